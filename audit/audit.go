@@ -0,0 +1,37 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/models"
+)
+
+// Entry is a single record of a change made to the system state, either by
+// an automated process (e.g., PDS policy evaluation) or by an operator.
+type Entry struct {
+	ID        models.ID `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string
+	Action    string
+	Target    string `gorm:"index"`
+	Details   string
+}
+
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Entry{})
+}
+
+func Record(ctx context.Context, db *gorm.DB, entry Entry) error {
+	if err := db.WithContext(ctx).Create(&entry).Error; err != nil {
+		return fmt.Errorf("writing audit log entry: %w", err)
+	}
+	return nil
+}
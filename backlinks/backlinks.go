@@ -0,0 +1,167 @@
+// Package backlinks maintains an index of references between records,
+// which allows to find all records that point to a given AT-URI or DID.
+package backlinks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/uabluerail/indexer/models"
+)
+
+// Backlink is a reference from a record to a target AT-URI or DID.
+type Backlink struct {
+	ID models.ID `gorm:"primarykey;index:idx_backlinks_target,priority:3"`
+	// Referencing record.
+	Repo       models.ID `gorm:"index:idx_backlinks_source,unique,priority:1;not null"`
+	Collection string    `gorm:"index:idx_backlinks_source,unique,priority:2;not null;index:idx_backlinks_target,priority:2"`
+	Rkey       string    `gorm:"index:idx_backlinks_source,unique,priority:3;not null"`
+	Path       string    `gorm:"index:idx_backlinks_source,unique,priority:4;not null"`
+	Target     string    `gorm:"index:idx_backlinks_source,unique,priority:5;not null;index:idx_backlinks_target,priority:1"`
+}
+
+func AutoMigrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Backlink{}); err != nil {
+		return err
+	}
+	// Authors of posts that were replied to, for the export of DIDs.
+	return db.Exec(`create index if not exists idx_backlinks_reply_parent_did
+		on backlinks (split_part(target, '/', 3))
+		where collection = 'app.bsky.feed.post' and path = 'reply.parent'`).Error
+}
+
+// Record identifies a record for which backlinks need to be updated.
+type Record struct {
+	Collection string
+	Rkey       string
+	// Nil if the record was deleted.
+	Content json.RawMessage
+}
+
+const batchSize = 500
+
+// Replace updates backlinks from the given records of the repo, removing
+// all references that are no longer present.
+func Replace(ctx context.Context, db *gorm.DB, repo models.ID, records []Record) error {
+	for start := 0; start < len(records); start += batchSize {
+		batch := records[start:min(start+batchSize, len(records))]
+
+		keys := [][]interface{}{}
+		links := []Backlink{}
+		for _, r := range batch {
+			keys = append(keys, []interface{}{r.Collection, r.Rkey})
+			if r.Content == nil {
+				continue
+			}
+			for _, ref := range ExtractRefs(r.Content) {
+				links = append(links, Backlink{
+					Repo:       repo,
+					Collection: r.Collection,
+					Rkey:       r.Rkey,
+					Path:       ref.Path,
+					Target:     ref.Target,
+				})
+			}
+		}
+
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Where("repo = ? AND (collection, rkey) IN ?", repo, keys).Delete(&Backlink{}).Error
+			if err != nil {
+				return fmt.Errorf("deleting old backlinks: %w", err)
+			}
+			if len(links) == 0 {
+				return nil
+			}
+			// Consumer and record indexer can update the same record
+			// concurrently, and the batch can list a record twice.
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error; err != nil {
+				return fmt.Errorf("inserting backlinks: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge deletes all backlinks from the repo's records, or only from the
+// given collections if any are specified.
+func Purge(ctx context.Context, db *gorm.DB, repo models.ID, collections []string) error {
+	q := db.WithContext(ctx).Where("repo = ?", repo)
+	if len(collections) > 0 {
+		q = q.Where("collection in ?", collections)
+	}
+	if err := q.Delete(&Backlink{}).Error; err != nil {
+		return fmt.Errorf("deleting backlinks: %w", err)
+	}
+	return nil
+}
+
+// Link is a record referencing the target.
+type Link struct {
+	ID         models.ID
+	DID        string `gorm:"column:did"`
+	Collection string
+	Rkey       string
+	Path       string
+}
+
+// URI returns the AT-URI of the referencing record.
+func (l Link) URI() string {
+	return fmt.Sprintf("at://%s/%s/%s", l.DID, l.Collection, l.Rkey)
+}
+
+// List returns records referencing the target, newest first. If collection
+// is not empty, only records from it are returned. Pass ID of the last
+// returned link as before to get the next page.
+func List(ctx context.Context, db *gorm.DB, target string, collection string, before models.ID, limit int) ([]Link, error) {
+	q := db.WithContext(ctx).Model(&Backlink{}).
+		Select("backlinks.id, repos.did, backlinks.collection, backlinks.rkey, backlinks.path").
+		Joins("join repos on repos.id = backlinks.repo").
+		Where("target = ?", target).
+		Order("backlinks.id desc").
+		Limit(limit)
+	if collection != "" {
+		q = q.Where("backlinks.collection = ?", collection)
+	}
+	if before != 0 {
+		q = q.Where("backlinks.id < ?", before)
+	}
+	links := []Link{}
+	if err := q.Scan(&links).Error; err != nil {
+		return nil, fmt.Errorf("querying backlinks: %w", err)
+	}
+	return links, nil
+}
+
+// Count is the number of references to the target from a given collection
+// and path, e.g. likes are counted under ("app.bsky.feed.like", "subject.uri").
+type Count struct {
+	Collection string `json:"collection"`
+	Path       string `json:"path"`
+	Count      int64  `json:"count"`
+}
+
+// Counts returns the number of references to the target, grouped by
+// collection and path.
+func Counts(ctx context.Context, db *gorm.DB, target string, collection string) ([]Count, error) {
+	q := db.WithContext(ctx).Model(&Backlink{}).
+		Select("collection, path, count(*) as count").
+		Where("target = ?", target).
+		Group("collection, path").
+		Order("collection, path")
+	if collection != "" {
+		q = q.Where("collection = ?", collection)
+	}
+	counts := []Count{}
+	if err := q.Scan(&counts).Error; err != nil {
+		return nil, fmt.Errorf("counting backlinks: %w", err)
+	}
+	return counts, nil
+}
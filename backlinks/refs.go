@@ -0,0 +1,97 @@
+package backlinks
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Ref is an outgoing reference from a record to an AT-URI or a DID.
+type Ref struct {
+	// Location of the reference within the record, e.g. "reply.parent".
+	Path   string
+	Target string
+}
+
+type strongRef struct {
+	URI string `json:"uri"`
+}
+
+type recordRefs struct {
+	// Either a DID (follows, blocks, list items) or a strong ref
+	// (likes, reposts, list blocks).
+	Subject json.RawMessage `json:"subject"`
+	Reply   *struct {
+		Parent *strongRef `json:"parent"`
+		Root   *strongRef `json:"root"`
+	} `json:"reply"`
+	Embed *struct {
+		// Either a strong ref (app.bsky.embed.record), or an object
+		// with a strong ref inside (app.bsky.embed.recordWithMedia).
+		Record json.RawMessage `json:"record"`
+	} `json:"embed"`
+	Facets []struct {
+		Features []struct {
+			Type string `json:"$type"`
+			DID  string `json:"did"`
+		} `json:"features"`
+	} `json:"facets"`
+}
+
+// ExtractRefs returns references to other records and accounts found in
+// the record. Content that doesn't look like a reference is ignored.
+func ExtractRefs(content json.RawMessage) []Ref {
+	rec := recordRefs{}
+	if err := json.Unmarshal(content, &rec); err != nil {
+		return nil
+	}
+
+	refs := []Ref{}
+	add := func(path string, target string) {
+		if !strings.HasPrefix(target, "at://") && !strings.HasPrefix(target, "did:") {
+			return
+		}
+		for _, r := range refs {
+			if r.Path == path && r.Target == target {
+				return
+			}
+		}
+		refs = append(refs, Ref{Path: path, Target: target})
+	}
+
+	if len(rec.Subject) > 0 {
+		var did string
+		ref := strongRef{}
+		if json.Unmarshal(rec.Subject, &did) == nil {
+			add("subject", did)
+		} else if json.Unmarshal(rec.Subject, &ref) == nil {
+			add("subject.uri", ref.URI)
+		}
+	}
+	if rec.Reply != nil {
+		if rec.Reply.Parent != nil {
+			add("reply.parent", rec.Reply.Parent.URI)
+		}
+		if rec.Reply.Root != nil {
+			add("reply.root", rec.Reply.Root.URI)
+		}
+	}
+	if rec.Embed != nil && len(rec.Embed.Record) > 0 {
+		ref := strongRef{}
+		withMedia := struct {
+			Record *strongRef `json:"record"`
+		}{}
+		if json.Unmarshal(rec.Embed.Record, &ref) == nil && ref.URI != "" {
+			add("embed.record", ref.URI)
+		} else if json.Unmarshal(rec.Embed.Record, &withMedia) == nil && withMedia.Record != nil {
+			add("embed.record", withMedia.Record.URI)
+		}
+	}
+	for _, facet := range rec.Facets {
+		for _, f := range facet.Features {
+			if f.Type == "app.bsky.richtext.facet#mention" {
+				add("facets.mention", f.DID)
+			}
+		}
+	}
+	return refs
+}
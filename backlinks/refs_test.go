@@ -0,0 +1,39 @@
+package backlinks
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExtractRefs(t *testing.T) {
+	type testCase struct {
+		input string
+		want  []Ref
+	}
+
+	cases := []testCase{
+		{`{"$type":"app.bsky.graph.follow","subject":"did:plc:a"}`,
+			[]Ref{{"subject", "did:plc:a"}}},
+		{`{"$type":"app.bsky.feed.like","subject":{"cid":"bafy","uri":"at://did:plc:a/app.bsky.feed.post/1"}}`,
+			[]Ref{{"subject.uri", "at://did:plc:a/app.bsky.feed.post/1"}}},
+		{`{"$type":"app.bsky.feed.post","text":"hi","reply":{"parent":{"uri":"at://did:plc:a/app.bsky.feed.post/2"},"root":{"uri":"at://did:plc:a/app.bsky.feed.post/1"}}}`,
+			[]Ref{{"reply.parent", "at://did:plc:a/app.bsky.feed.post/2"}, {"reply.root", "at://did:plc:a/app.bsky.feed.post/1"}}},
+		{`{"$type":"app.bsky.feed.post","embed":{"$type":"app.bsky.embed.record","record":{"uri":"at://did:plc:b/app.bsky.feed.post/3"}}}`,
+			[]Ref{{"embed.record", "at://did:plc:b/app.bsky.feed.post/3"}}},
+		{`{"$type":"app.bsky.feed.post","embed":{"$type":"app.bsky.embed.recordWithMedia","record":{"record":{"uri":"at://did:plc:b/app.bsky.feed.post/3"}},"media":{}}}`,
+			[]Ref{{"embed.record", "at://did:plc:b/app.bsky.feed.post/3"}}},
+		{`{"$type":"app.bsky.feed.post","facets":[{"features":[{"$type":"app.bsky.richtext.facet#mention","did":"did:plc:c"},{"$type":"app.bsky.richtext.facet#link","uri":"https://example.com"}]},{"features":[{"$type":"app.bsky.richtext.facet#mention","did":"did:plc:c"}]}]}`,
+			[]Ref{{"facets.mention", "did:plc:c"}}},
+		{`{"subject":"not a did"}`, []Ref{}},
+		{`{"subject":123}`, []Ref{}},
+		{`not json`, nil},
+	}
+
+	for _, tc := range cases {
+		got := ExtractRefs(json.RawMessage(tc.input))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ExtractRefs(%s) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
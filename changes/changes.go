@@ -0,0 +1,129 @@
+// Package changes implements an ordered feed of record changes, written
+// by the consumer and the record indexer and served by query-api.
+package changes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/util/fix"
+)
+
+// Where the change came from.
+const (
+	SourceFirehose = "firehose"
+	SourceBackfill = "backfill"
+)
+
+const (
+	ActionUpsert = "upsert"
+	ActionDelete = "delete"
+)
+
+// Change is a single record upsert or delete. Seq is assigned on insert
+// and is strictly increasing in the order changes become visible to
+// readers.
+type Change struct {
+	Seq        int64     `gorm:"primarykey;index:idx_record_changes_repo,priority:2;index:idx_record_changes_collection,priority:2" json:"seq"`
+	CreatedAt  time.Time `json:"time"`
+	Repo       string    `gorm:"not null;index:idx_record_changes_repo,priority:1" json:"repo"`
+	Collection string    `gorm:"not null;index:idx_record_changes_collection,priority:1" json:"collection"`
+	Rkey       string    `gorm:"not null" json:"rkey"`
+	Rev        string    `json:"rev"`
+	Action     string    `gorm:"not null" json:"action"`
+	Source     string    `gorm:"not null" json:"source"`
+	// Nil for deletes.
+	Content json.RawMessage `gorm:"type:JSONB" json:"record,omitempty"`
+}
+
+func (Change) TableName() string { return "record_changes" }
+
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Change{})
+}
+
+// Arbitrary constant used as the key for pg_advisory_xact_lock.
+const appendLockKey = 0x6368616e676573
+
+const batchSize = 500
+
+// Append adds changes to the feed.
+//
+// Sequence numbers are taken while holding an advisory lock, so that
+// transactions appending changes commit in the order of their sequence
+// numbers. Otherwise a reader could see a higher seq before a lower one
+// is committed, and skip the latter.
+func Append(ctx context.Context, db *gorm.DB, changes []Change) error {
+	for start := 0; start < len(changes); start += batchSize {
+		batch := changes[start:min(start+batchSize, len(changes))]
+		for i := range batch {
+			if batch[i].Content != nil {
+				batch[i].Content = fix.EscapeNullCharForPostgres(batch[i].Content)
+			}
+		}
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("select pg_advisory_xact_lock(?)", appendLockKey).Error; err != nil {
+				return fmt.Errorf("acquiring lock: %w", err)
+			}
+			return tx.Create(batch).Error
+		})
+		if err != nil {
+			return fmt.Errorf("appending changes: %w", err)
+		}
+	}
+	return nil
+}
+
+// Filter selects a subset of changes. Empty lists match everything.
+type Filter struct {
+	Collections []string
+	DIDs        []string
+}
+
+// Read returns up to limit changes with seq greater than after, in order.
+func Read(ctx context.Context, db *gorm.DB, after int64, filter Filter, limit int) ([]Change, error) {
+	q := db.WithContext(ctx).Where("seq > ?", after).Order("seq").Limit(limit)
+	if len(filter.Collections) > 0 {
+		q = q.Where("collection IN ?", filter.Collections)
+	}
+	if len(filter.DIDs) > 0 {
+		q = q.Where("repo IN ?", filter.DIDs)
+	}
+	r := []Change{}
+	if err := q.Find(&r).Error; err != nil {
+		return nil, fmt.Errorf("reading changes: %w", err)
+	}
+	return r, nil
+}
+
+// LastSeq returns the sequence number of the latest change, or 0 if the
+// feed is empty.
+func LastSeq(ctx context.Context, db *gorm.DB) (int64, error) {
+	var seq int64
+	err := db.WithContext(ctx).Model(&Change{}).Select("coalesce(max(seq), 0)").Scan(&seq).Error
+	if err != nil {
+		return 0, fmt.Errorf("querying last seq: %w", err)
+	}
+	return seq, nil
+}
+
+// Prune deletes changes created before the given time, with seq not greater
+// than upTo. Returns the number of deleted changes.
+func Prune(ctx context.Context, db *gorm.DB, before time.Time, upTo int64) (int64, error) {
+	var total int64
+	for {
+		r := db.WithContext(ctx).Exec(`delete from record_changes where seq in (
+			select seq from record_changes where created_at < ? and seq <= ? order by seq limit 10000)`, before, upTo)
+		if r.Error != nil {
+			return total, fmt.Errorf("deleting old changes: %w", r.Error)
+		}
+		total += r.RowsAffected
+		if r.RowsAffected == 0 {
+			return total, nil
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
@@ -24,28 +25,44 @@ import (
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/xrpc"
+	jsmodels "github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 
+	"github.com/uabluerail/indexer/backlinks"
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/graph"
+	"github.com/uabluerail/indexer/lexicon"
 	"github.com/uabluerail/indexer/models"
 	"github.com/uabluerail/indexer/pds"
 	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
 	"github.com/uabluerail/indexer/util/fix"
 	"github.com/uabluerail/indexer/util/resolver"
 )
 
 const lastRevUpdateInterval = 24 * time.Hour
 
+// errCursorChanged is returned when the cursor stored in the database was
+// changed by someone else (e.g., by an operator via admin API).
+var errCursorChanged = errors.New("cursor was changed externally")
+
 type Consumer struct {
-	db                  *gorm.DB
-	recordsDB           *gocqlx.Session
-	remote              pds.PDS
-	running             chan struct{}
-	collectionBlacklist map[string]bool
-	contactInfo         string
+	db          *gorm.DB
+	recordsDB   *gocqlx.Session
+	remote      pds.PDS
+	running     chan struct{}
+	router      *routing.Router
+	validator   *lexicon.Validator
+	contactInfo string
+	changeFeed  bool
+	relay       *Relay
+	jetstream   *JetstreamServer
 
 	lastCursorPersist time.Time
+	// Cursor value that we've last written to or read from the database.
+	persistedCursor int64
 }
 
 func NewConsumer(ctx context.Context, remote *pds.PDS, db *gorm.DB, session *gocqlx.Session, contactInfo string) (*Consumer, error) {
@@ -54,19 +71,42 @@ func NewConsumer(ctx context.Context, remote *pds.PDS, db *gorm.DB, session *goc
 	}
 
 	return &Consumer{
-		db:                  db,
-		recordsDB:           session,
-		remote:              *remote,
-		running:             make(chan struct{}),
-		collectionBlacklist: map[string]bool{},
-		contactInfo:         contactInfo,
+		db:              db,
+		recordsDB:       session,
+		remote:          *remote,
+		running:         make(chan struct{}),
+		contactInfo:     contactInfo,
+		persistedCursor: remote.Cursor,
 	}, nil
 }
 
-func (c *Consumer) BlacklistCollections(colls []string) {
-	for _, coll := range colls {
-		c.collectionBlacklist[coll] = true
-	}
+// SetRouter sets the rules for storing records of each collection.
+func (c *Consumer) SetRouter(r *routing.Router) {
+	c.router = r
+}
+
+// SetValidator sets the validator for checking records against their
+// lexicons.
+func (c *Consumer) SetValidator(v *lexicon.Validator) {
+	c.validator = v
+}
+
+// EnableChangeFeed makes the consumer append all record changes to the
+// change feed.
+func (c *Consumer) EnableChangeFeed() {
+	c.changeFeed = true
+}
+
+// SetRelay makes the consumer re-broadcast processed commits via the
+// given relay.
+func (c *Consumer) SetRelay(r *Relay) {
+	c.relay = r
+}
+
+// SetJetstream makes the consumer send processed commits, identity and
+// account events to the given Jetstream server.
+func (c *Consumer) SetJetstream(s *JetstreamServer) {
+	c.jetstream = s
 }
 
 func (c *Consumer) Start(ctx context.Context) error {
@@ -109,12 +149,24 @@ func (c *Consumer) run(ctx context.Context) {
 			reposDiscovered.DeletePartialMatch(prometheus.Labels{"remote": c.remote.Host})
 			postsByLanguageIndexed.DeletePartialMatch(prometheus.Labels{"remote": c.remote.Host})
 			pdsOnline.DeletePartialMatch(prometheus.Labels{"remote": c.remote.Host})
+			consecutiveFailures.DeletePartialMatch(prometheus.Labels{"remote": c.remote.Host})
 			return
 		default:
 			start := time.Now()
 			if err := c.runOnce(ctx); err != nil {
 				log.Error().Err(err).Msgf("Consumer of %q failed (will be restarted): %s", c.remote.Host, err)
 				connectionFailures.WithLabelValues(c.remote.Host).Inc()
+				if ctx.Err() == nil && !errors.Is(err, errCursorChanged) {
+					if err := pds.RecordFailure(ctx, c.db, &c.remote, err, "consumer"); err != nil {
+						log.Error().Err(err).Msgf("Failed to update health status: %s", err)
+					}
+					consecutiveFailures.WithLabelValues(c.remote.Host).Set(float64(c.remote.ConsecutiveFailures))
+				}
+				if errors.Is(err, errCursorChanged) {
+					if err := c.reload(ctx); err != nil {
+						log.Error().Err(err).Msgf("Failed to reload PDS info: %s", err)
+					}
+				}
 			}
 			if time.Since(start) > backoffTimer.MaxInterval*3 {
 				// XXX: assume that c.runOnce did some useful work in this case,
@@ -157,6 +209,11 @@ func (c *Consumer) runOnce(ctx context.Context) error {
 	pdsOnline.WithLabelValues(c.remote.Host).Set(1)
 	defer func() { pdsOnline.WithLabelValues(c.remote.Host).Set(0) }()
 
+	if err := pds.RecordSuccess(ctx, c.db, &c.remote); err != nil {
+		log.Error().Err(err).Msgf("Failed to update health status: %s", err)
+	}
+	consecutiveFailures.WithLabelValues(c.remote.Host).Set(0)
+
 	ch := make(chan bool)
 	defer close(ch)
 	go func() {
@@ -260,18 +317,36 @@ func (c *Consumer) updateCursor(ctx context.Context, seq int64) error {
 		return nil
 	}
 
-	err := c.db.Model(&c.remote).
-		Where(&pds.PDS{ID: c.remote.ID}).
-		Updates(&pds.PDS{Cursor: seq}).Error
-	if err != nil {
-		return fmt.Errorf("updating Cursor: %w", err)
+	// Also bump LastConnectedAt, so that a long-living connection keeps
+	// counting as a proof that the PDS is alive.
+	now := time.Now()
+	result := c.db.Model(&pds.PDS{}).
+		Where("id = ? AND coalesce(cursor, 0) = ?", c.remote.ID, c.persistedCursor).
+		Updates(&pds.PDS{Cursor: seq, LastConnectedAt: now, LastEventAt: now})
+	if result.Error != nil {
+		return fmt.Errorf("updating Cursor: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errCursorChanged
 	}
 	c.remote.Cursor = seq
-	c.lastCursorPersist = time.Now()
+	c.persistedCursor = seq
+	c.lastCursorPersist = now
 	return nil
 
 }
 
+// reload re-reads the PDS row from the database.
+func (c *Consumer) reload(ctx context.Context) error {
+	remote := pds.PDS{}
+	if err := c.db.WithContext(ctx).Model(&remote).Where(&pds.PDS{ID: c.remote.ID}).Take(&remote).Error; err != nil {
+		return err
+	}
+	c.remote = remote
+	c.persistedCursor = remote.Cursor
+	return nil
+}
+
 func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader, first bool) error {
 	log := zerolog.Ctx(ctx)
 
@@ -352,13 +427,17 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 				deletions = append(deletions, op.Path)
 			}
 		}
-		if c.recordsDB != nil && len(deletions) > 0 {
-			for _, d := range deletions {
-				parts := strings.SplitN(d, "/", 2)
-				if len(parts) != 2 {
-					continue
-				}
+		for _, d := range deletions {
+			parts := strings.SplitN(d, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			route := c.router.Route(parts[0])
+			if route.Action == routing.Drop {
+				continue
+			}
 
+			if c.recordsDB != nil && route.Table == "" {
 				err := c.recordsDB.Query(qb.Insert("bluesky.records").
 					Columns("repo", "collection", "rkey", "at_rev", "deleted", "created_at").
 					ToCql()).WithContext(ctx).
@@ -366,27 +445,22 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 				if err != nil {
 					return fmt.Errorf("failed to mark %s/%s as deleted: %w", payload.Repo, d, err)
 				}
+				continue
 			}
-
-		} else {
-			for _, d := range deletions {
-				parts := strings.SplitN(d, "/", 2)
-				if len(parts) != 2 {
-					continue
-				}
-				err := c.db.Model(&repo.Record{}).
-					Where(&repo.Record{
-						Repo:       models.ID(repoInfo.ID),
-						Collection: parts[0],
-						Rkey:       parts[1]}).
-					Updates(&repo.Record{Deleted: true}).Error
-				if err != nil {
-					return fmt.Errorf("failed to mark %s/%s as deleted: %w", payload.Repo, d, err)
-				}
+			// Bump the rev too, so that an older version can't bring the
+			// record back.
+			err := c.db.Model(&repo.Record{}).Table(cmp.Or(route.Table, routing.DefaultTable)).
+				Where(&repo.Record{
+					Repo:       models.ID(repoInfo.ID),
+					Collection: parts[0],
+					Rkey:       parts[1]}).
+				Updates(&repo.Record{Deleted: true, AtRev: payload.Rev}).Error
+			if err != nil {
+				return fmt.Errorf("failed to mark %s/%s as deleted: %w", payload.Repo, d, err)
 			}
 		}
 
-		newRecs, err := repo.ExtractRecords(ctx, bytes.NewReader(payload.Blocks), repoInfo.LastKnownKey)
+		newRecs, cids, err := repo.ExtractRecords(ctx, bytes.NewReader(payload.Blocks), repoInfo.LastKnownKey)
 		if errors.Is(err, repo.ErrInvalidSignature) {
 			// Key might have been updated recently.
 			_, pubKey, err2 := resolver.GetPDSEndpointAndPublicKey(ctx, payload.Repo)
@@ -401,7 +475,7 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 				}
 
 				// Retry with the new key.
-				newRecs, err = repo.ExtractRecords(ctx, bytes.NewReader(payload.Blocks), pubKey)
+				newRecs, cids, err = repo.ExtractRecords(ctx, bytes.NewReader(payload.Blocks), pubKey)
 			}
 		}
 
@@ -410,15 +484,42 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 		}
 
 		recs := []repo.Record{}
+		// Records to store, grouped by Postgres table. Records for ScyllaDB
+		// are under the empty key.
+		stored := map[string][]repo.Record{}
+		invalid := []repo.InvalidRecord{}
+		// Keys of records that are no longer invalid, if they were before.
+		fixed := map[string]bool{}
+		for _, d := range deletions {
+			fixed[d] = true
+		}
 		for k, v := range newRecs {
 			parts := strings.SplitN(k, "/", 2)
 			if len(parts) != 2 {
 				log.Warn().Msgf("Unexpected key format: %q", k)
 				continue
 			}
-			if c.collectionBlacklist[parts[0]] {
+			route := c.router.Route(parts[0])
+			if route.Action == routing.Drop {
 				continue
 			}
+			if err := c.validator.Validate(parts[0], v); err != nil {
+				recordValidationErrors.WithLabelValues(parts[0]).Inc()
+				invalid = append(invalid, repo.InvalidRecord{
+					Repo:       models.ID(repoInfo.ID),
+					Collection: parts[0],
+					Rkey:       parts[1],
+					AtRev:      payload.Rev,
+					Content:    fix.EscapeNullCharForPostgres(v),
+					Error:      err.Error(),
+					Rejected:   c.validator.Strict(),
+				})
+				if c.validator.Strict() {
+					continue
+				}
+			} else {
+				fixed[k] = true
+			}
 			langs, _, err := repo.GetLang(ctx, v)
 			if err == nil {
 				for _, lang := range langs {
@@ -429,6 +530,7 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 				Repo:       models.ID(repoInfo.ID),
 				Collection: parts[0],
 				Rkey:       parts[1],
+				CID:        cids[k].String(),
 				Content:    v,
 				AtRev:      payload.Rev,
 			}
@@ -439,38 +541,103 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 				rec.Content = fix.EscapeNullCharForPostgres(rec.Content)
 			}
 			recs = append(recs, rec)
+
+			table := route.Table
+			if table == "" && c.recordsDB == nil {
+				table = routing.DefaultTable
+			}
+			switch {
+			case route.Action == routing.Metadata:
+				rec.Content = nil
+			case table != "" && c.recordsDB != nil:
+				// Routed to Postgres from ScyllaDB mode.
+				rec.Content = fix.EscapeNullCharForPostgres(rec.Content)
+			}
+			stored[table] = append(stored[table], rec)
 		}
-		if len(c.collectionBlacklist) == 0 && len(recs) == 0 && expectRecords {
+		if len(newRecs) == 0 && expectRecords {
 			log.Debug().Int64("seq", payload.Seq).Str("pds", c.remote.Host).Msgf("len(recs) == 0")
 		}
-		if len(recs) > 0 {
-			if c.recordsDB != nil {
+		for table, recs := range stored {
+			if table == "" {
 				for _, r := range recs {
 					err := c.recordsDB.Query(qb.Insert("bluesky.records").
-						Columns("repo", "collection", "rkey", "at_rev", "record", "created_at").
+						Columns("repo", "collection", "rkey", "at_rev", "cid", "record", "created_at").
 						ToCql()).WithContext(ctx).
-						Bind(repoInfo.DID, r.Collection, r.Rkey, r.AtRev, r.Content, time.Now()).ExecRelease()
+						Bind(repoInfo.DID, r.Collection, r.Rkey, r.AtRev, r.CID, r.Content, time.Now()).ExecRelease()
 					if err != nil {
 						return fmt.Errorf("inserting record %s/%s/%s into the database: %w", repoInfo.DID, r.Collection, r.Rkey, err)
 					}
 				}
+				continue
+			}
 
-			} else {
-				err = c.db.Model(&repo.Record{}).
-					Clauses(clause.OnConflict{
-						Where: clause.Where{Exprs: []clause.Expression{clause.Or(
-							clause.Eq{Column: clause.Column{Name: "at_rev", Table: "records"}, Value: nil},
-							clause.Eq{Column: clause.Column{Name: "at_rev", Table: "records"}, Value: ""},
-							clause.Lt{
-								Column: clause.Column{Name: "at_rev", Table: "records"},
-								Value:  clause.Column{Name: "at_rev", Table: "excluded"}},
-						)}},
-						DoUpdates: clause.AssignmentColumns([]string{"content", "at_rev"}),
-						Columns:   []clause.Column{{Name: "repo"}, {Name: "collection"}, {Name: "rkey"}}}).
-					Create(recs).Error
-				if err != nil {
-					return fmt.Errorf("inserting records into the database: %w", err)
+			err = c.db.Model(&repo.Record{}).Table(table).
+				Clauses(clause.OnConflict{
+					Where: clause.Where{Exprs: []clause.Expression{clause.Or(
+						clause.Eq{Column: clause.Column{Name: "at_rev", Table: table}, Value: nil},
+						clause.Eq{Column: clause.Column{Name: "at_rev", Table: table}, Value: ""},
+						clause.Lt{
+							Column: clause.Column{Name: "at_rev", Table: table},
+							Value:  clause.Column{Name: "at_rev", Table: "excluded"}},
+					)}},
+					DoUpdates: clause.AssignmentColumns([]string{"content", "cid", "at_rev", "deleted"}),
+					Columns:   []clause.Column{{Name: "repo"}, {Name: "collection"}, {Name: "rkey"}}}).
+				Create(recs).Error
+			if err != nil {
+				return fmt.Errorf("inserting records into %q: %w", table, err)
+			}
+		}
+
+		if err := repo.SaveInvalidRecords(ctx, c.db, invalid); err != nil {
+			return fmt.Errorf("saving invalid records for %q: %w", repoInfo.DID, err)
+		}
+		err = repo.ClearInvalidRecords(ctx, c.db, models.ID(repoInfo.ID), payload.Rev, func(collection string, rkey string) bool {
+			return fixed[collection+"/"+rkey]
+		})
+		if err != nil {
+			return fmt.Errorf("clearing invalid records for %q: %w", repoInfo.DID, err)
+		}
+
+		linked := []backlinks.Record{}
+		for _, d := range deletions {
+			parts := strings.SplitN(d, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if c.router.Route(parts[0]).Action == routing.Drop {
+				continue
+			}
+			linked = append(linked, backlinks.Record{Collection: parts[0], Rkey: parts[1]})
+		}
+		for _, r := range recs {
+			linked = append(linked, backlinks.Record{Collection: r.Collection, Rkey: r.Rkey, Content: r.Content})
+		}
+		if err := backlinks.Replace(ctx, c.db, repoInfo.ID, linked); err != nil {
+			return fmt.Errorf("updating backlinks for %q: %w", repoInfo.DID, err)
+		}
+		if err := graph.Update(ctx, c.db, repoInfo.DID, linked); err != nil {
+			return fmt.Errorf("updating graph edges for %q: %w", repoInfo.DID, err)
+		}
+		if c.changeFeed {
+			feed := []changes.Change{}
+			for _, r := range linked {
+				action := changes.ActionUpsert
+				if r.Content == nil {
+					action = changes.ActionDelete
 				}
+				feed = append(feed, changes.Change{
+					Repo:       repoInfo.DID,
+					Collection: r.Collection,
+					Rkey:       r.Rkey,
+					Rev:        payload.Rev,
+					Action:     action,
+					Source:     changes.SourceFirehose,
+					Content:    r.Content,
+				})
+			}
+			if err := changes.Append(ctx, c.db, feed); err != nil {
+				return fmt.Errorf("appending changes for %q: %w", repoInfo.DID, err)
 			}
 		}
 
@@ -500,6 +667,9 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 			if err != nil {
 				return fmt.Errorf("failed to update repo info after cursor reset: %w", err)
 			}
+			if err := repo.RaisePriority(ctx, c.db, repoInfo.ID, repo.PriorityTooBig); err != nil {
+				return fmt.Errorf("failed to raise fetch priority: %w", err)
+			}
 		}
 
 		if repoInfo.FirstCursorSinceReset != c.remote.FirstCursorSinceReset {
@@ -511,6 +681,50 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 			if err != nil {
 				return fmt.Errorf("failed to update repo info after cursor reset: %w", err)
 			}
+			if repoInfo.FirstCursorSinceReset != 0 {
+				// Not the first event we see for this repo, so
+				// there might be a gap in the data.
+				if err := repo.RaisePriority(ctx, c.db, repoInfo.ID, repo.PriorityCursorReset); err != nil {
+					return fmt.Errorf("failed to raise fetch priority: %w", err)
+				}
+			}
+		}
+
+		if c.relay != nil {
+			if err := c.relay.Publish(payload); err != nil {
+				log.Error().Err(err).Msgf("Failed to re-broadcast commit %d: %s", payload.Seq, err)
+			}
+		}
+		if c.jetstream != nil {
+			events := []*jsmodels.Event{}
+			for _, op := range payload.Ops {
+				parts := strings.SplitN(op.Path, "/", 2)
+				if len(parts) != 2 || c.router.Route(parts[0]).Action == routing.Drop {
+					continue
+				}
+				commit := &jsmodels.Commit{
+					Rev:        payload.Rev,
+					Operation:  op.Action,
+					Collection: parts[0],
+					RKey:       parts[1],
+				}
+				if op.Action != jsmodels.CommitOperationDelete {
+					content, found := newRecs[op.Path]
+					if !found || op.Cid == nil {
+						continue
+					}
+					commit.Record = content
+					commit.CID = op.Cid.String()
+				}
+				events = append(events, &jsmodels.Event{
+					Did:    payload.Repo,
+					Kind:   jsmodels.EventKindCommit,
+					Commit: commit,
+				})
+			}
+			if err := c.jetstream.Publish(events); err != nil {
+				log.Error().Err(err).Msgf("Failed to send commit %d to Jetstream subscribers: %s", payload.Seq, err)
+			}
 		}
 
 		if err := c.updateCursor(ctx, payload.Seq); err != nil {
@@ -595,10 +809,38 @@ func (c *Consumer) processMessage(ctx context.Context, typ string, r io.Reader,
 
 		resolver.Resolver.FlushCacheFor(payload.Did)
 
+		if c.jetstream != nil {
+			err := c.jetstream.Publish([]*jsmodels.Event{{
+				Did:      payload.Did,
+				Kind:     jsmodels.EventKindIdentity,
+				Identity: payload,
+			}})
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to send identity event %d to Jetstream subscribers: %s", payload.Seq, err)
+			}
+		}
+
 		// TODO: fetch DID doc and update PDS field?
 
 	case "#account":
-		// Ignore for now.
+		if c.jetstream == nil {
+			// Ignore for now.
+			break
+		}
+		payload := &comatproto.SyncSubscribeRepos_Account{}
+		if err := payload.UnmarshalCBOR(r); err != nil {
+			return fmt.Errorf("failed to unmarshal account event: %w", err)
+		}
+		exportEventTimestamp(ctx, c.remote.Host, payload.Time)
+
+		err := c.jetstream.Publish([]*jsmodels.Event{{
+			Did:     payload.Did,
+			Kind:    jsmodels.EventKindAccount,
+			Account: payload,
+		}})
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to send account event %d to Jetstream subscribers: %s", payload.Seq, err)
+		}
 
 	default:
 		b, err := io.ReadAll(r)
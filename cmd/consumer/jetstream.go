@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+)
+
+const (
+	maxWantedCollections = 100
+	maxWantedDIDs        = 10000
+)
+
+// JetstreamServer serves events in Jetstream's JSON format. Events are
+// identified by their time_us, which is made strictly increasing, so that
+// it can be used as a cursor. Events are kept on disk for replay.
+type JetstreamServer struct {
+	log      *replayLog
+	upgrader websocket.Upgrader
+	encoder  *zstd.Encoder
+
+	mu          sync.Mutex
+	lastTime    int64
+	subscribers map[*jetstreamSubscriber]bool
+}
+
+type jetstreamFrame struct {
+	timeUS     int64
+	did        string
+	collection string
+	data       []byte
+	// Compresses data on first use, so that it's done once per event and
+	// only if there are subscribers that want it.
+	compressed func() []byte
+}
+
+type jetstreamSubscriber struct {
+	ch chan jetstreamFrame
+}
+
+func NewJetstreamServer(dir string, maxSize int64) (*JetstreamServer, error) {
+	l, err := openReplayLog(dir, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("opening replay log: %w", err)
+	}
+	// Same parameters as Jetstream itself uses, so that clients can
+	// decompress with the shared dictionary.
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(models.ZSTDDictionary),
+		zstd.WithWindowSize(1<<17), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("creating zstd encoder: %w", err)
+	}
+	return &JetstreamServer{
+		log:         l,
+		encoder:     encoder,
+		lastTime:    l.LastSeq(),
+		subscribers: map[*jetstreamSubscriber]bool{},
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}, nil
+}
+
+func (s *JetstreamServer) Close() error {
+	return s.log.Close()
+}
+
+// Publish assigns time_us to the events and sends them to subscribers.
+func (s *JetstreamServer) Publish(events []*models.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, evt := range events {
+		evt.TimeUS = max(time.Now().UnixMicro(), s.lastTime+1)
+		data, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("marshaling event: %w", err)
+		}
+		if err := s.log.Append(evt.TimeUS, data); err != nil {
+			return fmt.Errorf("writing to replay log: %w", err)
+		}
+		s.lastTime = evt.TimeUS
+
+		if len(s.subscribers) == 0 {
+			continue
+		}
+		frame := jetstreamFrame{
+			timeUS:     evt.TimeUS,
+			did:        evt.Did,
+			data:       data,
+			compressed: sync.OnceValue(func() []byte { return s.encoder.EncodeAll(data, nil) }),
+		}
+		if evt.Commit != nil {
+			frame.collection = evt.Commit.Collection
+		}
+		for sub := range s.subscribers {
+			select {
+			case sub.ch <- frame:
+			default:
+				// Too slow, disconnect.
+				delete(s.subscribers, sub)
+				close(sub.ch)
+				jetstreamSubscribersDropped.Inc()
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JetstreamServer) subscribe() (*jetstreamSubscriber, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := &jetstreamSubscriber{ch: make(chan jetstreamFrame, subscriberBufferSize)}
+	s.subscribers[sub] = true
+	jetstreamSubscribers.Set(float64(len(s.subscribers)))
+	return sub, s.lastTime
+}
+
+func (s *JetstreamServer) unsubscribe(sub *jetstreamSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.ch)
+	}
+	jetstreamSubscribers.Set(float64(len(s.subscribers)))
+}
+
+// jetstreamFilter implements wantedCollections and wantedDids.
+type jetstreamFilter struct {
+	collections map[string]bool
+	prefixes    []string
+	dids        map[string]bool
+}
+
+func parseJetstreamFilter(q map[string][]string) (*jetstreamFilter, error) {
+	f := &jetstreamFilter{collections: map[string]bool{}, dids: map[string]bool{}}
+	for _, c := range q["wantedCollections"] {
+		if strings.HasSuffix(c, ".*") {
+			f.prefixes = append(f.prefixes, strings.TrimSuffix(c, "*"))
+			continue
+		}
+		if _, err := syntax.ParseNSID(c); err != nil {
+			return nil, fmt.Errorf("invalid collection %q", c)
+		}
+		f.collections[c] = true
+	}
+	for _, d := range q["wantedDids"] {
+		if _, err := syntax.ParseDID(d); err != nil {
+			return nil, fmt.Errorf("invalid DID %q", d)
+		}
+		f.dids[d] = true
+	}
+	if len(f.collections)+len(f.prefixes) > maxWantedCollections {
+		return nil, fmt.Errorf("too many wanted collections, at most %d are allowed", maxWantedCollections)
+	}
+	if len(f.dids) > maxWantedDIDs {
+		return nil, fmt.Errorf("too many wanted DIDs, at most %d are allowed", maxWantedDIDs)
+	}
+	return f, nil
+}
+
+// Match returns true if the event should be sent. Events without
+// a collection (identity and account) are only filtered by DID.
+func (f *jetstreamFilter) Match(did string, collection string) bool {
+	if len(f.dids) > 0 && !f.dids[did] {
+		return false
+	}
+	if collection == "" || len(f.collections)+len(f.prefixes) == 0 {
+		return true
+	}
+	if f.collections[collection] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(collection, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements Jetstream's /subscribe endpoint.
+func (s *JetstreamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	log := zerolog.Ctx(ctx)
+
+	q := req.URL.Query()
+	filter, err := parseJetstreamFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cursor *int64
+	if c := q.Get("cursor"); c != "" {
+		v, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid cursor: %s", c), http.StatusBadRequest)
+			return
+		}
+		// Same as Jetstream: a cursor in the future means live tail.
+		if v <= time.Now().UnixMicro() {
+			cursor = &v
+		}
+	}
+	compress := strings.Contains(req.Header.Get("Socket-Encoding"), "zstd") || q.Get("compress") == "true"
+
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Jetstream clients can send options updates, we don't support those
+	// and just read to process control frames.
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		t := time.NewTicker(relayPingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(relayWriteTimeout))
+			}
+		}
+	}()
+
+	send := func(data []byte, compressed func() []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+		var err error
+		if compress {
+			var b []byte
+			if compressed != nil {
+				b = compressed()
+			} else {
+				b = s.encoder.EncodeAll(data, nil)
+			}
+			err = conn.WriteMessage(websocket.BinaryMessage, b)
+		} else {
+			err = conn.WriteMessage(websocket.TextMessage, data)
+		}
+		if err != nil {
+			return err
+		}
+		jetstreamEventsSent.Inc()
+		return nil
+	}
+
+	replay := func(timeUS int64, data []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		evt := struct {
+			Did    string `json:"did"`
+			Commit *struct {
+				Collection string `json:"collection"`
+			} `json:"commit"`
+		}{}
+		if err := json.Unmarshal(data, &evt); err != nil {
+			log.Error().Err(err).Msgf("Failed to parse event %d: %s", timeUS, err)
+			return nil
+		}
+		collection := ""
+		if evt.Commit != nil {
+			collection = evt.Commit.Collection
+		}
+		if !filter.Match(evt.Did, collection) {
+			return nil
+		}
+		return send(data, nil)
+	}
+	replayFailed := func(err error) {
+		if ctx.Err() == nil {
+			log.Debug().Err(err).Msgf("Replay failed: %s", err)
+		}
+	}
+
+	var last int64
+	if cursor != nil {
+		// Catch up from disk before subscribing, otherwise live events
+		// would overflow the subscriber's buffer during a long replay.
+		last, err = s.log.ReadToHead(*cursor-1, subscriberBufferSize/2, replay)
+		if err != nil {
+			replayFailed(err)
+			return
+		}
+	}
+
+	sub, head := s.subscribe()
+	defer s.unsubscribe(sub)
+	if cursor != nil {
+		// Events published since the last replay pass.
+		if err := s.log.Read(last, head, replay); err != nil {
+			replayFailed(err)
+			return
+		}
+	}
+	last = max(last, head)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-sub.ch:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "consumer too slow"),
+					time.Now().Add(relayWriteTimeout))
+				return
+			}
+			if frame.timeUS <= last || !filter.Match(frame.did, frame.collection) {
+				continue
+			}
+			if err := send(frame.data, frame.compressed); err != nil {
+				return
+			}
+			last = frame.timeUS
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestJetstreamFilter(t *testing.T) {
+	type testCase struct {
+		query      string
+		did        string
+		collection string
+		want       bool
+	}
+
+	cases := []testCase{
+		{"", "did:plc:a", "app.bsky.feed.post", true},
+		{"wantedCollections=app.bsky.feed.post", "did:plc:a", "app.bsky.feed.post", true},
+		{"wantedCollections=app.bsky.feed.post", "did:plc:a", "app.bsky.feed.like", false},
+		{"wantedCollections=app.bsky.graph.*", "did:plc:a", "app.bsky.graph.follow", true},
+		{"wantedCollections=app.bsky.graph.*", "did:plc:a", "app.bsky.graphx.follow", false},
+		{"wantedCollections=app.bsky.graph.*", "did:plc:a", "", true},
+		{"wantedDids=did:plc:a", "did:plc:a", "app.bsky.feed.post", true},
+		{"wantedDids=did:plc:a", "did:plc:b", "app.bsky.feed.post", false},
+		{"wantedDids=did:plc:a", "did:plc:b", "", false},
+		{"wantedDids=did:plc:a&wantedCollections=app.bsky.feed.like", "did:plc:a", "app.bsky.feed.post", false},
+	}
+
+	for _, tc := range cases {
+		q, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatalf("url.ParseQuery(%q): %s", tc.query, err)
+		}
+		f, err := parseJetstreamFilter(q)
+		if err != nil {
+			t.Errorf("parseJetstreamFilter(%q): %s", tc.query, err)
+			continue
+		}
+		if got := f.Match(tc.did, tc.collection); got != tc.want {
+			t.Errorf("%q: Match(%q, %q) = %v, want %v", tc.query, tc.did, tc.collection, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"wantedCollections=not_an_nsid", "wantedDids=plc:a"} {
+		q, _ := url.ParseQuery(query)
+		if _, err := parseJetstreamFilter(q); err == nil {
+			t.Errorf("parseJetstreamFilter(%q) succeeded, expected an error", query)
+		}
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -30,7 +31,11 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/uabluerail/indexer/lexicon"
 	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/pds/admin"
+	"github.com/uabluerail/indexer/routing"
+	"github.com/uabluerail/indexer/util/adminserver"
 	"github.com/uabluerail/indexer/util/gormzerolog"
 )
 
@@ -41,8 +46,22 @@ type Config struct {
 	MetricsPort         string   `split_words:"true"`
 	DBUrl               string   `envconfig:"POSTGRES_URL"`
 	CollectionBlacklist []string `split_words:"true"`
+	CollectionAllowlist []string `split_words:"true"`
+	CollectionRoutes    []string `split_words:"true"`
+	RecordValidation    string   `split_words:"true" default:"off"`
+	LexiconDir          string   `split_words:"true"`
 	ScyllaDBAddr        string   `envconfig:"SCYLLADB_ADDR"`
 	ContactInfo         string   `split_words:"true"`
+	PDSPolicyFile       string   `envconfig:"PDS_POLICY_FILE"`
+	ChangeFeed          bool     `split_words:"true"`
+	RelayPort           string   `split_words:"true"`
+	RelayDir            string   `split_words:"true" default:"relay"`
+	RelayMaxSize        int64    `split_words:"true" default:"10737418240"`
+	JetstreamPort       string   `split_words:"true"`
+	JetstreamDir        string   `split_words:"true" default:"jetstream"`
+	JetstreamMaxSize    int64    `split_words:"true" default:"10737418240"`
+
+	Admin adminserver.Config
 }
 
 var config Config
@@ -95,8 +114,64 @@ func runMain(ctx context.Context) error {
 		session = &s
 	}
 
+	if err := pds.WatchPolicy(ctx, db, config.PDSPolicyFile, "consumer"); err != nil {
+		return fmt.Errorf("loading PDS policy: %w", err)
+	}
+
+	router, err := routing.New(config.CollectionAllowlist, config.CollectionBlacklist, config.CollectionRoutes)
+	if err != nil {
+		return fmt.Errorf("parsing collection routes: %w", err)
+	}
+	if err := router.CheckTables(ctx, db); err != nil {
+		return err
+	}
+
+	validator, err := lexicon.NewValidator(lexicon.Mode(config.RecordValidation), config.LexiconDir)
+	if err != nil {
+		return fmt.Errorf("loading lexicons: %w", err)
+	}
+
+	var relay *Relay
+	if config.RelayPort != "" {
+		relay, err = NewRelay(config.RelayDir, config.RelayMaxSize)
+		if err != nil {
+			return fmt.Errorf("creating relay: %w", err)
+		}
+		defer relay.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/xrpc/com.atproto.sync.subscribeRepos", relay)
+		log.Info().Msgf("Starting relay listener on %q...", config.RelayPort)
+		go serveStream(ctx, "Relay", config.RelayPort, mux)
+	}
+
+	var jetstream *JetstreamServer
+	if config.JetstreamPort != "" {
+		jetstream, err = NewJetstreamServer(config.JetstreamDir, config.JetstreamMaxSize)
+		if err != nil {
+			return fmt.Errorf("creating Jetstream server: %w", err)
+		}
+		defer jetstream.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/subscribe", jetstream)
+		log.Info().Msgf("Starting Jetstream listener on %q...", config.JetstreamPort)
+		go serveStream(ctx, "Jetstream", config.JetstreamPort, mux)
+	}
+
 	consumersCh := make(chan struct{})
-	go runConsumers(ctx, db, session, consumersCh)
+	go runConsumers(ctx, db, session, router, validator, relay, jetstream, pds.ListenForChanges(ctx, conn), consumersCh)
+
+	adminSrv, err := adminserver.New(config.Admin)
+	if err != nil {
+		return fmt.Errorf("creating admin server: %w", err)
+	}
+	admin.AddHandlers(adminSrv, db, "consumer")
+	go func() {
+		if err := adminSrv.ListenAndServe(ctx); err != nil {
+			log.Error().Err(err).Msgf("Admin HTTP server failed: %s", err)
+		}
+	}()
 
 	log.Info().Msgf("Starting HTTP listener on %q...", config.MetricsPort)
 	http.Handle("/metrics", promhttp.Handler())
@@ -116,7 +191,24 @@ func runMain(ctx context.Context) error {
 	return <-errCh
 }
 
-func runConsumers(ctx context.Context, db *gorm.DB, session *gocqlx.Session, doneCh chan struct{}) {
+// serveStream runs an HTTP server for long-lived streaming connections,
+// until the context is cancelled.
+func serveStream(ctx context.Context, name string, port string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:        fmt.Sprintf(":%s", port),
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("%s HTTP server failed: %s", name, err)
+	}
+}
+
+func runConsumers(ctx context.Context, db *gorm.DB, session *gocqlx.Session, router *routing.Router, validator *lexicon.Validator, relay *Relay, jetstream *JetstreamServer, changes <-chan string, doneCh chan struct{}) {
 	log := zerolog.Ctx(ctx)
 	defer close(doneCh)
 
@@ -170,7 +262,17 @@ func runConsumers(ctx context.Context, db *gorm.DB, session *gocqlx.Session, don
 					cancel()
 					continue
 				}
-				c.BlacklistCollections(config.CollectionBlacklist)
+				c.SetRouter(router)
+				c.SetValidator(validator)
+				if config.ChangeFeed {
+					c.EnableChangeFeed()
+				}
+				if relay != nil {
+					c.SetRelay(relay)
+				}
+				if jetstream != nil {
+					c.SetJetstream(jetstream)
+				}
 				if err := c.Start(subCtx); err != nil {
 					log.Error().Err(err).Msgf("Failed ot start a consumer for %q: %s", remote.Host, err)
 					cancel()
@@ -203,6 +305,27 @@ func runConsumers(ctx context.Context, db *gorm.DB, session *gocqlx.Session, don
 			case t <- v:
 			default:
 			}
+
+		case host, ok := <-changes:
+			if !ok {
+				changes = nil
+				break
+			}
+			// Restart the consumer, so that it reconnects with the current
+			// settings (e.g., a cursor set via admin API) instead of
+			// overwriting them. Its unpersisted cursor doesn't clobber the
+			// new one, since cursor updates are conditional.
+			log.Debug().Msgf("PDS %q was changed", host)
+			if handle, found := running[host]; found {
+				handle.cancel()
+				_ = handle.consumer.Wait(ctx)
+				delete(running, host)
+			}
+			// Re-check which consumers should be running right away.
+			select {
+			case t <- time.Now():
+			default:
+			}
 		}
 	}
 }
@@ -25,6 +25,11 @@ var postsByLanguageIndexed = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of posts by language",
 }, []string{"remote", "lang"})
 
+var recordValidationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "consumer_record_validation_errors_count",
+	Help: "Number of records that failed validation against their lexicon",
+}, []string{"collection"})
+
 var connectionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "consumer_connection_failures",
 	Help: "Counter of firehose connection failures",
@@ -34,3 +39,43 @@ var pdsOnline = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "consumer_connection_up",
 	Help: "Status of a connection. 1 - up and running.",
 }, []string{"remote"})
+
+var consecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "consumer_consecutive_failures",
+	Help: "Number of failed connection attempts since the last successful one.",
+}, []string{"remote"})
+
+var relaySeq = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "consumer_relay_seq",
+	Help: "Last sequence number assigned by the re-broadcasting relay",
+})
+
+var relaySubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "consumer_relay_subscribers",
+	Help: "Number of connected relay subscribers",
+})
+
+var relaySubscribersDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "consumer_relay_subscribers_dropped_count",
+	Help: "Number of relay subscribers disconnected for being too slow",
+})
+
+var relayFramesSent = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "consumer_relay_frames_sent_count",
+	Help: "Number of frames sent to relay subscribers",
+})
+
+var jetstreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "consumer_jetstream_subscribers",
+	Help: "Number of connected Jetstream subscribers",
+})
+
+var jetstreamSubscribersDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "consumer_jetstream_subscribers_dropped_count",
+	Help: "Number of Jetstream subscribers disconnected for being too slow",
+})
+
+var jetstreamEventsSent = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "consumer_jetstream_events_sent_count",
+	Help: "Number of events sent to Jetstream subscribers",
+})
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gorilla/websocket"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/rs/zerolog"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+const (
+	// Number of live frames buffered for each subscriber. If a subscriber
+	// falls further behind, it gets disconnected.
+	subscriberBufferSize = 10000
+	relayWriteTimeout    = 30 * time.Second
+	relayPingInterval    = time.Minute
+)
+
+// Relay re-broadcasts commits, after they've been verified by consumers,
+// with its own sequence numbers. Frames are kept on disk for replay.
+type Relay struct {
+	log      *replayLog
+	upgrader websocket.Upgrader
+
+	mu          sync.Mutex
+	seq         int64
+	subscribers map[*relaySubscriber]bool
+}
+
+type relayFrame struct {
+	seq  int64
+	data []byte
+}
+
+type relaySubscriber struct {
+	ch chan relayFrame
+}
+
+func NewRelay(dir string, maxSize int64) (*Relay, error) {
+	l, err := openReplayLog(dir, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("opening replay log: %w", err)
+	}
+	r := &Relay{
+		log:         l,
+		seq:         l.LastSeq(),
+		subscribers: map[*relaySubscriber]bool{},
+	}
+	relaySeq.Set(float64(r.seq))
+	return r, nil
+}
+
+func (r *Relay) Close() error {
+	return r.log.Close()
+}
+
+// Publish assigns the next seq to the commit and sends it to subscribers.
+// The payload is not modified.
+func (r *Relay) Publish(payload *comatproto.SyncSubscribeRepos_Commit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	commit := *payload
+	commit.Seq = r.seq + 1
+	data, err := encodeFrame(1, "#commit", &commit)
+	if err != nil {
+		return fmt.Errorf("serializing commit: %w", err)
+	}
+	if err := r.log.Append(commit.Seq, data); err != nil {
+		return fmt.Errorf("writing to replay log: %w", err)
+	}
+	r.seq = commit.Seq
+	relaySeq.Set(float64(r.seq))
+
+	frame := relayFrame{seq: commit.Seq, data: data}
+	for sub := range r.subscribers {
+		select {
+		case sub.ch <- frame:
+		default:
+			// Too slow, disconnect.
+			delete(r.subscribers, sub)
+			close(sub.ch)
+			relaySubscribersDropped.Inc()
+		}
+	}
+	return nil
+}
+
+func (r *Relay) subscribe() (*relaySubscriber, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub := &relaySubscriber{ch: make(chan relayFrame, subscriberBufferSize)}
+	r.subscribers[sub] = true
+	relaySubscribers.Set(float64(len(r.subscribers)))
+	return sub, r.seq
+}
+
+func (r *Relay) unsubscribe(sub *relaySubscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribers[sub] {
+		delete(r.subscribers, sub)
+		close(sub.ch)
+	}
+	relaySubscribers.Set(float64(len(r.subscribers)))
+}
+
+// encodeFrame serializes a stream frame: a header with op and type,
+// followed by the body.
+func encodeFrame(op int64, typ string, body cbg.CBORMarshaler) ([]byte, error) {
+	header, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "op", qp.Int(op))
+		if typ != "" {
+			qp.MapEntry(ma, "t", qp.String(typ))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := dagcbor.Encode(header, buf); err != nil {
+		return nil, err
+	}
+	if err := body.MarshalCBOR(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errorFrame is the body of a frame with op = -1.
+type errorFrame struct {
+	Error   string
+	Message string
+}
+
+func (e *errorFrame) MarshalCBOR(w io.Writer) error {
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "error", qp.String(e.Error))
+		qp.MapEntry(ma, "message", qp.String(e.Message))
+	})
+	if err != nil {
+		return err
+	}
+	return dagcbor.Encode(n, w)
+}
+
+// filterFrame removes ops from collections other than the given ones.
+// Returns false if no ops are left. Blocks are passed through unchanged.
+func filterFrame(frame []byte, collections map[string]bool) ([]byte, bool, error) {
+	rd := bytes.NewReader(frame)
+	header := basicnode.Prototype.Any.NewBuilder()
+	if err := (&dagcbor.DecodeOptions{DontParseBeyondEnd: true}).Decode(header, rd); err != nil {
+		return nil, false, fmt.Errorf("unmarshaling header: %w", err)
+	}
+	if h, err := parseHeader(header.Build()); err != nil {
+		return nil, false, err
+	} else if h.Type != "#commit" {
+		return nil, false, fmt.Errorf("unexpected frame type %q", h.Type)
+	}
+	commit := &comatproto.SyncSubscribeRepos_Commit{}
+	if err := commit.UnmarshalCBOR(rd); err != nil {
+		return nil, false, fmt.Errorf("unmarshaling commit: %w", err)
+	}
+
+	ops := []*comatproto.SyncSubscribeRepos_RepoOp{}
+	for _, op := range commit.Ops {
+		collection, _, _ := strings.Cut(op.Path, "/")
+		if collections[collection] {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) == 0 {
+		return nil, false, nil
+	}
+	if len(ops) == len(commit.Ops) {
+		return frame, true, nil
+	}
+	commit.Ops = ops
+	b, err := encodeFrame(1, "#commit", commit)
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func writeFrame(conn *websocket.Conn, op int64, typ string, body cbg.CBORMarshaler) error {
+	b, err := encodeFrame(op, typ, body)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+	return conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// ServeHTTP implements com.atproto.sync.subscribeRepos. In addition to
+// the standard cursor parameter, it accepts a list of collections to
+// filter commits by.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	log := zerolog.Ctx(ctx)
+
+	collections := map[string]bool{}
+	for _, c := range req.URL.Query()["collection"] {
+		if _, err := syntax.ParseNSID(c); err != nil {
+			http.Error(w, fmt.Sprintf("invalid collection %q", c), http.StatusBadRequest)
+			return
+		}
+		collections[c] = true
+	}
+	var cursor *int64
+	if s := req.URL.Query().Get("cursor"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 0 {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", s), http.StatusBadRequest)
+			return
+		}
+		cursor = &v
+	}
+
+	conn, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		t := time.NewTicker(relayPingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(relayWriteTimeout))
+			}
+		}
+	}()
+
+	send := func(seq int64, frame []byte) error {
+		if len(collections) > 0 {
+			filtered, ok, err := filterFrame(frame, collections)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to filter frame %d: %s", seq, err)
+				return nil
+			}
+			if !ok {
+				return nil
+			}
+			frame = filtered
+		}
+		conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return err
+		}
+		relayFramesSent.Inc()
+		return nil
+	}
+
+	replay := func(seq int64, frame []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return send(seq, frame)
+	}
+	replayFailed := func(err error) {
+		if ctx.Err() == nil {
+			log.Debug().Err(err).Msgf("Replay failed: %s", err)
+		}
+	}
+
+	var last int64
+	if cursor != nil {
+		if *cursor > r.log.LastSeq() {
+			writeFrame(conn, -1, "", &errorFrame{Error: "FutureCursor", Message: "Cursor in the future."})
+			return
+		}
+		if first := r.log.FirstSeq(); *cursor+1 < first {
+			msg := "Requested cursor exceeded limit. Possibly missing events"
+			if err := writeFrame(conn, 1, "#info", &comatproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor", Message: &msg}); err != nil {
+				return
+			}
+		}
+		// Catch up from disk before subscribing, otherwise live frames
+		// would overflow the subscriber's buffer during a long replay.
+		last, err = r.log.ReadToHead(*cursor, subscriberBufferSize/2, replay)
+		if err != nil {
+			replayFailed(err)
+			return
+		}
+	}
+
+	sub, head := r.subscribe()
+	defer r.unsubscribe(sub)
+	if cursor != nil {
+		// Frames published since the last replay pass.
+		if err := r.log.Read(last, head, replay); err != nil {
+			replayFailed(err)
+			return
+		}
+	}
+	last = head
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-sub.ch:
+			if !ok {
+				writeFrame(conn, -1, "", &errorFrame{Error: "ConsumerTooSlow", Message: "Stream consumer too slow"})
+				return
+			}
+			if frame.seq <= last {
+				continue
+			}
+			if err := send(frame.seq, frame.data); err != nil {
+				return
+			}
+			last = frame.seq
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentSuffix      = ".seg"
+	recordHeaderSize   = 12 // seq (8 bytes) + length (4 bytes)
+	defaultSegmentSize = 64 << 20
+)
+
+// replayLog is an append-only log of sequenced frames on disk, split into
+// segment files named after the first seq in them. Oldest segments are
+// removed once the total size exceeds the limit.
+type replayLog struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu       sync.Mutex
+	segments []logSegment
+	cur      *os.File
+	lastSeq  int64
+}
+
+type logSegment struct {
+	firstSeq int64
+	path     string
+	size     int64
+}
+
+func openReplayLog(dir string, maxSize int64) (*replayLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &replayLog{dir: dir, maxSize: maxSize, segmentSize: defaultSegmentSize}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentSuffix)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, logSegment{firstSeq: seq, path: filepath.Join(dir, e.Name()), size: info.Size()})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].firstSeq < l.segments[j].firstSeq })
+
+	if len(l.segments) > 0 {
+		if err := l.recoverLast(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// recoverLast finds the last seq in the last segment, and truncates
+// a partially written record, if any.
+func (l *replayLog) recoverLast() error {
+	last := &l.segments[len(l.segments)-1]
+	f, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	var valid int64
+	l.lastSeq = last.firstSeq - 1
+	err = readSegment(f, func(seq int64, frame []byte) error {
+		l.lastSeq = seq
+		valid += recordHeaderSize + int64(len(frame))
+		return nil
+	})
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		f.Close()
+		return fmt.Errorf("reading %q: %w", last.path, err)
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	last.size = valid
+	l.cur = f
+	return nil
+}
+
+// readSegment calls fn for each record in the segment.
+func readSegment(r io.Reader, fn func(seq int64, frame []byte) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		seq := int64(binary.BigEndian.Uint64(header[:8]))
+		frame := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(br, frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(seq, frame); err != nil {
+			return err
+		}
+	}
+}
+
+// LastSeq returns seq of the last record, or 0 if the log is empty.
+func (l *replayLog) LastSeq() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq
+}
+
+// FirstSeq returns the oldest seq still available.
+func (l *replayLog) FirstSeq() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.segments) == 0 {
+		return l.lastSeq + 1
+	}
+	return l.segments[0].firstSeq
+}
+
+// Append writes a record. Seq must be greater than any previously
+// appended one.
+func (l *replayLog) Append(seq int64, frame []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq <= l.lastSeq {
+		return fmt.Errorf("seq %d is not greater than the last one (%d)", seq, l.lastSeq)
+	}
+
+	if l.cur == nil || l.segments[len(l.segments)-1].size >= l.segmentSize {
+		if err := l.rotate(seq); err != nil {
+			return fmt.Errorf("creating a new segment: %w", err)
+		}
+	}
+
+	b := make([]byte, recordHeaderSize+len(frame))
+	binary.BigEndian.PutUint64(b[:8], uint64(seq))
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(frame)))
+	copy(b[recordHeaderSize:], frame)
+	if _, err := l.cur.Write(b); err != nil {
+		return err
+	}
+	l.segments[len(l.segments)-1].size += int64(len(b))
+	l.lastSeq = seq
+	return nil
+}
+
+func (l *replayLog) rotate(firstSeq int64) error {
+	if l.cur != nil {
+		if err := l.cur.Close(); err != nil {
+			return err
+		}
+		l.cur = nil
+	}
+	p := filepath.Join(l.dir, fmt.Sprintf("%020d%s", firstSeq, segmentSuffix))
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.cur = f
+	l.segments = append(l.segments, logSegment{firstSeq: firstSeq, path: p})
+
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+	for len(l.segments) > 1 && total > l.maxSize {
+		if err := os.Remove(l.segments[0].path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= l.segments[0].size
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Read calls fn for every record with seq in (after, upTo].
+func (l *replayLog) Read(after int64, upTo int64, fn func(seq int64, frame []byte) error) error {
+	l.mu.Lock()
+	segments := append([]logSegment(nil), l.segments...)
+	l.mu.Unlock()
+
+	start := 0
+	for i, s := range segments {
+		if s.firstSeq <= after+1 {
+			start = i
+		}
+	}
+
+	errStop := errors.New("stop")
+	for _, s := range segments[start:] {
+		if s.firstSeq > upTo {
+			break
+		}
+		f, err := os.Open(s.path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed while we were reading the previous ones.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = readSegment(f, func(seq int64, frame []byte) error {
+			if seq > upTo {
+				return errStop
+			}
+			if seq <= after {
+				return nil
+			}
+			return fn(seq, frame)
+		})
+		f.Close()
+		if errors.Is(err, errStop) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadToHead calls fn for every record after the given seq, in passes up to
+// the last seq at the start of each pass, until a pass reads fewer than
+// maxBehind records. Returns the last seq of the final pass. This lets a
+// reader catch up from disk before subscribing to live records, so that
+// only a few of them need to be buffered while it reads the rest.
+func (l *replayLog) ReadToHead(after int64, maxBehind int, fn func(seq int64, frame []byte) error) (int64, error) {
+	for {
+		head := l.LastSeq()
+		n := 0
+		err := l.Read(after, head, func(seq int64, frame []byte) error {
+			n++
+			return fn(seq, frame)
+		})
+		if err != nil {
+			return after, err
+		}
+		after = max(after, head)
+		if n < maxBehind {
+			return after, nil
+		}
+	}
+}
+
+func (l *replayLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cur == nil {
+		return nil
+	}
+	return l.cur.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReplayLog(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := openReplayLog(dir, 1000)
+	if err != nil {
+		t.Fatalf("openReplayLog: %s", err)
+	}
+	// 12 bytes of header + 8 bytes of frame per record, 5 records per segment.
+	l.segmentSize = 100
+	for seq := int64(1); seq <= 20; seq++ {
+		if err := l.Append(seq, []byte(fmt.Sprintf("frame%03d", seq))); err != nil {
+			t.Fatalf("Append(%d): %s", seq, err)
+		}
+	}
+	if err := l.Append(20, []byte("again")); err == nil {
+		t.Errorf("Append with a duplicate seq succeeded")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// Simulate a crash in the middle of writing a record.
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 16, segmentSuffix)), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("opening last segment: %s", err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 21, 0, 0})
+	f.Close()
+
+	l, err = openReplayLog(dir, 1000)
+	if err != nil {
+		t.Fatalf("re-opening: %s", err)
+	}
+	l.segmentSize = 100
+	defer l.Close()
+
+	if got := l.LastSeq(); got != 20 {
+		t.Errorf("LastSeq() = %d, want 20", got)
+	}
+	if got := l.FirstSeq(); got != 1 {
+		t.Errorf("FirstSeq() = %d, want 1", got)
+	}
+	if err := l.Append(21, []byte("frame021")); err != nil {
+		t.Fatalf("Append(21): %s", err)
+	}
+
+	read := func(after, upTo int64) []int64 {
+		t.Helper()
+		r := []int64{}
+		err := l.Read(after, upTo, func(seq int64, frame []byte) error {
+			if want := fmt.Sprintf("frame%03d", seq); string(frame) != want {
+				t.Errorf("frame %d: got %q, want %q", seq, frame, want)
+			}
+			r = append(r, seq)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Read(%d, %d): %s", after, upTo, err)
+		}
+		return r
+	}
+	if got, want := read(7, 12), []int64{8, 9, 10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Read(7, 12) = %v, want %v", got, want)
+	}
+	if got, want := read(19, 100), []int64{20, 21}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Read(19, 100) = %v, want %v", got, want)
+	}
+
+	// Fill up enough segments to go over the size limit.
+	for seq := int64(22); seq <= 60; seq++ {
+		if err := l.Append(seq, []byte(fmt.Sprintf("frame%03d", seq))); err != nil {
+			t.Fatalf("Append(%d): %s", seq, err)
+		}
+	}
+	first := l.FirstSeq()
+	if first == 1 {
+		t.Fatalf("old segments were not removed")
+	}
+	if got := read(0, 60); len(got) != int(60-first+1) || got[0] != first {
+		t.Errorf("Read(0, 60) returned %d records starting at %d, want all from %d", len(got), got[0], first)
+	}
+}
+
+func TestReplayLogReadToHead(t *testing.T) {
+	l, err := openReplayLog(t.TempDir(), 10000)
+	if err != nil {
+		t.Fatalf("openReplayLog: %s", err)
+	}
+	defer l.Close()
+	for seq := int64(1); seq <= 10; seq++ {
+		if err := l.Append(seq, []byte("frame")); err != nil {
+			t.Fatalf("Append(%d): %s", seq, err)
+		}
+	}
+
+	// Records keep being appended while reading, like live ones would.
+	next := int64(11)
+	got := []int64{}
+	last, err := l.ReadToHead(2, 3, func(seq int64, frame []byte) error {
+		got = append(got, seq)
+		if next <= 14 {
+			if err := l.Append(next, []byte("frame")); err != nil {
+				return err
+			}
+			next++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadToHead: %s", err)
+	}
+	want := []int64{}
+	for seq := int64(3); seq <= 14; seq++ {
+		want = append(want, seq)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadToHead read %v, want %v", got, want)
+	}
+	if last != 14 {
+		t.Errorf("ReadToHead returned %d, want 14", last)
+	}
+}
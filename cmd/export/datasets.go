@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type columnType int
+
+const (
+	stringColumn columnType = iota
+	int64Column
+)
+
+type column struct {
+	// Header in CSV files, in the format expected by neo4j-admin import.
+	Header string
+	// Column name in Parquet files.
+	Name string
+	Type columnType
+}
+
+// dataset is exported page by page, using keyset pagination over a text
+// key: keysQuery selects up to @limit keys greater than @after, and
+// rowsQuery selects all rows for keys in (@after, @last]. Pages are small
+// enough to be read in a short transaction.
+type dataset struct {
+	Name    string
+	Columns []column
+	// Selects a single column of keys, ordered.
+	keysQuery string
+	// If empty, rows are the keys themselves.
+	rowsQuery string
+}
+
+var (
+	startColumn = column{Header: ":START_ID", Name: "source", Type: stringColumn}
+	endColumn   = column{Header: ":END_ID", Name: "target", Type: stringColumn}
+	countColumn = column{Header: "count:long", Name: "count", Type: int64Column}
+)
+
+var datasets = []dataset{
+	{
+		Name:      "follows",
+		Columns:   []column{startColumn, endColumn},
+		keysQuery: `select distinct source from graph_follows where source > @after order by source limit @limit`,
+		rowsQuery: `select source, target from graph_follows
+			where source > @after and source <= @last and target <> source
+			order by source, rkey`,
+	},
+	{
+		Name:      "blocks",
+		Columns:   []column{startColumn, endColumn},
+		keysQuery: `select distinct source from graph_blocks where source > @after order by source limit @limit`,
+		rowsQuery: `select source, target from graph_blocks
+			where source > @after and source <= @last and target <> source
+			order by source, rkey`,
+	},
+	{
+		Name:      "like_counts",
+		Columns:   []column{startColumn, endColumn, countColumn},
+		keysQuery: `select distinct source from graph_likes where source > @after order by source limit @limit`,
+		rowsQuery: `select source, split_part(target, '/', 3) as subject, count(*) from graph_likes
+			where source > @after and source <= @last and split_part(target, '/', 3) <> source
+			group by source, subject
+			order by source, subject`,
+	},
+	{
+		Name:      "post_counts",
+		Columns:   []column{startColumn, endColumn, countColumn},
+		keysQuery: `select did from repos where did > @after order by did limit @limit`,
+		rowsQuery: `select repos.did, split_part(backlinks.target, '/', 3) as subject, count(*)
+			from backlinks join repos on repos.id = backlinks.repo
+			where repos.did > @after and repos.did <= @last
+				and backlinks.collection = 'app.bsky.feed.post' and backlinks.path = 'reply.parent'
+				and split_part(backlinks.target, '/', 3) <> repos.did
+			group by repos.did, subject
+			order by repos.did, subject`,
+	},
+	{
+		Name:    "dids",
+		Columns: []column{{Header: "did:ID", Name: "did", Type: stringColumn}},
+		keysQuery: `select distinct did from (
+				(select did from repos where did > @after order by did limit @limit)
+				union all
+				(select distinct target from graph_follows where target > @after order by target limit @limit)
+				union all
+				(select distinct target from graph_blocks where target > @after order by target limit @limit)
+				union all
+				(select distinct split_part(target, '/', 3) from graph_likes
+					where split_part(target, '/', 3) > @after order by 1 limit @limit)
+				union all
+				(select distinct split_part(target, '/', 3) from backlinks
+					where collection = 'app.bsky.feed.post' and path = 'reply.parent'
+						and split_part(target, '/', 3) > @after
+					order by 1 limit @limit)
+			) as t order by did limit @limit`,
+	},
+	{
+		// Latest handle of each DID, from the operation log of a PLC mirror
+		// sharing the database.
+		Name: "handles",
+		Columns: []column{
+			{Header: "did:ID", Name: "did", Type: stringColumn},
+			{Header: "handle", Name: "handle", Type: stringColumn},
+		},
+		keysQuery: `select distinct did from plc_log_entries where did > @after order by did limit @limit`,
+		rowsQuery: `select did, handle from (
+				select distinct on (did) did, replace(operation -> 'alsoKnownAs' ->> 0, 'at://', '') as handle
+				from plc_log_entries
+				where did > @after and did <= @last and not nullified
+				order by did, plc_timestamp desc
+			) as t where handle is not null order by did`,
+	},
+}
+
+func findDataset(name string) (dataset, error) {
+	for _, d := range datasets {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return dataset{}, fmt.Errorf("unknown dataset %q", name)
+}
+
+// page reads the next page of rows after the given key. Returns the last
+// key of the page, or an empty string if there are no more rows.
+func (d dataset) page(ctx context.Context, tx *gorm.DB, after string, limit int) ([][]any, string, error) {
+	keys := []string{}
+	err := tx.WithContext(ctx).Raw(d.keysQuery, map[string]interface{}{"after": after, "limit": limit}).
+		Scan(&keys).Error
+	if err != nil {
+		return nil, "", fmt.Errorf("querying keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, "", nil
+	}
+	last := keys[len(keys)-1]
+
+	if d.rowsQuery == "" {
+		r := [][]any{}
+		for _, k := range keys {
+			r = append(r, []any{k})
+		}
+		return r, last, nil
+	}
+
+	rows, err := tx.WithContext(ctx).Raw(d.rowsQuery, map[string]interface{}{"after": after, "last": last}).Rows()
+	if err != nil {
+		return nil, "", fmt.Errorf("querying rows: %w", err)
+	}
+	defer rows.Close()
+
+	r := [][]any{}
+	for rows.Next() {
+		row := make([]any, len(d.Columns))
+		ptrs := make([]any, len(d.Columns))
+		for i, c := range d.Columns {
+			switch c.Type {
+			case stringColumn:
+				row[i] = new(string)
+			case int64Column:
+				row[i] = new(int64)
+			}
+			ptrs[i] = row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, "", fmt.Errorf("scanning row: %w", err)
+		}
+		for i := range row {
+			switch v := row[i].(type) {
+			case *string:
+				row[i] = *v
+			case *int64:
+				row[i] = *v
+			}
+		}
+		r = append(r, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("reading rows: %w", err)
+	}
+	return r, last, nil
+}
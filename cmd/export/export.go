@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// manifest describes a single exported file. It is written next to the
+// file after it has been fully written, so a file without a manifest is
+// incomplete.
+type manifest struct {
+	Dataset string   `json:"dataset"`
+	File    string   `json:"file"`
+	Format  string   `json:"format"`
+	Part    int      `json:"part"`
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+	Bytes   int64    `json:"bytes"`
+	SHA256  string   `json:"sha256"`
+	// Keys covered by this part are in (After, Last].
+	After string `json:"after"`
+	Last  string `json:"last"`
+	// True if this is the last part of the dataset.
+	Done bool `json:"done"`
+	// Time of the database snapshot the data was read from.
+	SnapshotTime time.Time `json:"snapshotTime"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+}
+
+type exporter struct {
+	db     *gorm.DB
+	sink   sink
+	format string
+
+	pageSize int
+	partRows int64
+
+	// If set, each part is read from a snapshot of its own.
+	snapshot bool
+	// ID of the exported snapshot that pages of the current part are read
+	// from, if any.
+	snapshotID   string
+	snapshotTime time.Time
+}
+
+var snapshotIDRegexp = regexp.MustCompile(`^[0-9A-F-]+$`)
+
+// holdSnapshot starts a transaction and exports its snapshot, so that
+// every page can be read from the same state of the database in a
+// transaction of its own. The returned transaction must stay open until
+// the part is finished.
+func (e *exporter) holdSnapshot(ctx context.Context) (*gorm.DB, error) {
+	tx := e.db.WithContext(ctx).Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return nil, fmt.Errorf("starting transaction: %w", tx.Error)
+	}
+	err := tx.Raw("select pg_export_snapshot(), now()").Row().Scan(&e.snapshotID, &e.snapshotTime)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("exporting snapshot: %w", err)
+	}
+	if !snapshotIDRegexp.MatchString(e.snapshotID) {
+		tx.Rollback()
+		return nil, fmt.Errorf("unexpected snapshot ID %q", e.snapshotID)
+	}
+	return tx, nil
+}
+
+func (e *exporter) page(ctx context.Context, d dataset, after string) ([][]any, string, error) {
+	var rows [][]any
+	var last string
+	err := e.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if e.snapshotID != "" {
+			// Can't be passed as a parameter.
+			err := tx.Exec(fmt.Sprintf("set transaction snapshot '%s'", e.snapshotID)).Error
+			if err != nil {
+				return fmt.Errorf("importing snapshot: %w", err)
+			}
+		}
+		var err error
+		rows, last, err = d.page(ctx, tx, after, e.pageSize)
+		return err
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	return rows, last, err
+}
+
+func (e *exporter) fileName(d dataset, part int) string {
+	return fmt.Sprintf("%s-%05d.%s", d.Name, part, e.format)
+}
+
+func manifestName(file string) string {
+	return file + ".manifest.json"
+}
+
+func (e *exporter) writeFile(ctx context.Context, name string, content []byte) error {
+	f, err := e.sink.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// writeTimestamp writes timestamp.csv in the same format as the export
+// scripts did, unless it already exists from an interrupted run.
+func (e *exporter) writeTimestamp(ctx context.Context) error {
+	_, err := e.sink.Read(ctx, "timestamp.csv")
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errNotExist) {
+		return err
+	}
+	return e.writeFile(ctx, "timestamp.csv", []byte(fmt.Sprintf("export_start\n%s\n", time.Now().UTC().Format(time.RFC3339))))
+}
+
+// countingWriter computes size and checksum of the written data.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	hash  hash.Hash
+	total io.Writer
+}
+
+func newCountingWriter(w io.Writer) *countingWriter {
+	h := sha256.New()
+	return &countingWriter{w: w, hash: h, total: io.MultiWriter(w, h)}
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.total.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Export writes the dataset into one or more parts. Parts that already
+// have a manifest are skipped, so an interrupted export can be resumed.
+func (e *exporter) Export(ctx context.Context, d dataset) error {
+	log := zerolog.Ctx(ctx).With().Str("dataset", d.Name).Logger()
+
+	part := 0
+	after := ""
+	for {
+		b, err := e.sink.Read(ctx, manifestName(e.fileName(d, part)))
+		if errors.Is(err, errNotExist) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading manifest of part %d: %w", part, err)
+		}
+		m := manifest{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return fmt.Errorf("parsing manifest of part %d: %w", part, err)
+		}
+		if m.Done {
+			log.Info().Msgf("Already exported, skipping")
+			return nil
+		}
+		after = m.Last
+		part++
+	}
+	if part > 0 {
+		log.Info().Msgf("Resuming from part %d, after key %q", part, after)
+	}
+
+	columns := []string{}
+	for _, c := range d.Columns {
+		columns = append(columns, c.Header)
+	}
+
+	for {
+		m := manifest{
+			Dataset: d.Name,
+			File:    e.fileName(d, part),
+			Format:  e.format,
+			Part:    part,
+			Columns: columns,
+			After:   after,
+			Started: time.Now(),
+		}
+		if err := e.exportPart(ctx, d, &m); err != nil {
+			return fmt.Errorf("part %d: %w", part, err)
+		}
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := e.writeFile(ctx, manifestName(m.File), b); err != nil {
+			return fmt.Errorf("writing manifest of part %d: %w", part, err)
+		}
+		log.Info().Msgf("Wrote %s: %d rows, %d bytes", m.File, m.Rows, m.Bytes)
+		if m.Done {
+			return nil
+		}
+		after = m.Last
+		part++
+	}
+}
+
+func (e *exporter) exportPart(ctx context.Context, d dataset, m *manifest) error {
+	// A snapshot per part keeps each file consistent, without holding back
+	// vacuum for the whole export.
+	if e.snapshot {
+		tx, err := e.holdSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			tx.Rollback()
+			e.snapshotID = ""
+		}()
+		m.SnapshotTime = e.snapshotTime
+	}
+
+	f, err := e.sink.Create(ctx, m.File)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	cw := newCountingWriter(f)
+	w := formats[e.format](cw, d.Columns)
+
+	m.Last = m.After
+	for m.Rows < e.partRows {
+		rows, last, err := e.page(ctx, d, m.Last)
+		if err != nil {
+			f.Abort()
+			return err
+		}
+		if last == "" {
+			m.Done = true
+			break
+		}
+		if err := w.Write(rows); err != nil {
+			f.Abort()
+			return fmt.Errorf("writing rows: %w", err)
+		}
+		m.Rows += int64(len(rows))
+		m.Last = last
+	}
+
+	if err := w.Close(); err != nil {
+		f.Abort()
+		return fmt.Errorf("flushing: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	m.Bytes = cw.n
+	m.SHA256 = hex.EncodeToString(cw.hash.Sum(nil))
+	m.Finished = time.Now()
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// rowWriter encodes rows of a dataset into a file. Close flushes buffered
+// data, but doesn't close the underlying writer.
+type rowWriter interface {
+	Write(rows [][]any) error
+	Close() error
+}
+
+var formats = map[string]func(w io.Writer, columns []column) rowWriter{
+	"csv":     newCSVWriter,
+	"csv.gz":  newGzipCSVWriter,
+	"parquet": newParquetWriter,
+}
+
+type csvWriter struct {
+	w     *csv.Writer
+	close func() error
+}
+
+func newCSVWriter(w io.Writer, columns []column) rowWriter {
+	r := &csvWriter{w: csv.NewWriter(w), close: func() error { return nil }}
+	header := []string{}
+	for _, c := range columns {
+		header = append(header, c.Header)
+	}
+	// Errors are sticky and will be returned by the next Write.
+	r.w.Write(header)
+	return r
+}
+
+func newGzipCSVWriter(w io.Writer, columns []column) rowWriter {
+	gz := gzip.NewWriter(w)
+	r := newCSVWriter(gz, columns).(*csvWriter)
+	r.close = gz.Close
+	return r
+}
+
+func (w *csvWriter) Write(rows [][]any) error {
+	record := []string{}
+	for _, row := range rows {
+		record = record[:0]
+		for _, v := range row {
+			switch v := v.(type) {
+			case string:
+				record = append(record, v)
+			case int64:
+				record = append(record, strconv.FormatInt(v, 10))
+			default:
+				return fmt.Errorf("unsupported value type %T", v)
+			}
+		}
+		if err := w.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+	return w.close()
+}
+
+type parquetWriter struct {
+	w *parquet.Writer
+	// Index of each dataset column in the Parquet schema, which is
+	// ordered by name.
+	indexes []int
+}
+
+func newParquetWriter(w io.Writer, columns []column) rowWriter {
+	group := parquet.Group{}
+	for _, c := range columns {
+		switch c.Type {
+		case stringColumn:
+			group[c.Name] = parquet.String()
+		case int64Column:
+			group[c.Name] = parquet.Int(64)
+		}
+	}
+	schema := parquet.NewSchema("export", group)
+
+	r := &parquetWriter{w: parquet.NewWriter(w, schema, parquet.Compression(&parquet.Zstd))}
+	for _, c := range columns {
+		leaf, _ := schema.Lookup(c.Name)
+		r.indexes = append(r.indexes, leaf.ColumnIndex)
+	}
+	return r
+}
+
+func (w *parquetWriter) Write(rows [][]any) error {
+	prows := make([]parquet.Row, 0, len(rows))
+	for _, row := range rows {
+		prow := make(parquet.Row, len(row))
+		for i, v := range row {
+			var value parquet.Value
+			switch v := v.(type) {
+			case string:
+				value = parquet.ByteArrayValue([]byte(v))
+			case int64:
+				value = parquet.Int64Value(v)
+			default:
+				return fmt.Errorf("unsupported value type %T", v)
+			}
+			prow[w.indexes[i]] = value.Level(0, 0, w.indexes[i])
+		}
+		prows = append(prows, prow)
+	}
+	_, err := w.w.WriteRows(prows)
+	return err
+}
+
+func (w *parquetWriter) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestFormats(t *testing.T) {
+	columns := []column{startColumn, endColumn, countColumn}
+	rows := [][]any{
+		{"did:plc:a", "did:plc:b", int64(3)},
+		{"did:plc:a", "did:plc:\"c\",", int64(1)},
+	}
+
+	type testCase struct {
+		format string
+		decode func(t *testing.T, b []byte) [][]any
+	}
+
+	readCSV := func(t *testing.T, b []byte) [][]any {
+		t.Helper()
+		if got, want := string(b), ":START_ID,:END_ID,count:long\n"+
+			"did:plc:a,did:plc:b,3\n"+
+			"did:plc:a,\"did:plc:\"\"c\"\",\",1\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		return rows
+	}
+
+	cases := []testCase{
+		{"csv", readCSV},
+		{"csv.gz", func(t *testing.T, b []byte) [][]any {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %s", err)
+			}
+			b, err = io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading gzip: %s", err)
+			}
+			return readCSV(t, b)
+		}},
+		{"parquet", func(t *testing.T, b []byte) [][]any {
+			type row struct {
+				Source string `parquet:"source"`
+				Target string `parquet:"target"`
+				Count  int64  `parquet:"count"`
+			}
+			got, err := parquet.Read[row](bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("parquet.Read: %s", err)
+			}
+			r := [][]any{}
+			for _, v := range got {
+				r = append(r, []any{v.Source, v.Target, v.Count})
+			}
+			return r
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := formats[tc.format](buf, columns)
+			if err := w.Write(rows); err != nil {
+				t.Fatalf("Write: %s", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+			if got := tc.decode(t, buf.Bytes()); !reflect.DeepEqual(got, rows) {
+				t.Errorf("got %v, want %v", got, rows)
+			}
+		})
+	}
+}
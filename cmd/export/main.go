@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/uabluerail/indexer/util/gormzerolog"
+)
+
+type Config struct {
+	LogFile   string
+	LogFormat string `default:"text"`
+	LogLevel  int64  `default:"1"`
+	DBUrl     string `envconfig:"POSTGRES_URL"`
+	// Directory path, or s3://bucket/prefix.
+	Output   string `default:"export"`
+	Format   string `default:"csv"`
+	Datasets string `default:"follows,blocks,like_counts,post_counts,dids,handles"`
+	// Number of keys (usually source DIDs) read in a single query.
+	PageSize int `split_words:"true" default:"1000"`
+	// Approximate number of rows in a single file.
+	PartRows int64 `split_words:"true" default:"10000000"`
+	// Read each file from a single database snapshot.
+	Snapshot bool `default:"true"`
+
+	S3Endpoint  string `split_words:"true" default:"s3.amazonaws.com"`
+	S3Region    string `split_words:"true"`
+	S3AccessKey string `split_words:"true"`
+	S3SecretKey string `split_words:"true"`
+	S3Insecure  bool   `split_words:"true"`
+}
+
+var config Config
+
+func runMain(ctx context.Context) error {
+	ctx = setupLogging(ctx)
+	log := zerolog.Ctx(ctx)
+
+	if _, ok := formats[config.Format]; !ok {
+		return fmt.Errorf("unsupported format %q", config.Format)
+	}
+	toExport := []dataset{}
+	for _, name := range strings.Split(config.Datasets, ",") {
+		d, err := findDataset(strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		toExport = append(toExport, d)
+	}
+	if config.PageSize < 1 || config.PartRows < 1 {
+		return fmt.Errorf("page size and part size must be positive")
+	}
+
+	out, err := newSink(config.Output)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("Starting up...")
+	db, err := gorm.Open(postgres.Open(config.DBUrl), &gorm.Config{
+		Logger: gormzerolog.New(&logger.Config{
+			SlowThreshold:             1 * time.Minute,
+			IgnoreRecordNotFoundError: true,
+		}, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to the database: %w", err)
+	}
+	log.Debug().Msgf("DB connection established")
+
+	e := &exporter{
+		db:       db,
+		sink:     out,
+		format:   config.Format,
+		pageSize: config.PageSize,
+		partRows: config.PartRows,
+		snapshot: config.Snapshot,
+	}
+
+	if err := e.writeTimestamp(ctx); err != nil {
+		return fmt.Errorf("writing timestamp: %w", err)
+	}
+	for _, d := range toExport {
+		if err := e.Export(ctx, d); err != nil {
+			return fmt.Errorf("exporting %q: %w", d.Name, err)
+		}
+	}
+	log.Info().Msgf("Export finished")
+	return nil
+}
+
+func main() {
+	flag.StringVar(&config.LogFile, "log", "", "Path to the log file. If empty, will log to stderr")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
+	flag.Int64Var(&config.LogLevel, "log-level", 1, "Log level. -1 - trace, 0 - debug, 1 - info, 5 - panic")
+
+	if err := envconfig.Process("export", &config); err != nil {
+		log.Fatalf("envconfig.Process: %s", err)
+	}
+
+	flag.StringVar(&config.Output, "output", config.Output, "Output directory, or s3://bucket/prefix")
+	flag.StringVar(&config.Format, "format", config.Format, "Output format: csv, csv.gz or parquet")
+	flag.StringVar(&config.Datasets, "datasets", config.Datasets, "Comma-separated list of datasets to export")
+	flag.BoolVar(&config.Snapshot, "snapshot", config.Snapshot, "Read each file from a single database snapshot")
+	flag.Parse()
+
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	if err := runMain(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func setupLogging(ctx context.Context) context.Context {
+	logFile := os.Stderr
+
+	if config.LogFile != "" {
+		f, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open the specified log file %q: %s", config.LogFile, err)
+		}
+		logFile = f
+	}
+
+	var output io.Writer
+
+	switch config.LogFormat {
+	case "json":
+		output = logFile
+	case "text":
+		prefixList := []string{}
+		info, ok := debug.ReadBuildInfo()
+		if ok {
+			prefixList = append(prefixList, info.Path+"/")
+		}
+
+		basedir := ""
+		_, sourceFile, _, ok := runtime.Caller(0)
+		if ok {
+			basedir = filepath.Dir(sourceFile)
+		}
+
+		if basedir != "" && strings.HasPrefix(basedir, "/") {
+			prefixList = append(prefixList, basedir+"/")
+			head, _ := filepath.Split(basedir)
+			for head != "/" {
+				prefixList = append(prefixList, head)
+				head, _ = filepath.Split(strings.TrimSuffix(head, "/"))
+			}
+		}
+
+		output = zerolog.ConsoleWriter{
+			Out:        logFile,
+			NoColor:    true,
+			TimeFormat: time.RFC3339,
+			PartsOrder: []string{
+				zerolog.LevelFieldName,
+				zerolog.TimestampFieldName,
+				zerolog.CallerFieldName,
+				zerolog.MessageFieldName,
+			},
+			FormatFieldName:  func(i interface{}) string { return fmt.Sprintf("%s:", i) },
+			FormatFieldValue: func(i interface{}) string { return fmt.Sprintf("%s", i) },
+			FormatCaller: func(i interface{}) string {
+				s := i.(string)
+				for _, p := range prefixList {
+					s = strings.TrimPrefix(s, p)
+				}
+				return s
+			},
+		}
+	default:
+		log.Fatalf("Invalid log format specified: %q", config.LogFormat)
+	}
+
+	logger := zerolog.New(output).Level(zerolog.Level(config.LogLevel)).With().Caller().Timestamp().Logger()
+
+	ctx = logger.WithContext(ctx)
+
+	zerolog.DefaultContextLogger = &logger
+	log.SetOutput(logger)
+
+	return ctx
+}
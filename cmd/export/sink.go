@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var errNotExist = errors.New("file does not exist")
+
+// sink is where exported files are written to.
+type sink interface {
+	// Create starts writing a new file. It becomes visible under the
+	// given name only after a successful Commit.
+	Create(ctx context.Context, name string) (sinkFile, error)
+	// Read returns the contents of a file, or errNotExist.
+	Read(ctx context.Context, name string) ([]byte, error)
+}
+
+type sinkFile interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+func newSink(output string) (sink, error) {
+	if rest, ok := strings.CutPrefix(output, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("missing bucket name in %q", output)
+		}
+		return newS3Sink(bucket, prefix)
+	}
+	return &dirSink{dir: output}, nil
+}
+
+// dirSink writes files into a local directory.
+type dirSink struct {
+	dir string
+}
+
+type dirFile struct {
+	*os.File
+	name string
+}
+
+func (s *dirSink) Create(ctx context.Context, name string) (sinkFile, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(p + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{File: f, name: p}, nil
+}
+
+func (f *dirFile) Commit() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.File.Name(), f.name)
+}
+
+func (f *dirFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+func (s *dirSink) Read(ctx context.Context, name string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotExist
+	}
+	return b, err
+}
+
+// s3Sink uploads files into an S3-compatible object storage.
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Sink(bucket string, prefix string) (*s3Sink, error) {
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+	})
+	if config.S3AccessKey != "" {
+		creds = credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, "")
+	}
+	client, err := minio.New(config.S3Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !config.S3Insecure,
+		Region: config.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating S3 client: %w", err)
+	}
+	return &s3Sink{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Sink) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+type s3File struct {
+	*io.PipeWriter
+	result chan error
+}
+
+// Create streams the file into a multipart upload, so that the size
+// doesn't need to be known in advance.
+func (s *s3Sink) Create(ctx context.Context, name string) (sinkFile, error) {
+	pr, pw := io.Pipe()
+	f := &s3File{PipeWriter: pw, result: make(chan error, 1)}
+	go func() {
+		_, err := s.client.PutObject(ctx, s.bucket, s.key(name), pr, -1, minio.PutObjectOptions{
+			PartSize: 64 << 20,
+		})
+		pr.CloseWithError(err)
+		f.result <- err
+	}()
+	return f, nil
+}
+
+func (f *s3File) Commit() error {
+	f.PipeWriter.Close()
+	return <-f.result
+}
+
+func (f *s3File) Abort() {
+	f.PipeWriter.CloseWithError(errors.New("aborted"))
+	<-f.result
+}
+
+func (s *s3Sink) Read(ctx context.Context, name string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, obj); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, errNotExist
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
@@ -11,15 +12,21 @@ import (
 	"gorm.io/gorm"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/bluesky-social/indigo/did"
+	"github.com/bluesky-social/indigo/xrpc"
 
-	"github.com/uabluerail/bsky-tools/pagination"
 	"github.com/uabluerail/bsky-tools/xrpcauth"
+	"github.com/uabluerail/indexer/models"
 	"github.com/uabluerail/indexer/pds"
 	"github.com/uabluerail/indexer/repo"
 	"github.com/uabluerail/indexer/util/resolver"
 )
 
+// errListPassReset is returned when the listing pass was reset by someone
+// else (e.g., by an operator via admin API) while it was running.
+var errListPassReset = errors.New("listing pass was reset externally")
+
 type Lister struct {
 	db          *gorm.DB
 	resolver    did.Resolver
@@ -27,6 +34,17 @@ type Lister struct {
 
 	pollInterval        time.Duration
 	listRefreshInterval time.Duration
+	reprobeInterval     time.Duration
+	metadataInterval    time.Duration
+	// How far behind the listed rev our copy of a repo can be before
+	// we trigger a re-fetch. Small lag is expected, since the firehose
+	// consumer might simply not have caught up yet.
+	staleRevThreshold time.Duration
+	// Interrupted listing passes older than this are started over.
+	maxListPassDuration time.Duration
+	// Delay before retrying a failed listing pass, doubled on every
+	// consecutive failure of the PDS, up to listRefreshInterval.
+	listRetryDelay time.Duration
 }
 
 func NewLister(ctx context.Context, db *gorm.DB, contactInfo string) (*Lister, error) {
@@ -36,11 +54,18 @@ func NewLister(ctx context.Context, db *gorm.DB, contactInfo string) (*Lister, e
 		contactInfo:         contactInfo,
 		pollInterval:        1 * time.Minute,
 		listRefreshInterval: 24 * time.Hour,
+		reprobeInterval:     6 * time.Hour,
+		metadataInterval:    24 * time.Hour,
+		staleRevThreshold:   time.Hour,
+		maxListPassDuration: 7 * 24 * time.Hour,
+		listRetryDelay:      10 * time.Minute,
 	}, nil
 }
 
 func (l *Lister) Start(ctx context.Context) error {
 	go l.run(ctx)
+	go l.runProber(ctx)
+	go l.runMetadataCollector(ctx)
 	return nil
 }
 
@@ -65,7 +90,8 @@ func (l *Lister) run(ctx context.Context) {
 
 			remotes := []pds.PDS{}
 			if err := db.Model(&remotes).
-				Where("(disabled=false or disabled is null) and (last_list is null or last_list < ?)", time.Now().Add(-l.listRefreshInterval)).
+				Where("(disabled=false or disabled is null) and (last_list is null or last_list < ?) and (list_retry_at is null or list_retry_at < ?)",
+					time.Now().Add(-l.listRefreshInterval), time.Now()).
 				Find(&remotes).Error; err != nil {
 				if !errors.Is(err, gorm.ErrRecordNotFound) {
 					log.Error().Err(err).Msgf("Failed to query DB for a PDS to list repos from: %s", err)
@@ -79,9 +105,9 @@ func (l *Lister) run(ctx context.Context) {
 
 			started := false
 			for _, remote := range remotes {
-				if !pds.IsWhitelisted(remote.Host) {
-					log.Info().Msgf("PDS %q is not whitelisted, disabling it", remote.Host)
-					if err := db.Model(&remote).Where(&pds.PDS{ID: remote.ID}).Updates(&pds.PDS{Disabled: true}).Error; err != nil {
+				if d := pds.CheckPolicy(ctx, remote.Host); !d.Allowed {
+					log.Info().Msgf("PDS %q is not allowed by the policy (%s), disabling it", remote.Host, d.Reason())
+					if _, err := pds.SetDisabled(ctx, db, &remote, true, pds.DisabledByPolicy, "lister", d.Reason()); err != nil {
 						log.Error().Err(err).Msgf("Failed to disable PDS %q: %s", remote.Host, err)
 					}
 					continue
@@ -116,109 +142,505 @@ func (l *Lister) listOneHost(ctx context.Context, remote *pds.PDS) error {
 	log := zerolog.Ctx(ctx).With().Str("remote", remote.Host).Logger()
 	ctx = log.WithContext(ctx)
 	db := l.db.WithContext(ctx)
-	client := xrpcauth.NewAnonymousClient(ctx)
-	client.Host = remote.Host
-	userAgent := fmt.Sprintf("Go-http-client/1.1 indexerbot/0.1 (based on github.com/uabluerail/indexer; %s)", l.contactInfo)
-	client.UserAgent = &userAgent
+	client := l.newClient(ctx, remote.Host)
 
-	log.Info().Msgf("Listing repos from %q...", remote.Host)
+	progress := listProgress{
+		StartedAt: remote.ListStartedAt,
+		Cursor:    remote.ListCursor,
+		Seen:      remote.ListReposSeen,
+		Failed:    remote.ListReposFailed,
+	}
+	if progress.Cursor != "" && time.Since(progress.StartedAt) < l.maxListPassDuration {
+		log.Info().Msgf("Resuming listing repos from %q (%d repos seen so far)...", remote.Host, progress.Seen)
+	} else {
+		log.Info().Msgf("Listing repos from %q...", remote.Host)
+		// Truncated to the precision of the DB column, so that
+		// saveProgress can match on it.
+		progress = listProgress{StartedAt: time.Now().Truncate(time.Microsecond)}
+		err := db.Model(&pds.PDS{}).Where(&pds.PDS{ID: remote.ID}).Updates(map[string]interface{}{
+			"list_started_at":   progress.StartedAt,
+			"list_cursor":       "",
+			"list_repos_seen":   0,
+			"list_repos_failed": 0,
+		}).Error
+		if err != nil {
+			return fmt.Errorf("starting a listing pass for %q: %w", remote.Host, err)
+		}
+	}
 
-	repos := make(chan *comatproto.SyncListRepos_Repo, 1000)
+	pages := make(chan *comatproto.SyncListRepos_Output, 5)
+	// Closed by addRepos once it stops processing pages.
+	stopped := make(chan struct{})
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
+	var saveErr error
 	go func() {
 		defer wg.Done()
-		l.addRepos(ctx, repos, remote.Host)
+		progress, saveErr = l.addRepos(ctx, remote, pages, progress, stopped)
 	}()
 
-	total, err := pagination.Reduce(
-		func(cursor string) (resp *comatproto.SyncListRepos_Output, nextCursor string, err error) {
-			resp, err = comatproto.SyncListRepos(ctx, client, cursor, 200)
-			if err == nil && resp.Cursor != nil {
-				nextCursor = *resp.Cursor
+	cursor := progress.Cursor
+	var err error
+fetch:
+	for {
+		var resp *comatproto.SyncListRepos_Output
+		resp, err = l.fetchPage(ctx, client, remote.Host, cursor)
+		if err != nil {
+			break
+		}
+		select {
+		case pages <- resp:
+		case <-stopped:
+			break fetch
+		}
+		if resp.Cursor == nil || *resp.Cursor == "" || *resp.Cursor == cursor {
+			break
+		}
+		cursor = *resp.Cursor
+	}
+	close(pages)
+	wg.Wait()
+
+	if err != nil && ctx.Err() != nil {
+		// Shutting down, progress is saved and will be picked up after restart.
+		return err
+	}
+	if err != nil {
+		if err := pds.RecordFailure(ctx, db, remote, err, "lister"); err != nil {
+			log.Error().Err(err).Msgf("Failed to update health status of %q: %s", remote.Host, err)
+		}
+		// Postpone the next attempt, so we don't get stuck on a single
+		// broken PDS. Progress is kept, so the next attempt will continue
+		// from where we stopped.
+		delay := l.listRetryDelay
+		for i := 1; i < remote.ConsecutiveFailures && delay < l.listRefreshInterval; i++ {
+			delay *= 2
+		}
+		delay = min(delay, l.listRefreshInterval)
+		err2 := db.Model(&pds.PDS{}).
+			Where("id = ? and list_started_at = ?", remote.ID, progress.StartedAt).
+			Updates(&pds.PDS{ListRetryAt: time.Now().Add(delay)}).Error
+		if err2 != nil {
+			log.Error().Err(err2).Msgf("Failed to set the time of the next listing attempt for %q: %s", remote.Host, err2)
+		}
+		return err
+	}
+	if errors.Is(saveErr, errListPassReset) {
+		log.Info().Msgf("Listing pass for %q was reset, stopping it", remote.Host)
+		return nil
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := pds.RecordSuccess(ctx, db, remote); err != nil {
+		log.Error().Err(err).Msgf("Failed to update health status of %q: %s", remote.Host, err)
+	}
+
+	log.Info().Msgf("Received %d DIDs from %q", progress.Seen, remote.Host)
+
+	if progress.Failed == 0 {
+		// Only a complete pass tells us which repos are not there anymore.
+		if err := l.flagMissing(ctx, remote, progress.StartedAt); err != nil {
+			log.Error().Err(err).Msgf("Failed to flag repos missing from %q: %s", remote.Host, err)
+		}
+	} else {
+		log.Warn().Msgf("Failed to process %d repos from %q, not flagging missing repos", progress.Failed, remote.Host)
+	}
+
+	result := db.Model(&pds.PDS{}).
+		Where("id = ? and list_started_at = ?", remote.ID, progress.StartedAt).
+		Updates(map[string]interface{}{
+			"last_list":         time.Now(),
+			"list_retry_at":     nil,
+			"list_cursor":       "",
+			"list_repos_seen":   0,
+			"list_repos_failed": 0,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update the timestamp: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		log.Info().Msgf("Listing pass for %q was reset before it completed, not recording it", remote.Host)
+		return nil
+	}
+	listPassesCompleted.WithLabelValues(remote.Host).Inc()
+	listReposSeen.DeleteLabelValues(remote.Host)
+	return nil
+}
+
+// listProgress is the state of a listing pass, persisted in the pds table.
+type listProgress struct {
+	StartedAt time.Time
+	Cursor    string
+	Seen      int64
+	Failed    int64
+}
+
+// saveProgress persists progress of the pass. It returns errListPassReset
+// if the pass was reset since it started, leaving the row as is.
+func (l *Lister) saveProgress(ctx context.Context, remote *pds.PDS, progress listProgress) error {
+	result := l.db.WithContext(ctx).Model(&pds.PDS{}).
+		Where("id = ? and list_started_at = ?", remote.ID, progress.StartedAt).
+		Updates(map[string]interface{}{
+			"list_cursor":       progress.Cursor,
+			"list_repos_seen":   progress.Seen,
+			"list_repos_failed": progress.Failed,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("saving listing progress for %q: %w", remote.Host, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errListPassReset
+	}
+	listReposSeen.WithLabelValues(remote.Host).Set(float64(progress.Seen))
+	return nil
+}
+
+// fetchPage fetches a single page of listRepos, retrying with exponential backoff.
+func (l *Lister) fetchPage(ctx context.Context, client *xrpc.Client, host string, cursor string) (*comatproto.SyncListRepos_Output, error) {
+	log := zerolog.Ctx(ctx)
+	const maxAttempts = 5
+	backoff := time.Second
+
+	for attempt := 1; ; attempt++ {
+		resp, err := comatproto.SyncListRepos(ctx, client, cursor, 1000)
+		if err == nil {
+			listPagesFetched.WithLabelValues(host).Inc()
+			return resp, nil
+		}
+		if attempt >= maxAttempts || ctx.Err() != nil {
+			return nil, fmt.Errorf("listRepos (cursor %q, %d attempts): %w", cursor, attempt, err)
+		}
+
+		listPageRetries.WithLabelValues(host).Inc()
+		wait := backoff
+		var xrpcErr *xrpc.Error
+		if errors.As(err, &xrpcErr) && xrpcErr.Ratelimit != nil && time.Until(xrpcErr.Ratelimit.Reset) > wait {
+			wait = time.Until(xrpcErr.Ratelimit.Reset)
+		}
+		log.Warn().Err(err).Msgf("Failed to fetch a page of repos from %q (attempt %d), retrying in %s: %s", host, attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// addRepos processes pages of listed repos, saving progress after each page.
+// If it fails to save progress, or ctx is cancelled, it closes stopped and
+// ignores the remaining pages.
+func (l *Lister) addRepos(ctx context.Context, remote *pds.PDS, pages chan *comatproto.SyncListRepos_Output, progress listProgress, stopped chan struct{}) (listProgress, error) {
+	var saveErr error
+	stop := sync.OnceFunc(func() { close(stopped) })
+	defer stop()
+	for resp := range pages {
+		if ctx.Err() != nil || saveErr != nil {
+			stop()
+			// Drain the channel so that the sender doesn't block.
+			continue
+		}
+		n := 0
+		// Repos that were added successfully, grouped by account status,
+		// so that they can be updated with a few queries per page.
+		byStatus := map[accountStatus][]models.ID{}
+		for _, repoInfo := range resp.Repos {
+			if repoInfo == nil {
+				continue
 			}
-			return
-		},
-		func(resp *comatproto.SyncListRepos_Output, acc int) (int, error) {
-			for _, repo := range resp.Repos {
-				if repo == nil {
-					continue
+			n++
+			if id, ok := l.addRepo(ctx, repoInfo, remote.Host); ok {
+				status := accountStatus{Active: repoInfo.Active == nil || *repoInfo.Active}
+				if repoInfo.Status != nil {
+					status.Status = *repoInfo.Status
 				}
-				acc++
-				repos <- repo
+				byStatus[status] = append(byStatus[status], id)
+			} else {
+				progress.Failed++
 			}
-			return acc, nil
-		})
+			if (progress.Seen+int64(n))%10_000 == 0 {
+				zerolog.Ctx(ctx).Info().Msgf("Received %d repos from %q so far...", progress.Seen+int64(n), remote.Host)
+			}
+		}
+		for status, ids := range byStatus {
+			if err := l.updateListed(ctx, remote, ids, status, progress.StartedAt); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to update account status of %d repos from %q: %s", len(ids), remote.Host, err)
+				progress.Failed += int64(len(ids))
+			}
+		}
+		if ctx.Err() != nil {
+			// Page might have been processed partially, don't save the cursor.
+			continue
+		}
+		reposListed.WithLabelValues(remote.Host).Add(float64(n))
+		progress.Seen += int64(n)
+		if resp.Cursor != nil {
+			progress.Cursor = *resp.Cursor
+		}
+		saveErr = l.saveProgress(ctx, remote, progress)
+		if saveErr != nil {
+			stop()
+		}
+	}
+	return progress, saveErr
+}
+
+type accountStatus struct {
+	Active bool
+	Status string
+}
+
+// updateListed records account status of repos listed in the pass that
+// started at listedAt. Only repos attributed to the listing PDS are updated,
+// so that last_listed_at tells if the repo was included in the latest
+// listing of its own PDS, regardless of what other PDSs list.
+func (l *Lister) updateListed(ctx context.Context, remote *pds.PDS, ids []models.ID, status accountStatus, listedAt time.Time) error {
+	return l.db.WithContext(ctx).Model(&repo.Repo{}).
+		Where("id in ? and pds = ?", ids, remote.ID).
+		Updates(map[string]interface{}{
+			"account_active":       status.Active,
+			"account_status":       status.Status,
+			"last_listed_at":       listedAt,
+			"missing_from_listing": false,
+		}).Error
+}
 
+// addRepo processes a single listed repo and returns its ID, or false if
+// it failed. Account status is updated separately, by updateListed.
+func (l *Lister) addRepo(ctx context.Context, repoInfo *comatproto.SyncListRepos_Repo, host string) (models.ID, bool) {
+	log := zerolog.Ctx(ctx)
+
+	record, created, err := repo.EnsureExists(ctx, l.db, repoInfo.Did)
 	if err != nil {
-		// Update the timestamp so we don't get stuck on a single broken PDS
-		if err := db.Model(&remote).Updates(&pds.PDS{LastList: time.Now()}).Error; err != nil {
-			log.Error().Err(err).Msgf("Failed to update the timestamp of last list for %q: %s", remote.Host, err)
+		log.Error().Err(err).Msgf("Failed to ensure that we have a record for the repo %q: %s", repoInfo.Did, err)
+		return 0, false
+	} else if created {
+		reposDiscovered.WithLabelValues(host).Inc()
+	}
+
+	if l.isStale(record, repoInfo.Rev) {
+		// Trigger an incremental re-fetch the same way the consumer
+		// does for too big commits.
+		err := l.db.WithContext(ctx).Model(&repo.Repo{}).
+			Where("id = ? and (first_rev_since_reset is null or first_rev_since_reset < ?)", record.ID, repoInfo.Rev).
+			Updates(&repo.Repo{FirstRevSinceReset: repoInfo.Rev}).Error
+		if err == nil {
+			err = repo.RaisePriority(ctx, l.db, record.ID, repo.PriorityTooBig)
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to mark %q for re-fetch: %s", repoInfo.Did, err)
+		} else {
+			log.Debug().Msgf("Repo %q is behind the PDS (listed rev %q, indexed %q, firehose %q), marking for re-fetch",
+				repoInfo.Did, repoInfo.Rev, record.LastIndexedRev, record.LastFirehoseRev)
+			reposStale.WithLabelValues(host).Inc()
 		}
-		close(repos)
-		wg.Wait()
-		return err
 	}
-	close(repos)
-	wg.Wait()
 
-	log.Info().Msgf("Received %d DIDs from %q", total, remote.Host)
-	reposListed.WithLabelValues(remote.Host).Add(float64(total))
+	if record.FirstRevSinceReset == "" {
+		// Populate this field in case it's empty, so we don't have to wait for the first firehose event
+		// to trigger a resync.
+		err := l.db.Transaction(func(tx *gorm.DB) error {
+			var currentRecord repo.Repo
+			if err := tx.Model(&record).Where(&repo.Repo{ID: record.ID}).Take(&currentRecord).Error; err != nil {
+				return err
+			}
+			if currentRecord.FirstRevSinceReset != "" {
+				// Someone else already updated it, nothing to do.
+				return nil
+			}
+			var remote pds.PDS
+			if err := tx.Model(&remote).Where(&pds.PDS{ID: record.PDS}).Take(&remote).Error; err != nil {
+				return err
+			}
+			return tx.Model(&record).Where(&repo.Repo{ID: record.ID}).Updates(&repo.Repo{
+				FirstRevSinceReset:    repoInfo.Rev,
+				FirstCursorSinceReset: remote.FirstCursorSinceReset,
+			}).Error
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to set the initial FirstRevSinceReset value for %q: %s", repoInfo.Did, err)
+		}
+	}
+	return record.ID, true
+}
 
-	if err := db.Model(&remote).Updates(&pds.PDS{LastList: time.Now()}).Error; err != nil {
-		return fmt.Errorf("failed to update the timestamp: %w", err)
+// isStale returns true if the repo was indexed before, but both the indexed
+// rev and the rev last seen on the firehose are behind the rev reported by
+// the PDS by more than staleRevThreshold, and no re-fetch is pending yet.
+func (l *Lister) isStale(record *repo.Repo, listedRev string) bool {
+	if record.LastIndexedRev == "" || listedRev == "" {
+		// Never indexed, will be fetched anyway.
+		return false
+	}
+	if record.FirstRevSinceReset != "" && record.LastIndexedRev < record.FirstRevSinceReset {
+		// Re-fetch is already pending.
+		return false
+	}
+
+	known := record.LastIndexedRev
+	if record.LastFirehoseRev > known {
+		known = record.LastFirehoseRev
+	}
+	if listedRev <= known {
+		return false
+	}
+
+	listed, err := syntax.ParseTID(listedRev)
+	if err != nil {
+		return false
+	}
+	current, err := syntax.ParseTID(known)
+	if err != nil {
+		// Can't tell how far behind we are, so assume the worst.
+		return true
+	}
+	return listed.Time().Sub(current.Time()) > l.staleRevThreshold
+}
+
+// flagMissing marks repos attributed to the PDS, which were not included in
+// the listing that started at passStarted.
+func (l *Lister) flagMissing(ctx context.Context, remote *pds.PDS, passStarted time.Time) error {
+	log := zerolog.Ctx(ctx)
+
+	result := l.db.WithContext(ctx).Model(&repo.Repo{}).
+		Where("pds = ? and not missing_from_listing and (last_listed_at is null or last_listed_at < ?)", remote.ID, passStarted).
+		Update("missing_from_listing", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Info().Msgf("%d repos attributed to %q were missing from the listing", result.RowsAffected, remote.Host)
+		reposMissing.WithLabelValues(remote.Host).Add(float64(result.RowsAffected))
 	}
 	return nil
 }
 
-func (l *Lister) addRepos(ctx context.Context, repos chan *comatproto.SyncListRepos_Repo, host string) {
+// runProber periodically checks PDSs that were disabled due to being
+// unreachable, and re-enables them once they're back up.
+func (l *Lister) runProber(ctx context.Context) {
 	log := zerolog.Ctx(ctx)
-	count := 0
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
 
 	for {
+		if err := l.probeDisabled(ctx); err != nil {
+			log.Error().Err(err).Msgf("Failed to re-probe disabled PDSs: %s", err)
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		case repoInfo, ok := <-repos:
-			if !ok {
-				return
-			}
-			record, created, err := repo.EnsureExists(ctx, l.db, repoInfo.Did)
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to ensure that we have a record for the repo %q: %s", repoInfo.Did, err)
-			} else if created {
-				reposDiscovered.WithLabelValues(host).Inc()
-			}
+		case <-t.C:
+		}
+	}
+}
 
-			if err == nil && record.FirstRevSinceReset == "" {
-				// Populate this field in case it's empty, so we don't have to wait for the first firehose event
-				// to trigger a resync.
-				err := l.db.Transaction(func(tx *gorm.DB) error {
-					var currentRecord repo.Repo
-					if err := tx.Model(&record).Where(&repo.Repo{ID: record.ID}).Take(&currentRecord).Error; err != nil {
-						return err
-					}
-					if currentRecord.FirstRevSinceReset != "" {
-						// Someone else already updated it, nothing to do.
-						return nil
-					}
-					var remote pds.PDS
-					if err := tx.Model(&remote).Where(&pds.PDS{ID: record.PDS}).Take(&remote).Error; err != nil {
-						return err
-					}
-					return tx.Model(&record).Where(&repo.Repo{ID: record.ID}).Updates(&repo.Repo{
-						FirstRevSinceReset:    repoInfo.Rev,
-						FirstCursorSinceReset: remote.FirstCursorSinceReset,
-					}).Error
-				})
-				if err != nil {
-					log.Error().Err(err).Msgf("Failed to set the initial FirstRevSinceReset value for %q: %s", repoInfo.Did, err)
-				}
-			}
-			count++
-			if count%10_000 == 0 {
-				log.Info().Msgf("Received %d repos from %q so far...", count, host)
+func (l *Lister) probeDisabled(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	db := l.db.WithContext(ctx)
+
+	remotes := []pds.PDS{}
+	err := db.Model(&remotes).
+		Where("disabled and disabled_by = ? and (last_probe is null or last_probe < ?)",
+			pds.DisabledByHealth, time.Now().Add(-l.reprobeInterval)).
+		Find(&remotes).Error
+	if err != nil {
+		return fmt.Errorf("querying DB: %w", err)
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	for _, remote := range remotes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d := pds.CheckPolicy(ctx, remote.Host); !d.Allowed {
+			// Stays disabled even if it's back up.
+			log.Debug().Msgf("Not probing PDS %q, it's not allowed by the policy: %s", remote.Host, d.Reason())
+			continue
+		}
+
+		err := pds.Probe(ctx, client, remote.Host)
+		if err2 := db.Model(&remote).Where(&pds.PDS{ID: remote.ID}).Updates(&pds.PDS{LastProbe: time.Now()}).Error; err2 != nil {
+			return fmt.Errorf("updating last probe timestamp for %q: %w", remote.Host, err2)
+		}
+		if err != nil {
+			log.Debug().Err(err).Msgf("PDS %q is still down: %s", remote.Host, err)
+			if err := pds.RecordFailure(ctx, l.db, &remote, err, "lister"); err != nil {
+				log.Error().Err(err).Msgf("Failed to update health status of %q: %s", remote.Host, err)
 			}
+			continue
+		}
+
+		log.Info().Msgf("PDS %q is reachable again, enabling it", remote.Host)
+		if err := pds.RecordSuccess(ctx, l.db, &remote); err != nil {
+			log.Error().Err(err).Msgf("Failed to update health status of %q: %s", remote.Host, err)
+		}
+		if _, err := pds.SetDisabled(ctx, l.db, &remote, false, "", "lister", "health probe succeeded"); err != nil {
+			log.Error().Err(err).Msgf("Failed to enable PDS %q: %s", remote.Host, err)
+		}
+	}
+	return nil
+}
+
+// runMetadataCollector periodically fetches metadata of every enabled PDS.
+func (l *Lister) runMetadataCollector(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+
+	for {
+		if err := l.collectMetadata(ctx); err != nil {
+			log.Error().Err(err).Msgf("Failed to collect PDS metadata: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (l *Lister) collectMetadata(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	db := l.db.WithContext(ctx)
+
+	remotes := []pds.PDS{}
+	err := db.Model(&remotes).
+		Where("(disabled=false or disabled is null) and id not in (select pds from pds_metadata where checked_at > ?)",
+			time.Now().Add(-l.metadataInterval)).
+		Find(&remotes).Error
+	if err != nil {
+		return fmt.Errorf("querying DB: %w", err)
+	}
+
+	for _, remote := range remotes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		client := l.newClient(ctx, remote.Host)
+		client.Client = &http.Client{Timeout: 30 * time.Second}
+		m := pds.FetchMetadata(ctx, client, &remote)
+		if m.Error != "" {
+			log.Debug().Msgf("Failed to fetch some of the metadata from %q: %s", remote.Host, m.Error)
+		}
+		if err := pds.StoreMetadata(ctx, l.db, m); err != nil {
+			return fmt.Errorf("storing metadata of %q: %w", remote.Host, err)
 		}
 	}
+	return nil
+}
+
+func (l *Lister) newClient(ctx context.Context, host string) *xrpc.Client {
+	client := xrpcauth.NewAnonymousClient(ctx)
+	client.Host = host
+	userAgent := fmt.Sprintf("Go-http-client/1.1 indexerbot/0.1 (based on github.com/uabluerail/indexer; %s)", l.contactInfo)
+	client.UserAgent = &userAgent
+	return client
 }
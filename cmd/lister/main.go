@@ -7,7 +7,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -25,16 +24,22 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/pds/admin"
+	"github.com/uabluerail/indexer/util/adminserver"
 	"github.com/uabluerail/indexer/util/gormzerolog"
 )
 
 type Config struct {
-	LogFile     string
-	LogFormat   string `default:"text"`
-	LogLevel    int64  `default:"1"`
-	MetricsPort string `split_words:"true"`
-	DBUrl       string `envconfig:"POSTGRES_URL"`
-	ContactInfo string `split_words:"true"`
+	LogFile       string
+	LogFormat     string `default:"text"`
+	LogLevel      int64  `default:"1"`
+	MetricsPort   string `split_words:"true"`
+	DBUrl         string `envconfig:"POSTGRES_URL"`
+	ContactInfo   string `split_words:"true"`
+	PDSPolicyFile string `envconfig:"PDS_POLICY_FILE"`
+
+	Admin adminserver.Config
 }
 
 var config Config
@@ -58,6 +63,10 @@ func runMain(ctx context.Context) error {
 		config.ContactInfo = "<contact info unspecified>"
 	}
 
+	if err := pds.WatchPolicy(ctx, db, config.PDSPolicyFile, "lister"); err != nil {
+		return fmt.Errorf("loading PDS policy: %w", err)
+	}
+
 	lister, err := NewLister(ctx, db, config.ContactInfo)
 	if err != nil {
 		return fmt.Errorf("failed to create lister: %w", err)
@@ -66,6 +75,17 @@ func runMain(ctx context.Context) error {
 		return fmt.Errorf("failed to start lister: %w", err)
 	}
 
+	adminSrv, err := adminserver.New(config.Admin)
+	if err != nil {
+		return fmt.Errorf("creating admin server: %w", err)
+	}
+	admin.AddHandlers(adminSrv, db, "lister")
+	go func() {
+		if err := adminSrv.ListenAndServe(ctx); err != nil {
+			log.Error().Err(err).Msgf("Admin HTTP server failed: %s", err)
+		}
+	}()
+
 	log.Info().Msgf("Starting HTTP listener on %q...", config.MetricsPort)
 	http.Handle("/metrics", promhttp.Handler())
 	srv := &http.Server{Addr: fmt.Sprintf(":%s", config.MetricsPort)}
@@ -14,3 +14,33 @@ var reposListed = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "repo_listed_counter",
 	Help: "Counter of repos received by listing PDSs.",
 }, []string{"remote"})
+
+var reposStale = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "repo_stale_counter",
+	Help: "Counter of repos marked for re-fetch because the listed rev was ahead of ours.",
+}, []string{"remote"})
+
+var reposMissing = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "repo_missing_from_listing_counter",
+	Help: "Counter of repos that were flagged because the PDS did not list them.",
+}, []string{"remote"})
+
+var listPagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lister_pages_fetched_counter",
+	Help: "Counter of listRepos pages fetched.",
+}, []string{"remote"})
+
+var listPageRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lister_page_retries_counter",
+	Help: "Counter of retried listRepos requests.",
+}, []string{"remote"})
+
+var listReposSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lister_pass_repos_seen",
+	Help: "Number of repos received so far in the current listing pass.",
+}, []string{"remote"})
+
+var listPassesCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lister_passes_completed_counter",
+	Help: "Counter of completed listing passes.",
+}, []string{"remote"})
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/util/adminserver"
+)
+
+func AddAdminHandlers(srv *adminserver.Server, db *gorm.DB) {
+	srv.HandleFunc("/xrpc/com.atproto.sync.requestCrawl", adminserver.RoleWrite, handleRequestCrawl(db))
+}
+
+// handleRequestCrawl allows to manually submit a PDS host. The host is
+// checked against the policy and probed before being added.
+func handleRequestCrawl(db *gorm.DB) http.HandlerFunc {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := zerolog.Ctx(ctx)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		input := comatproto.SyncRequestCrawl_Input{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if input.Hostname == "" {
+			http.Error(w, "missing hostname", http.StatusBadRequest)
+			return
+		}
+
+		host := pds.NormalizeHost("https://" + input.Hostname)
+		if d := pds.CheckPolicy(ctx, host); !d.Allowed {
+			http.Error(w, fmt.Sprintf("host %q is not allowed (%s)", host, d.Reason()), http.StatusForbidden)
+			return
+		}
+		if err := pds.Probe(ctx, client, host); err != nil {
+			http.Error(w, fmt.Sprintf("host %q is not reachable: %s", host, err), http.StatusBadRequest)
+			return
+		}
+		if _, err := pds.RecordDiscovery(ctx, db, host, pds.SourceManual); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err := audit.Record(ctx, db, audit.Entry{
+			Actor:   adminserver.Actor(ctx, "pds-discovery"),
+			Action:  "pds.requestCrawl",
+			Target:  host,
+			Details: fmt.Sprintf("requested from %s", r.RemoteAddr),
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to record audit entry: %s", err)
+		}
+
+		log.Info().Msgf("Added %q via requestCrawl", host)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -99,7 +99,7 @@ func (c *JetstreamConsumer) handleEvent(ctx context.Context, event *models.Event
 	if err != nil {
 		return err
 	}
-	_, err = pds.EnsureExists(ctx, c.db, u.String())
+	_, err = pds.RecordDiscovery(ctx, c.db, u.String(), pds.SourceJetstream)
 	if err != nil {
 		return err
 	}
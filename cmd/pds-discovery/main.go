@@ -7,7 +7,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -27,16 +26,25 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/util/adminserver"
 	"github.com/uabluerail/indexer/util/gormzerolog"
 )
 
 type Config struct {
-	LogFile     string
-	LogFormat   string `default:"text"`
-	LogLevel    int64  `default:"1"`
-	MetricsPort string `split_words:"true"`
-	DBUrl       string `envconfig:"POSTGRES_URL"`
-	Jetstream   string
+	LogFile       string
+	LogFormat     string `default:"text"`
+	LogLevel      int64  `default:"1"`
+	MetricsPort   string `split_words:"true"`
+	DBUrl         string `envconfig:"POSTGRES_URL"`
+	Jetstream     string
+	Relays        string
+	PLCExport     bool   `split_words:"true"`
+	PLCAddr       string `envconfig:"ATP_PLC_ADDR" default:"https://plc.directory"`
+	ContactInfo   string `split_words:"true"`
+	PDSPolicyFile string `envconfig:"PDS_POLICY_FILE"`
+
+	Admin adminserver.Config
 }
 
 var config Config
@@ -46,8 +54,11 @@ func runMain(ctx context.Context) error {
 	log := zerolog.Ctx(ctx)
 	log.Debug().Msgf("Starting up...")
 
-	if config.Jetstream == "" {
-		return fmt.Errorf("missing jetstream addresses")
+	if config.Jetstream == "" && config.Relays == "" && !config.PLCExport {
+		return fmt.Errorf("no discovery sources configured: need at least one of jetstream addresses, relay addresses or PLC export")
+	}
+	if config.ContactInfo == "" {
+		config.ContactInfo = "<contact info unspecified>"
 	}
 
 	dbCfg, err := pgxpool.ParseConfig(config.DBUrl)
@@ -79,7 +90,11 @@ func runMain(ctx context.Context) error {
 	}
 	log.Debug().Msgf("DB connection established")
 
-	for _, host := range strings.Split(config.Jetstream, ",") {
+	if err := pds.WatchPolicy(ctx, db, config.PDSPolicyFile, "pds-discovery"); err != nil {
+		return fmt.Errorf("loading PDS policy: %w", err)
+	}
+
+	for _, host := range splitList(config.Jetstream) {
 		c, err := NewJetstreamConsumer(ctx, host, db)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to create relay consumer for %q: %s", host, err)
@@ -88,6 +103,29 @@ func runMain(ctx context.Context) error {
 		c.Start(ctx)
 	}
 
+	for _, host := range splitList(config.Relays) {
+		NewRelayLister(ctx, host, db, config.ContactInfo).Start(ctx)
+	}
+
+	if config.PLCExport {
+		e, err := NewPLCExporter(ctx, config.PLCAddr, db)
+		if err != nil {
+			return fmt.Errorf("creating PLC exporter: %w", err)
+		}
+		e.Start(ctx)
+	}
+
+	adminSrv, err := adminserver.New(config.Admin)
+	if err != nil {
+		return fmt.Errorf("creating admin server: %w", err)
+	}
+	AddAdminHandlers(adminSrv, db)
+	go func() {
+		if err := adminSrv.ListenAndServe(ctx); err != nil {
+			log.Error().Err(err).Msgf("Admin HTTP server failed: %s", err)
+		}
+	}()
+
 	log.Info().Msgf("Starting HTTP listener on %q...", config.MetricsPort)
 	http.Handle("/metrics", promhttp.Handler())
 	srv := &http.Server{Addr: fmt.Sprintf(":%s", config.MetricsPort)}
@@ -109,6 +147,8 @@ func main() {
 	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
 	flag.Int64Var(&config.LogLevel, "log-level", 1, "Log level. -1 - trace, 0 - debug, 1 - info, 5 - panic")
 	flag.StringVar(&config.Jetstream, "jetstream", "", "List of jetstream instances to connect to")
+	flag.StringVar(&config.Relays, "relays", "", "List of relays to fetch the list of hosts from")
+	flag.BoolVar(&config.PLCExport, "plc-export", false, "Discover PDSs by following PLC export log")
 
 	if err := envconfig.Process("pds-discovery", &config); err != nil {
 		log.Fatalf("envconfig.Process: %s", err)
@@ -123,6 +163,16 @@ func main() {
 	}
 }
 
+func splitList(s string) []string {
+	r := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			r = append(r, item)
+		}
+	}
+	return r
+}
+
 func setupLogging(ctx context.Context) context.Context {
 	logFile := os.Stderr
 
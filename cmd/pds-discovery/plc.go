@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/util/plc"
+)
+
+const plcExportPageSize = 1000
+
+// PLCExporter follows the PLC export log and records service endpoints
+// of all DIDs that are being created or updated.
+type PLCExporter struct {
+	addr   string
+	db     *gorm.DB
+	client *http.Client
+	// Hosts that are already recorded, to avoid hitting the database
+	// for every operation.
+	known map[string]bool
+	// Set if the next page should start strictly after the cursor.
+	skipBoundary bool
+}
+
+func NewPLCExporter(ctx context.Context, addr string, db *gorm.DB) (*PLCExporter, error) {
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("parsing URL %q: %w", addr, err)
+	}
+	return &PLCExporter{
+		addr:   addr,
+		db:     db,
+		client: &http.Client{Timeout: time.Minute},
+		known:  map[string]bool{},
+	}, nil
+}
+
+func (e *PLCExporter) Start(ctx context.Context) {
+	go e.run(ctx)
+}
+
+func (e *PLCExporter) run(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("plc", e.addr).Logger()
+	ctx = log.WithContext(ctx)
+
+	for {
+		n, err := e.exportPage(ctx)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to fetch PLC export page: %s", err)
+		}
+
+		wait := time.Duration(0)
+		if err != nil || n < plcExportPageSize {
+			// Either we've caught up, or something is wrong. Either way
+			// there's no point in retrying immediately.
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			log.Info().Msgf("PLC exporter stopped")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// plcCursor is the position in the PLC export log. The log can only be
+// requested after a given time, and several entries can share the same
+// one, so the cursor includes its time and also lists entries with that
+// time that were already processed.
+type plcCursor struct {
+	CreatedAt string
+	CIDs      map[string]bool
+}
+
+func parsePLCCursor(s string) plcCursor {
+	createdAt, cids, _ := strings.Cut(s, " ")
+	c := plcCursor{CreatedAt: createdAt, CIDs: map[string]bool{}}
+	for _, cid := range strings.Split(cids, ",") {
+		if cid != "" {
+			c.CIDs[cid] = true
+		}
+	}
+	return c
+}
+
+func (c plcCursor) String() string {
+	cids := []string{}
+	for cid := range c.CIDs {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	return strings.TrimSpace(c.CreatedAt + " " + strings.Join(cids, ","))
+}
+
+// exportPage fetches and processes a single page of the export log,
+// returning the number of entries in it.
+func (e *PLCExporter) exportPage(ctx context.Context) (int, error) {
+	log := zerolog.Ctx(ctx)
+
+	stored, err := pds.GetDiscoveryCursor(ctx, e.db, pds.SourcePLC)
+	if err != nil {
+		return 0, err
+	}
+	cursor := parsePLCCursor(stored)
+
+	u, err := url.Parse(e.addr)
+	if err != nil {
+		return 0, fmt.Errorf("parsing URL %q: %w", e.addr, err)
+	}
+	u = u.JoinPath("export")
+	params := url.Values{"count": []string{fmt.Sprint(plcExportPageSize)}}
+	if cursor.CreatedAt != "" {
+		after := cursor.CreatedAt
+		if t, err := time.Parse(time.RFC3339Nano, after); err == nil && !e.skipBoundary {
+			// Ask for entries with the same time too, since there might be
+			// more of them that didn't fit into the previous page.
+			after = t.Add(-time.Millisecond).UTC().Format("2006-01-02T15:04:05.000Z")
+		}
+		params.Set("after", after)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned status %d", u, resp.StatusCode)
+	}
+
+	// Number of entries on the page, and how many of them weren't seen
+	// before.
+	n, fresh := 0, 0
+	var readErr error
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for decoder.More() {
+		raw := json.RawMessage{}
+		if err := decoder.Decode(&raw); err != nil {
+			// The rest of the response can't be read, but entries before
+			// this one are still processed.
+			readErr = fmt.Errorf("reading export log entry: %w", err)
+			break
+		}
+		n++
+
+		position := struct {
+			CID       string `json:"cid"`
+			CreatedAt string `json:"createdAt"`
+		}{}
+		if err := json.Unmarshal(raw, &position); err != nil || position.CreatedAt == "" {
+			log.Warn().Msgf("Skipping export log entry without a valid createdAt: %s", raw)
+			continue
+		}
+		if position.CreatedAt == cursor.CreatedAt {
+			if cursor.CIDs[position.CID] {
+				continue
+			}
+			cursor.CIDs[position.CID] = true
+		} else {
+			cursor = plcCursor{CreatedAt: position.CreatedAt, CIDs: map[string]bool{position.CID: true}}
+		}
+		fresh++
+
+		entry := plc.OperationLogEntry{}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			log.Warn().Err(err).Msgf("Skipping export log entry %s that failed to parse: %s", position.CID, err)
+			continue
+		}
+		if entry.Nullified {
+			continue
+		}
+		endpoint := ""
+		switch op := entry.Operation.Value.(type) {
+		case plc.Op:
+			endpoint = op.Services["atproto_pds"].Endpoint
+		case plc.LegacyCreateOp:
+			endpoint = op.Service
+		}
+		if endpoint == "" {
+			continue
+		}
+		host := pds.NormalizeHost(endpoint)
+		if e.known[host] || !pds.IsAllowed(ctx, host) {
+			continue
+		}
+		if _, err := pds.RecordDiscovery(ctx, e.db, host, pds.SourcePLC); err != nil {
+			log.Warn().Err(err).Msgf("Failed to record %q (from %s): %s", host, entry.DID, err)
+			continue
+		}
+		e.known[host] = true
+	}
+
+	// A full page of entries that were all seen before means that more of
+	// them share the same time than fit into a page. The only way forward
+	// is to skip the rest of them.
+	e.skipBoundary = n == plcExportPageSize && fresh == 0
+	if e.skipBoundary {
+		log.Warn().Msgf("More than %d export log entries at %s, skipping the rest of them", plcExportPageSize, cursor.CreatedAt)
+	}
+
+	if fresh > 0 {
+		if err := pds.SetDiscoveryCursor(ctx, e.db, pds.SourcePLC, cursor.String()); err != nil {
+			return n, err
+		}
+	}
+	return n, readErr
+}
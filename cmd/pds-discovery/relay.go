@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/uabluerail/bsky-tools/xrpcauth"
+
+	"github.com/uabluerail/indexer/pds"
+)
+
+// listHostsOutput is the output of com.atproto.sync.listHosts. The method is
+// too new to be included in the version of indigo we're using.
+type listHostsOutput struct {
+	Cursor *string    `json:"cursor,omitempty"`
+	Hosts  []listHost `json:"hosts"`
+}
+
+type listHost struct {
+	Hostname     string `json:"hostname"`
+	Seq          int64  `json:"seq,omitempty"`
+	AccountCount int64  `json:"accountCount,omitempty"`
+	Status       string `json:"status,omitempty"`
+}
+
+// RelayLister periodically fetches the list of hosts that a relay
+// is crawling.
+type RelayLister struct {
+	host        string
+	db          *gorm.DB
+	contactInfo string
+	interval    time.Duration
+}
+
+func NewRelayLister(ctx context.Context, host string, db *gorm.DB, contactInfo string) *RelayLister {
+	return &RelayLister{
+		host:        pds.NormalizeHost(host),
+		db:          db,
+		contactInfo: contactInfo,
+		interval:    6 * time.Hour,
+	}
+}
+
+func (l *RelayLister) Start(ctx context.Context) {
+	go l.run(ctx)
+}
+
+func (l *RelayLister) run(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("relay", l.host).Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := l.listHosts(ctx); err != nil {
+			log.Error().Err(err).Msgf("Failed to list hosts of relay %q: %s", l.host, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msgf("Relay lister stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *RelayLister) listHosts(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	source := pds.SourceRelay + ":" + l.host
+
+	client := xrpcauth.NewAnonymousClient(ctx)
+	client.Host = l.host
+	userAgent := fmt.Sprintf("Go-http-client/1.1 indexerbot/0.1 (based on github.com/uabluerail/indexer; %s)", l.contactInfo)
+	client.UserAgent = &userAgent
+
+	cursor := ""
+	total, added := 0, 0
+	for {
+		params := map[string]interface{}{"limit": 1000}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		resp := listHostsOutput{}
+		if err := client.Do(ctx, xrpc.Query, "", "com.atproto.sync.listHosts", params, nil, &resp); err != nil {
+			return fmt.Errorf("listHosts: %w", err)
+		}
+
+		for _, h := range resp.Hosts {
+			if h.Hostname == "" {
+				continue
+			}
+			total++
+			if h.Status != "" && h.Status != "active" {
+				continue
+			}
+			host := pds.NormalizeHost("https://" + h.Hostname)
+			if !pds.IsAllowed(ctx, host) {
+				continue
+			}
+			if _, err := pds.RecordDiscovery(ctx, l.db, host, source); err != nil {
+				log.Warn().Err(err).Msgf("Failed to record %q: %s", host, err)
+				continue
+			}
+			added++
+		}
+
+		if resp.Cursor == nil || *resp.Cursor == "" || *resp.Cursor == cursor {
+			break
+		}
+		cursor = *resp.Cursor
+	}
+
+	log.Info().Msgf("Relay %q reported %d hosts, %d of them are active and allowed", l.host, total, added)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/backlinks"
+	"github.com/uabluerail/indexer/models"
+)
+
+type backlinksServer struct {
+	db *gorm.DB
+}
+
+type backlinkView struct {
+	URI  string `json:"uri"`
+	Path string `json:"path"`
+}
+
+type backlinksOutput struct {
+	Cursor string         `json:"cursor,omitempty"`
+	Links  []backlinkView `json:"links"`
+}
+
+type backlinkCountsOutput struct {
+	Target string            `json:"target"`
+	Total  int64             `json:"total"`
+	Counts []backlinks.Count `json:"counts"`
+}
+
+func parseTarget(r *http.Request) (string, error) {
+	target := r.FormValue("target")
+	switch {
+	case strings.HasPrefix(target, "at://"):
+		if _, err := syntax.ParseATURI(target); err != nil {
+			return "", invalidRequest("invalid target %q: %s", target, err)
+		}
+	case strings.HasPrefix(target, "did:"):
+		if _, err := syntax.ParseDID(target); err != nil {
+			return "", invalidRequest("invalid target %q: %s", target, err)
+		}
+	default:
+		return "", invalidRequest("target must be an AT-URI or a DID")
+	}
+	return target, nil
+}
+
+// handleList returns records that reference the target, newest first.
+func (s *backlinksServer) handleList(w http.ResponseWriter, r *http.Request) error {
+	target, err := parseTarget(r)
+	if err != nil {
+		return err
+	}
+	limit := defaultListLimit
+	if l := r.FormValue("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return invalidRequest("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+	var before models.ID
+	if c := r.FormValue("cursor"); c != "" {
+		n, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			return invalidRequest("invalid cursor %q", c)
+		}
+		before = models.ID(n)
+	}
+
+	links, err := backlinks.List(r.Context(), s.db, target, r.FormValue("collection"), before, limit)
+	if err != nil {
+		return err
+	}
+	resp := backlinksOutput{Links: []backlinkView{}}
+	for _, l := range links {
+		resp.Links = append(resp.Links, backlinkView{URI: l.URI(), Path: l.Path})
+	}
+	if len(links) == limit {
+		resp.Cursor = strconv.FormatInt(int64(links[len(links)-1].ID), 10)
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// handleCount returns the number of references to the target, grouped by
+// collection and path.
+func (s *backlinksServer) handleCount(w http.ResponseWriter, r *http.Request) error {
+	target, err := parseTarget(r)
+	if err != nil {
+		return err
+	}
+	counts, err := backlinks.Counts(r.Context(), s.db, target, r.FormValue("collection"))
+	if err != nil {
+		return err
+	}
+	resp := backlinkCountsOutput{Target: target, Counts: counts}
+	for _, c := range counts {
+		resp.Total += c.Count
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
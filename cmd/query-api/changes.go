@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/webhooks"
+)
+
+const (
+	changesPageSize     = 500
+	changesPollInterval = 500 * time.Millisecond
+	keepaliveInterval   = 15 * time.Second
+	maxChangeFilters    = 100
+)
+
+// changesServer streams the change feed over SSE or websocket.
+type changesServer struct {
+	db       *gorm.DB
+	upgrader websocket.Upgrader
+}
+
+func newChangesServer(db *gorm.DB) *changesServer {
+	return &changesServer{
+		db: db,
+		upgrader: websocket.Upgrader{
+			// The feed is public, same as the rest of the API.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// parseRequest returns the seq to start after and the filter. Without
+// a cursor the stream starts from the latest change.
+func (s *changesServer) parseRequest(r *http.Request) (int64, changes.Filter, error) {
+	filter := changes.Filter{}
+	if len(r.Form["collection"]) > maxChangeFilters || len(r.Form["did"]) > maxChangeFilters {
+		return 0, filter, invalidRequest("too many filters, at most %d of each are allowed", maxChangeFilters)
+	}
+	for _, c := range r.Form["collection"] {
+		if _, err := syntax.ParseNSID(c); err != nil {
+			return 0, filter, invalidRequest("invalid collection %q", c)
+		}
+		filter.Collections = append(filter.Collections, c)
+	}
+	for _, d := range r.Form["did"] {
+		if _, err := syntax.ParseDID(d); err != nil {
+			return 0, filter, invalidRequest("invalid DID %q", d)
+		}
+		filter.DIDs = append(filter.DIDs, d)
+	}
+
+	cursor := r.Form.Get("cursor")
+	if cursor == "" {
+		// Sent by browsers when an EventSource reconnects.
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+	if cursor == "" {
+		seq, err := changes.LastSeq(r.Context(), s.db)
+		return seq, filter, err
+	}
+	seq, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, filter, invalidRequest("invalid cursor %q", cursor)
+	}
+	return seq, filter, nil
+}
+
+func (s *changesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, invalidRequest("%s", err))
+		return
+	}
+	after, filter, err := s.parseRequest(r)
+	if err != nil {
+		xerr, ok := err.(*xrpcError)
+		if !ok {
+			xerr = &xrpcError{Status: http.StatusInternalServerError, Name: "InternalServerError", Message: err.Error()}
+		}
+		writeJSON(w, xerr.Status, xerr)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebsocket(w, r, after, filter)
+	} else {
+		s.serveSSE(w, r, after, filter)
+	}
+}
+
+// stream sends changes after the given seq until the context is cancelled
+// or sending fails. keepalive is called when there were no changes for a
+// while.
+func (s *changesServer) stream(ctx context.Context, after int64, filter changes.Filter, send func(*changes.Change) error, keepalive func() error) error {
+	keepaliveTicker := time.NewTicker(keepaliveInterval)
+	defer keepaliveTicker.Stop()
+
+	for {
+		batch, err := changes.Read(ctx, s.db, after, filter, changesPageSize)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err := send(&batch[i]); err != nil {
+				return err
+			}
+			after = batch[i].Seq
+		}
+		if len(batch) > 0 {
+			keepaliveTicker.Reset(keepaliveInterval)
+		}
+		if len(batch) == changesPageSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepaliveTicker.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+		case <-time.After(changesPollInterval):
+		}
+	}
+}
+
+func (s *changesServer) serveSSE(w http.ResponseWriter, r *http.Request, after int64, filter changes.Filter) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disable response buffering in nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	changeSubscribers.WithLabelValues("sse").Inc()
+	defer changeSubscribers.WithLabelValues("sse").Dec()
+
+	send := func(c *changes.Change) error {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", c.Seq, b); err != nil {
+			return err
+		}
+		changesSent.WithLabelValues("sse").Inc()
+		return rc.Flush()
+	}
+	keepalive := func() error {
+		if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := s.stream(ctx, after, filter, send, keepalive); err != nil && ctx.Err() == nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msgf("SSE stream terminated: %s", err)
+	}
+}
+
+func (s *changesServer) serveWebsocket(w http.ResponseWriter, r *http.Request, after int64, filter changes.Filter) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response.
+		return
+	}
+	defer conn.Close()
+
+	changeSubscribers.WithLabelValues("websocket").Inc()
+	defer changeSubscribers.WithLabelValues("websocket").Dec()
+
+	// We don't expect any messages from the client, but need to read
+	// to process control frames and to notice when the connection is closed.
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(c *changes.Change) error {
+		conn.SetWriteDeadline(time.Now().Add(keepaliveInterval))
+		if err := conn.WriteJSON(c); err != nil {
+			return err
+		}
+		changesSent.WithLabelValues("websocket").Inc()
+		return nil
+	}
+	keepalive := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepaliveInterval))
+	}
+	if err := s.stream(ctx, after, filter, send, keepalive); err != nil && ctx.Err() == nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msgf("Websocket stream terminated: %s", err)
+	}
+}
+
+// pruneChanges periodically deletes changes older than the retention
+// period, except the ones that enabled webhooks haven't processed yet.
+func pruneChanges(ctx context.Context, db *gorm.DB, retention time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		n, err := pruneOnce(ctx, db, retention)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to prune change feed: %s", err)
+		} else if n > 0 {
+			log.Info().Msgf("Pruned %d changes older than %s", n, retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pruneOnce(ctx context.Context, db *gorm.DB, retention time.Duration) (int64, error) {
+	upTo, found, err := webhooks.MinLastSeq(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		upTo = math.MaxInt64
+	}
+	return changes.Prune(ctx, db, time.Now().Add(-retention), upTo)
+}
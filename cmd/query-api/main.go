@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/gocql/gocql"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/scylladb/gocqlx/v3"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/uabluerail/indexer/routing"
+	"github.com/uabluerail/indexer/util/gormzerolog"
+)
+
+type Config struct {
+	LogFile      string
+	LogFormat    string `default:"text"`
+	LogLevel     int64  `default:"1"`
+	MetricsPort  string `split_words:"true"`
+	ListenPort   string `split_words:"true" default:"8081"`
+	DBUrl        string `envconfig:"POSTGRES_URL"`
+	ScyllaDBAddr string `envconfig:"SCYLLADB_ADDR"`
+	PLCAddr      string `envconfig:"ATP_PLC_ADDR" default:"https://plc.directory"`
+	// How long to keep changes in the change feed. Zero disables pruning.
+	ChangesRetention time.Duration `split_words:"true" default:"72h"`
+	// Same as for the consumer and record indexer, to know which tables
+	// to read collections from.
+	CollectionRoutes []string `split_words:"true"`
+}
+
+var config Config
+
+func runMain(ctx context.Context) error {
+	ctx = setupLogging(ctx)
+	log := zerolog.Ctx(ctx)
+	log.Debug().Msgf("Starting up...")
+	db, err := gorm.Open(postgres.Open(config.DBUrl), &gorm.Config{
+		Logger: gormzerolog.New(&logger.Config{
+			SlowThreshold:             1 * time.Second,
+			IgnoreRecordNotFoundError: true,
+		}, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to the database: %w", err)
+	}
+	log.Debug().Msgf("DB connection established")
+
+	router, err := routing.New(nil, nil, config.CollectionRoutes)
+	if err != nil {
+		return fmt.Errorf("parsing collection routes: %w", err)
+	}
+	if err := router.CheckTables(ctx, db); err != nil {
+		return err
+	}
+
+	var store recordStore = &postgresStore{db: db, table: routing.DefaultTable}
+	if config.ScyllaDBAddr != "" {
+		scylla := gocql.NewCluster(config.ScyllaDBAddr)
+		session, err := gocqlx.WrapSession(scylla.CreateSession())
+		if err != nil {
+			return fmt.Errorf("Creating ScyllaDB session: %w", err)
+		}
+		store = &scyllaStore{db: db, session: &session}
+	}
+	store = &routedStore{db: db, router: router, def: store}
+
+	identity.DefaultPLCURL = config.PLCAddr
+	api := &xrpcServer{
+		store:     store,
+		directory: identity.DefaultDirectory(),
+		backlinks: &backlinksServer{db: db},
+		changes:   newChangesServer(db),
+	}
+	if config.ChangesRetention > 0 {
+		go pruneChanges(ctx, db, config.ChangesRetention)
+	}
+	mux := http.NewServeMux()
+	api.AddHandlers(mux)
+	apiSrv := &http.Server{Addr: fmt.Sprintf(":%s", config.ListenPort), Handler: mux}
+	errCh := make(chan error, 2)
+	go func() {
+		log.Info().Msgf("Starting XRPC listener on %q...", config.ListenPort)
+		errCh <- apiSrv.ListenAndServe()
+	}()
+
+	log.Info().Msgf("Starting HTTP listener on %q...", config.MetricsPort)
+	http.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", config.MetricsPort)}
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+		if err := apiSrv.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("XRPC server shutdown failed: %w", err)
+		}
+		if err := srv.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("HTTP server shutdown failed: %w", err)
+		}
+	}
+	return <-errCh
+}
+
+func main() {
+	flag.StringVar(&config.LogFile, "log", "", "Path to the log file. If empty, will log to stderr")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
+	flag.Int64Var(&config.LogLevel, "log-level", 1, "Log level. -1 - trace, 0 - debug, 1 - info, 5 - panic")
+
+	if err := envconfig.Process("query-api", &config); err != nil {
+		log.Fatalf("envconfig.Process: %s", err)
+	}
+
+	flag.Parse()
+
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	if err := runMain(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func setupLogging(ctx context.Context) context.Context {
+	logFile := os.Stderr
+
+	if config.LogFile != "" {
+		f, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open the specified log file %q: %s", config.LogFile, err)
+		}
+		logFile = f
+	}
+
+	var output io.Writer
+
+	switch config.LogFormat {
+	case "json":
+		output = logFile
+	case "text":
+		prefixList := []string{}
+		info, ok := debug.ReadBuildInfo()
+		if ok {
+			prefixList = append(prefixList, info.Path+"/")
+		}
+
+		basedir := ""
+		_, sourceFile, _, ok := runtime.Caller(0)
+		if ok {
+			basedir = filepath.Dir(sourceFile)
+		}
+
+		if basedir != "" && strings.HasPrefix(basedir, "/") {
+			prefixList = append(prefixList, basedir+"/")
+			head, _ := filepath.Split(basedir)
+			for head != "/" {
+				prefixList = append(prefixList, head)
+				head, _ = filepath.Split(strings.TrimSuffix(head, "/"))
+			}
+		}
+
+		output = zerolog.ConsoleWriter{
+			Out:        logFile,
+			NoColor:    true,
+			TimeFormat: time.RFC3339,
+			PartsOrder: []string{
+				zerolog.LevelFieldName,
+				zerolog.TimestampFieldName,
+				zerolog.CallerFieldName,
+				zerolog.MessageFieldName,
+			},
+			FormatFieldName:  func(i interface{}) string { return fmt.Sprintf("%s:", i) },
+			FormatFieldValue: func(i interface{}) string { return fmt.Sprintf("%s", i) },
+			FormatCaller: func(i interface{}) string {
+				s := i.(string)
+				for _, p := range prefixList {
+					s = strings.TrimPrefix(s, p)
+				}
+				return s
+			},
+		}
+	default:
+		log.Fatalf("Invalid log format specified: %q", config.LogFormat)
+	}
+
+	logger := zerolog.New(output).Level(zerolog.Level(config.LogLevel)).With().Caller().Timestamp().Logger()
+
+	ctx = logger.WithContext(ctx)
+
+	zerolog.DefaultContextLogger = &logger
+	log.SetOutput(logger)
+
+	return ctx
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var requestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "query_api_requests_count",
+	Help: "Number of XRPC requests served",
+}, []string{"method", "status"})
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "query_api_request_duration_seconds",
+	Help:    "Time spent serving XRPC requests",
+	Buckets: prometheus.ExponentialBucketsRange(0.001, 30, 20),
+}, []string{"method"})
+
+var changeSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "query_api_change_subscribers",
+	Help: "Number of connected change feed subscribers",
+}, []string{"transport"})
+
+var changesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "query_api_changes_sent_count",
+	Help: "Number of changes sent to change feed subscribers",
+}, []string{"transport"})
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/qb"
+	"github.com/scylladb/gocqlx/v3"
+	"gorm.io/gorm"
+)
+
+// scyllaStore reads records from ScyllaDB. Repos are still stored
+// in Postgres.
+type scyllaStore struct {
+	db      *gorm.DB
+	session *gocqlx.Session
+}
+
+type scyllaRow struct {
+	Rkey    string          `db:"rkey"`
+	AtRev   string          `db:"at_rev"`
+	CID     string          `db:"cid"`
+	Deleted bool            `db:"deleted"`
+	Record  json.RawMessage `db:"record"`
+}
+
+func (s *scyllaStore) GetRecord(ctx context.Context, did string, collection string, rkey string) (*storedRecord, error) {
+	if _, err := getRepo(ctx, s.db, did); err != nil {
+		return nil, err
+	}
+	// Rows are ordered by at_rev descending within the same rkey,
+	// so the first one is the latest.
+	row := scyllaRow{}
+	err := s.session.Query(
+		qb.Select("bluesky.records").Columns("rkey", "at_rev", "cid", "deleted", "record").
+			Where(qb.Eq("repo"), qb.Eq("collection"), qb.Eq("rkey")).Limit(1).ToCql()).
+		WithContext(ctx).Bind(did, collection, rkey).GetRelease(&row)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying record: %w", err)
+	}
+	return &storedRecord{
+		Collection: collection,
+		Rkey:       row.Rkey,
+		AtRev:      row.AtRev,
+		CID:        row.CID,
+		Deleted:    row.Deleted,
+		Content:    row.Record,
+	}, nil
+}
+
+func (s *scyllaStore) ListRecords(ctx context.Context, did string, collection string, opts listOptions) ([]storedRecord, error) {
+	if _, err := getRepo(ctx, s.db, did); err != nil {
+		return nil, err
+	}
+
+	q := qb.Select("bluesky.records").Columns("rkey", "at_rev", "cid", "deleted", "record").
+		Where(qb.Eq("repo"), qb.Eq("collection"))
+	args := []interface{}{did, collection}
+	if opts.Reverse {
+		if opts.Cursor != "" {
+			q = q.Where(qb.Gt("rkey"))
+			args = append(args, opts.Cursor)
+		}
+	} else {
+		if opts.Cursor != "" {
+			q = q.Where(qb.Lt("rkey"))
+			args = append(args, opts.Cursor)
+		}
+		q = q.OrderBy("rkey", qb.DESC).OrderBy("at_rev", qb.ASC)
+	}
+
+	iter := s.session.Query(q.ToCql()).WithContext(ctx).Bind(args...).Iter()
+
+	// There can be several rows per rkey, one for each version of the
+	// record. Pick the latest one from each group.
+	r := []storedRecord{}
+	var cur *scyllaRow
+	emit := func() {
+		if cur == nil || (cur.Deleted && !opts.IncludeDeleted) {
+			return
+		}
+		r = append(r, storedRecord{
+			Collection: collection,
+			Rkey:       cur.Rkey,
+			AtRev:      cur.AtRev,
+			CID:        cur.CID,
+			Deleted:    cur.Deleted,
+			Content:    cur.Record,
+		})
+	}
+	row := scyllaRow{}
+	for len(r) < opts.Limit && iter.StructScan(&row) {
+		switch {
+		case cur == nil || cur.Rkey != row.Rkey:
+			emit()
+			copied := row
+			cur = &copied
+		case row.AtRev > cur.AtRev:
+			copied := row
+			cur = &copied
+		}
+		row = scyllaRow{}
+	}
+	if len(r) < opts.Limit {
+		emit()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("querying records: %w", err)
+	}
+	return r, nil
+}
+
+// Collections is not supported, since the records table is partitioned
+// by (repo, collection) and can't be queried by repo alone.
+func (s *scyllaStore) Collections(ctx context.Context, did string) ([]string, error) {
+	if _, err := getRepo(ctx, s.db, did); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
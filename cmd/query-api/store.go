@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
+)
+
+var errRepoNotFound = errors.New("repo not found")
+var errRecordNotFound = errors.New("record not found")
+
+type storedRecord struct {
+	Collection string
+	Rkey       string
+	AtRev      string
+	// CID is empty if the record was indexed before CIDs were stored.
+	CID     string
+	Deleted bool
+	Content json.RawMessage
+}
+
+type listOptions struct {
+	// Only records with rkey after the cursor (in the order of listing)
+	// are returned.
+	Cursor string
+	Limit  int
+	// By default records are listed in descending order of rkey.
+	Reverse        bool
+	IncludeDeleted bool
+}
+
+// recordStore is implemented by both storage backends.
+type recordStore interface {
+	// GetRecord returns the latest version of the record, which might be
+	// a tombstone.
+	GetRecord(ctx context.Context, did string, collection string, rkey string) (*storedRecord, error)
+	ListRecords(ctx context.Context, did string, collection string, opts listOptions) ([]storedRecord, error)
+	// Collections returns the list of collections that have at least
+	// one record in the repo, or nil if the backend can't tell.
+	Collections(ctx context.Context, did string) ([]string, error)
+}
+
+type postgresStore struct {
+	db    *gorm.DB
+	table string
+}
+
+func getRepo(ctx context.Context, db *gorm.DB, did string) (*repo.Repo, error) {
+	r := &repo.Repo{}
+	err := db.WithContext(ctx).Model(r).Where(&repo.Repo{DID: did}).Take(r).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errRepoNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying repo %q: %w", did, err)
+	}
+	return r, nil
+}
+
+func (s *postgresStore) GetRecord(ctx context.Context, did string, collection string, rkey string) (*storedRecord, error) {
+	r, err := getRepo(ctx, s.db, did)
+	if err != nil {
+		return nil, err
+	}
+	rec := repo.Record{}
+	err = s.db.WithContext(ctx).Model(&rec).Table(s.table).
+		Where(&repo.Record{Repo: r.ID, Collection: collection, Rkey: rkey}).
+		Take(&rec).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying record: %w", err)
+	}
+	return &storedRecord{
+		Collection: rec.Collection,
+		Rkey:       rec.Rkey,
+		AtRev:      rec.AtRev,
+		CID:        rec.CID,
+		Deleted:    rec.Deleted,
+		Content:    rec.Content,
+	}, nil
+}
+
+func (s *postgresStore) ListRecords(ctx context.Context, did string, collection string, opts listOptions) ([]storedRecord, error) {
+	r, err := getRepo(ctx, s.db, did)
+	if err != nil {
+		return nil, err
+	}
+	q := s.db.WithContext(ctx).Model(&repo.Record{}).Table(s.table).
+		Where(&repo.Record{Repo: r.ID, Collection: collection}).
+		Limit(opts.Limit)
+	if !opts.IncludeDeleted {
+		q = q.Where("not coalesce(deleted, false)")
+	}
+	if opts.Reverse {
+		q = q.Order("rkey asc")
+		if opts.Cursor != "" {
+			q = q.Where("rkey > ?", opts.Cursor)
+		}
+	} else {
+		q = q.Order("rkey desc")
+		if opts.Cursor != "" {
+			q = q.Where("rkey < ?", opts.Cursor)
+		}
+	}
+
+	recs := []repo.Record{}
+	if err := q.Find(&recs).Error; err != nil {
+		return nil, fmt.Errorf("querying records: %w", err)
+	}
+	r2 := []storedRecord{}
+	for _, rec := range recs {
+		r2 = append(r2, storedRecord{
+			Collection: rec.Collection,
+			Rkey:       rec.Rkey,
+			AtRev:      rec.AtRev,
+			CID:        rec.CID,
+			Deleted:    rec.Deleted,
+			Content:    rec.Content,
+		})
+	}
+	return r2, nil
+}
+
+func (s *postgresStore) Collections(ctx context.Context, did string) ([]string, error) {
+	r, err := getRepo(ctx, s.db, did)
+	if err != nil {
+		return nil, err
+	}
+	collections := []string{}
+	err = s.db.WithContext(ctx).Model(&repo.Record{}).Table(s.table).
+		Where("repo = ? and not coalesce(deleted, false)", r.ID).
+		Distinct("collection").Order("collection").
+		Pluck("collection", &collections).Error
+	if err != nil {
+		return nil, fmt.Errorf("querying collections: %w", err)
+	}
+	return collections, nil
+}
+
+// routedStore reads collections routed to their own Postgres tables from
+// there, and everything else from the default store.
+type routedStore struct {
+	db     *gorm.DB
+	router *routing.Router
+	def    recordStore
+}
+
+func (s *routedStore) storeFor(collection string) recordStore {
+	if table := s.router.Route(collection).Table; table != "" {
+		return &postgresStore{db: s.db, table: table}
+	}
+	return s.def
+}
+
+func (s *routedStore) GetRecord(ctx context.Context, did string, collection string, rkey string) (*storedRecord, error) {
+	return s.storeFor(collection).GetRecord(ctx, did, collection, rkey)
+}
+
+func (s *routedStore) ListRecords(ctx context.Context, did string, collection string, opts listOptions) ([]storedRecord, error) {
+	return s.storeFor(collection).ListRecords(ctx, did, collection, opts)
+}
+
+func (s *routedStore) Collections(ctx context.Context, did string) ([]string, error) {
+	collections, err := s.def.Collections(ctx, did)
+	if err != nil || collections == nil {
+		// A partial list would be misleading.
+		return collections, err
+	}
+	for _, table := range s.router.Tables() {
+		more, err := (&postgresStore{db: s.db, table: table}).Collections(ctx, did)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, more...)
+	}
+	slices.Sort(collections)
+	return slices.Compact(collections), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rs/zerolog"
+
+	"github.com/uabluerail/indexer/util/resolver"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+)
+
+type xrpcServer struct {
+	store     recordStore
+	directory identity.Directory
+	backlinks *backlinksServer
+	changes   *changesServer
+}
+
+func (s *xrpcServer) AddHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/xrpc/com.atproto.repo.getRecord", s.instrument("com.atproto.repo.getRecord", s.handleGetRecord))
+	mux.HandleFunc("/xrpc/com.atproto.repo.listRecords", s.instrument("com.atproto.repo.listRecords", s.handleListRecords))
+	mux.HandleFunc("/xrpc/com.atproto.repo.describeRepo", s.instrument("com.atproto.repo.describeRepo", s.handleDescribeRepo))
+	mux.HandleFunc("/backlinks", s.instrument("backlinks", s.backlinks.handleList))
+	mux.HandleFunc("/backlinks/count", s.instrument("backlinks.count", s.backlinks.handleCount))
+	mux.Handle("/changes", s.changes)
+	mux.HandleFunc("/xrpc/_health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"version": "query-api"})
+	})
+}
+
+// xrpcError is returned to clients in the format defined by the XRPC spec.
+type xrpcError struct {
+	Status  int    `json:"-"`
+	Name    string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *xrpcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+func invalidRequest(format string, args ...interface{}) *xrpcError {
+	return &xrpcError{Status: http.StatusBadRequest, Name: "InvalidRequest", Message: fmt.Sprintf(format, args...)}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument converts returned errors into XRPC error responses and
+// records metrics.
+func (s *xrpcServer) instrument(method string, h func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// The API is public and read-only, so allow browser clients too.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		if err := h(rec, r); err != nil {
+			xerr, ok := err.(*xrpcError)
+			if !ok {
+				zerolog.Ctx(r.Context()).Error().Err(err).Str("method", method).Msgf("Request failed: %s", err)
+				xerr = &xrpcError{Status: http.StatusInternalServerError, Name: "InternalServerError", Message: err.Error()}
+			}
+			writeJSON(rec, xerr.Status, xerr)
+		}
+		requestsCount.WithLabelValues(method, strconv.Itoa(rec.status)).Inc()
+		requestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// resolveRepo accepts either a DID or a handle, and returns the DID.
+func (s *xrpcServer) resolveRepo(ctx context.Context, repoParam string) (string, error) {
+	if repoParam == "" {
+		return "", invalidRequest("missing repo")
+	}
+	id, err := syntax.ParseAtIdentifier(repoParam)
+	if err != nil {
+		return "", invalidRequest("invalid repo %q: %s", repoParam, err)
+	}
+	if id.IsDID() {
+		did, _ := id.AsDID()
+		return did.String(), nil
+	}
+	handle, _ := id.AsHandle()
+	ident, err := s.directory.LookupHandle(ctx, handle)
+	if err != nil {
+		return "", invalidRequest("failed to resolve handle %q: %s", handle, err)
+	}
+	return ident.DID.String(), nil
+}
+
+// mapStoreError converts well-known errors into XRPC errors.
+func mapStoreError(err error) error {
+	switch {
+	case errors.Is(err, errRepoNotFound):
+		return &xrpcError{Status: http.StatusBadRequest, Name: "RepoNotFound", Message: "Could not find repo"}
+	case errors.Is(err, errRecordNotFound):
+		return &xrpcError{Status: http.StatusBadRequest, Name: "RecordNotFound", Message: "Could not locate record"}
+	default:
+		return err
+	}
+}
+
+// recordView is a record as returned by getRecord and listRecords. In
+// addition to the standard fields it includes the rev at which the record
+// was indexed, and whether it has been deleted since.
+type recordView struct {
+	URI     string          `json:"uri"`
+	CID     string          `json:"cid,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	AtRev   string          `json:"atRev,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+func newRecordView(did string, rec *storedRecord) recordView {
+	v := recordView{
+		URI:     fmt.Sprintf("at://%s/%s/%s", did, rec.Collection, rec.Rkey),
+		AtRev:   rec.AtRev,
+		Deleted: rec.Deleted,
+	}
+	if rec.Deleted {
+		return v
+	}
+	v.Value = rec.Content
+	v.CID = rec.CID
+	return v
+}
+
+func parseBool(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+// handleGetRecord returns the latest version of a record. Deleted records
+// are reported as RecordNotFound, unless includeDeleted=true is passed, in
+// which case a tombstone is returned.
+func (s *xrpcServer) handleGetRecord(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	did, err := s.resolveRepo(ctx, r.FormValue("repo"))
+	if err != nil {
+		return err
+	}
+	collection := r.FormValue("collection")
+	if _, err := syntax.ParseNSID(collection); err != nil {
+		return invalidRequest("invalid collection %q", collection)
+	}
+	rkey := r.FormValue("rkey")
+	if _, err := syntax.ParseRecordKey(rkey); err != nil {
+		return invalidRequest("invalid rkey %q", rkey)
+	}
+
+	rec, err := s.store.GetRecord(ctx, did, collection, rkey)
+	if err != nil {
+		return mapStoreError(err)
+	}
+	if rec.Deleted && !parseBool(r.FormValue("includeDeleted")) {
+		return mapStoreError(errRecordNotFound)
+	}
+	v := newRecordView(did, rec)
+	if c := r.FormValue("cid"); c != "" && c != v.CID {
+		return mapStoreError(errRecordNotFound)
+	}
+	writeJSON(w, http.StatusOK, v)
+	return nil
+}
+
+type listRecordsOutput struct {
+	Cursor  string       `json:"cursor,omitempty"`
+	Records []recordView `json:"records"`
+}
+
+func (s *xrpcServer) handleListRecords(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	did, err := s.resolveRepo(ctx, r.FormValue("repo"))
+	if err != nil {
+		return err
+	}
+	collection := r.FormValue("collection")
+	if _, err := syntax.ParseNSID(collection); err != nil {
+		return invalidRequest("invalid collection %q", collection)
+	}
+	opts := listOptions{
+		Cursor:         r.FormValue("cursor"),
+		Limit:          defaultListLimit,
+		Reverse:        parseBool(r.FormValue("reverse")),
+		IncludeDeleted: parseBool(r.FormValue("includeDeleted")),
+	}
+	if l := r.FormValue("limit"); l != "" {
+		opts.Limit, err = strconv.Atoi(l)
+		if err != nil || opts.Limit < 1 || opts.Limit > maxListLimit {
+			return invalidRequest("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+
+	recs, err := s.store.ListRecords(ctx, did, collection, opts)
+	if err != nil {
+		return mapStoreError(err)
+	}
+	resp := listRecordsOutput{Records: []recordView{}}
+	for i := range recs {
+		resp.Records = append(resp.Records, newRecordView(did, &recs[i]))
+	}
+	if len(recs) == opts.Limit {
+		resp.Cursor = recs[len(recs)-1].Rkey
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+type describeRepoOutput struct {
+	Handle          string      `json:"handle"`
+	DID             string      `json:"did"`
+	DIDDoc          interface{} `json:"didDoc"`
+	Collections     []string    `json:"collections"`
+	HandleIsCorrect bool        `json:"handleIsCorrect"`
+}
+
+// handleDescribeRepo describes the repo. With ScyllaDB the list of
+// collections is always empty.
+func (s *xrpcServer) handleDescribeRepo(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	did, err := s.resolveRepo(ctx, r.FormValue("repo"))
+	if err != nil {
+		return err
+	}
+	collections, err := s.store.Collections(ctx, did)
+	if err != nil {
+		return mapStoreError(err)
+	}
+	if collections == nil {
+		collections = []string{}
+	}
+
+	doc, err := resolver.GetDocument(ctx, did)
+	if err != nil {
+		return fmt.Errorf("resolving %q: %w", did, err)
+	}
+	resp := describeRepoOutput{
+		Handle:      syntax.HandleInvalid.String(),
+		DID:         did,
+		DIDDoc:      doc,
+		Collections: collections,
+	}
+	if ident, err := s.directory.LookupDID(ctx, syntax.DID(did)); err == nil && ident.Handle != syntax.HandleInvalid {
+		resp.Handle = ident.Handle.String()
+		resp.HandleIsCorrect = true
+	} else {
+		for _, aka := range doc.AlsoKnownAs {
+			if h, found := strings.CutPrefix(aka, "at://"); found {
+				resp.Handle = h
+				break
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zerolog.DefaultContextLogger.Error().Err(err).Msgf("Failed to write response: %s", err)
+	}
+}
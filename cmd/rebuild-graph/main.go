@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/uabluerail/indexer/graph"
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
+	"github.com/uabluerail/indexer/util/gormzerolog"
+)
+
+type Config struct {
+	LogFile          string
+	LogFormat        string   `default:"text"`
+	LogLevel         int64    `default:"1"`
+	DBUrl            string   `envconfig:"POSTGRES_URL"`
+	ScyllaDBAddr     string   `envconfig:"SCYLLADB_ADDR"`
+	CollectionRoutes []string `split_words:"true"`
+}
+
+var config Config
+
+var (
+	collections = flag.String("collections", "", "Comma-separated list of collections to rebuild. If empty, all edge tables are rebuilt")
+	batchSize   = flag.Int("batch-size", 10000, "Number of repos to process in a single query")
+	startFrom   = flag.Uint("from", 0, "Repo ID to start from. If non-zero, existing edges are not removed, which allows to resume an interrupted rebuild")
+)
+
+func runMain(ctx context.Context) error {
+	ctx = setupLogging(ctx)
+	log := zerolog.Ctx(ctx)
+	log.Debug().Msgf("Starting up...")
+	db, err := gorm.Open(postgres.Open(config.DBUrl), &gorm.Config{
+		Logger: gormzerolog.New(&logger.Config{
+			SlowThreshold:             1 * time.Minute,
+			IgnoreRecordNotFoundError: true,
+		}, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to the database: %w", err)
+	}
+	log.Debug().Msgf("DB connection established")
+
+	if err := graph.AutoMigrate(db); err != nil {
+		return fmt.Errorf("auto-migrating DB schema: %w", err)
+	}
+
+	router, err := routing.New(nil, nil, config.CollectionRoutes)
+	if err != nil {
+		return fmt.Errorf("parsing collection routes: %w", err)
+	}
+	toRebuild := graph.Collections()
+	if *collections != "" {
+		toRebuild = strings.Split(*collections, ",")
+	}
+	slices.Sort(toRebuild)
+
+	// Changing the routes doesn't move already stored records, so all
+	// tables are read regardless of where the collection is routed now.
+	tables := append([]string{routing.DefaultTable}, router.Tables()...)
+	if config.ScyllaDBAddr != "" {
+		// Only records routed to PostgreSQL can be read back in bulk.
+		// Truncating edge tables of other collections would leave them
+		// empty.
+		tables = router.Tables()
+		for _, collection := range toRebuild {
+			if router.Route(collection).Table == "" {
+				return fmt.Errorf("records of %q are stored in ScyllaDB, rebuilding its edges is not supported", collection)
+			}
+		}
+	}
+
+	var maxID models.ID
+	err = db.WithContext(ctx).Model(&repo.Repo{}).Select("coalesce(max(id), 0)").Scan(&maxID).Error
+	if err != nil {
+		return fmt.Errorf("querying max repo ID: %w", err)
+	}
+
+	for _, collection := range toRebuild {
+		if *startFrom == 0 {
+			log.Info().Msgf("Truncating edge table for %q...", collection)
+			if err := graph.Truncate(ctx, db, collection); err != nil {
+				return err
+			}
+		}
+
+		var total int64
+		for from := models.ID(*startFrom); from <= maxID; from += models.ID(*batchSize) {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("interrupted while processing %q at repo %d: %w", collection, from, err)
+			}
+			to := from + models.ID(*batchSize)
+			for _, table := range tables {
+				n, err := graph.Rebuild(ctx, db, table, collection, from, to)
+				if err != nil {
+					return fmt.Errorf("repos [%d, %d): %w", from, to, err)
+				}
+				total += n
+			}
+			log.Info().Msgf("%s: processed repos up to %d of %d, %d edges inserted so far", collection, to, maxID, total)
+		}
+		log.Info().Msgf("Finished rebuilding %q: %d edges", collection, total)
+	}
+	return nil
+}
+
+func main() {
+	flag.StringVar(&config.LogFile, "log", "", "Path to the log file. If empty, will log to stderr")
+	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
+	flag.Int64Var(&config.LogLevel, "log-level", 1, "Log level. -1 - trace, 0 - debug, 1 - info, 5 - panic")
+
+	if err := envconfig.Process("rebuild-graph", &config); err != nil {
+		log.Fatalf("envconfig.Process: %s", err)
+	}
+
+	flag.Parse()
+
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	if err := runMain(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func setupLogging(ctx context.Context) context.Context {
+	logFile := os.Stderr
+
+	if config.LogFile != "" {
+		f, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open the specified log file %q: %s", config.LogFile, err)
+		}
+		logFile = f
+	}
+
+	var output io.Writer
+
+	switch config.LogFormat {
+	case "json":
+		output = logFile
+	case "text":
+		prefixList := []string{}
+		info, ok := debug.ReadBuildInfo()
+		if ok {
+			prefixList = append(prefixList, info.Path+"/")
+		}
+
+		basedir := ""
+		_, sourceFile, _, ok := runtime.Caller(0)
+		if ok {
+			basedir = filepath.Dir(sourceFile)
+		}
+
+		if basedir != "" && strings.HasPrefix(basedir, "/") {
+			prefixList = append(prefixList, basedir+"/")
+			head, _ := filepath.Split(basedir)
+			for head != "/" {
+				prefixList = append(prefixList, head)
+				head, _ = filepath.Split(strings.TrimSuffix(head, "/"))
+			}
+		}
+
+		output = zerolog.ConsoleWriter{
+			Out:        logFile,
+			NoColor:    true,
+			TimeFormat: time.RFC3339,
+			PartsOrder: []string{
+				zerolog.LevelFieldName,
+				zerolog.TimestampFieldName,
+				zerolog.CallerFieldName,
+				zerolog.MessageFieldName,
+			},
+			FormatFieldName:  func(i interface{}) string { return fmt.Sprintf("%s:", i) },
+			FormatFieldValue: func(i interface{}) string { return fmt.Sprintf("%s", i) },
+			FormatCaller: func(i interface{}) string {
+				s := i.(string)
+				for _, p := range prefixList {
+					s = strings.TrimPrefix(s, p)
+				}
+				return s
+			},
+		}
+	default:
+		log.Fatalf("Invalid log format specified: %q", config.LogFormat)
+	}
+
+	logger := zerolog.New(output).Level(zerolog.Level(config.LogLevel)).With().Caller().Timestamp().Logger()
+
+	ctx = logger.WithContext(ctx)
+
+	zerolog.DefaultContextLogger = &logger
+	log.SetOutput(logger)
+
+	return ctx
+}
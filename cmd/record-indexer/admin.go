@@ -6,16 +6,44 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/rs/zerolog"
+	"github.com/scylladb/gocqlx/v3"
 	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/routing"
+	"github.com/uabluerail/indexer/util/adminserver"
 )
 
-func AddAdminHandlers(limiter *Limiter, pool *WorkerPool) {
-	http.HandleFunc("/rate/set", handleRateSet(limiter))
-	http.HandleFunc("/rate/setAll", handleRateSetAll(limiter))
-	http.HandleFunc("/pool/resize", handlePoolResize(pool))
+func AddAdminHandlers(srv *adminserver.Server, limiter *Limiter, pool *WorkerPool, scheduler *Scheduler, db *gorm.DB, session *gocqlx.Session, router *routing.Router) {
+	srv.HandleFunc("/rate/set", adminserver.RoleWrite, handleRateSet(limiter, db))
+	srv.HandleFunc("/rate/setAll", adminserver.RoleWrite, handleRateSetAll(limiter, db))
+	srv.HandleFunc("/pool/resize", adminserver.RoleWrite, handlePoolResize(pool, db))
+
+	repos := &repoAdmin{db: db, recordsDB: session, router: router, scheduler: scheduler}
+	srv.HandleFunc("/repo/show", adminserver.RoleRead, repos.handleShow)
+	srv.HandleFunc("/repo/reindex", adminserver.RoleWrite, repos.handleReindex)
+	srv.HandleFunc("/repo/resetFailures", adminserver.RoleWrite, repos.handleResetFailures)
+	srv.HandleFunc("/repo/purge", adminserver.RoleWrite, repos.handlePurge)
+	srv.HandleFunc("/fetches", adminserver.RoleRead, handleFetches(pool))
+}
+
+// recordAudit records a change made via an admin endpoint. Failures are
+// only logged, since the change itself has already been applied.
+func recordAudit(r *http.Request, db *gorm.DB, action string, target string, details string) {
+	err := audit.Record(r.Context(), db, audit.Entry{
+		Actor:   adminserver.Actor(r.Context(), "record-indexer"),
+		Action:  action,
+		Target:  target,
+		Details: fmt.Sprintf("%s (requested from %s)", details, r.RemoteAddr),
+	})
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msgf("Failed to record audit entry: %s", err)
+	}
 }
 
-func handlePoolResize(pool *WorkerPool) http.HandlerFunc {
+func handlePoolResize(pool *WorkerPool, db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("size")
 		if s == "" {
@@ -30,11 +58,12 @@ func handlePoolResize(pool *WorkerPool) http.HandlerFunc {
 		}
 
 		pool.Resize(context.Background(), size)
+		recordAudit(r, db, "pool.resize", "", fmt.Sprintf("size=%d", size))
 		fmt.Fprintln(w, "OK")
 	}
 }
 
-func handleRateSet(limiter *Limiter) http.HandlerFunc {
+func handleRateSet(limiter *Limiter, db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("limit")
 		if s == "" {
@@ -54,11 +83,12 @@ func handleRateSet(limiter *Limiter) http.HandlerFunc {
 		}
 
 		limiter.SetLimit(context.Background(), name, rate.Limit(limit))
+		recordAudit(r, db, "rate.set", name, fmt.Sprintf("limit=%d", limit))
 		fmt.Fprintln(w, "OK")
 	}
 }
 
-func handleRateSetAll(limiter *Limiter) http.HandlerFunc {
+func handleRateSetAll(limiter *Limiter, db *gorm.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("limit")
 		if s == "" {
@@ -72,6 +102,7 @@ func handleRateSetAll(limiter *Limiter) http.HandlerFunc {
 		}
 
 		limiter.SetAllLimits(context.Background(), rate.Limit(limit))
+		recordAudit(r, db, "rate.setAll", "", fmt.Sprintf("limit=%d", limit))
 		fmt.Fprintln(w, "OK")
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/imax9000/errors"
+
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/uabluerail/indexer/repo"
+)
+
+// errBadCAR is wrapped into errors caused by the PDS returning something
+// that we can't parse as a repo.
+var errBadCAR = errors.New("bad CAR")
+
+// Delay before retrying after a transient error, doubled on every
+// consecutive failure.
+const (
+	minRetryDelay = time.Minute
+	maxRetryDelay = 24 * time.Hour
+)
+
+// retryCondition selects repos that either have no failed attempts, or for
+// which the backoff delay has passed since the last attempt.
+const retryCondition = `(
+	NOT coalesce(terminal, false)
+	AND (
+		coalesce(failed_attempts, 0) = 0
+		OR last_index_attempt < now() - least(
+			interval '1 second' * ? * power(2, least(failed_attempts, 20) - 1),
+			interval '1 second' * ?)
+	)
+)`
+
+func retryConditionArgs() []interface{} {
+	return []interface{}{minRetryDelay.Seconds(), maxRetryDelay.Seconds()}
+}
+
+func classifyFetchError(err error) repo.FetchErrorClass {
+	if err == nil {
+		return repo.ErrorNone
+	}
+	if errors.Is(err, errBadCAR) {
+		return repo.ErrorBadCAR
+	}
+	if xrpcErr, ok := errors.As[*xrpc.Error](err); ok {
+		if xrpcErr.IsThrottled() {
+			return repo.ErrorRateLimit
+		}
+		if e, ok := errors.As[*xrpc.XRPCError](err); ok {
+			switch e.ErrStr {
+			case "RepoNotFound":
+				return repo.ErrorNotFound
+			case "RepoTakendown":
+				return repo.ErrorTakendown
+			case "RepoDeactivated", "RepoSuspended":
+				return repo.ErrorInactive
+			}
+		}
+		// A bare 404 without the RepoNotFound error usually means that
+		// the method is not there (old PDS version, misrouted URL, proxy),
+		// not the repo. That is worth retrying later.
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return repo.ErrorTimeout
+	}
+	if netErr, ok := errors.As[net.Error](err); ok && netErr.Timeout() {
+		return repo.ErrorTimeout
+	}
+	return repo.ErrorOther
+}
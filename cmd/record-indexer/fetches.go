@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// fetchProgress tracks a repo fetch that is currently in progress.
+type fetchProgress struct {
+	DID     string
+	PDS     string
+	Started time.Time
+	bytes   atomic.Int64
+}
+
+func (f *fetchProgress) Bytes() int64 {
+	return f.bytes.Load()
+}
+
+// countingTransport counts the bytes of all response bodies
+// received through it.
+type countingTransport struct {
+	base    http.RoundTripper
+	counter *atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &countingReader{ReadCloser: resp.Body, counter: t.counter}
+	return resp, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	counter *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(int64(n))
+	return n, err
+}
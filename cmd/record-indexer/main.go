@@ -7,7 +7,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -29,6 +28,10 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/uabluerail/indexer/lexicon"
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/routing"
+	"github.com/uabluerail/indexer/util/adminserver"
 	"github.com/uabluerail/indexer/util/gormzerolog"
 )
 
@@ -40,8 +43,17 @@ type Config struct {
 	DBUrl               string   `envconfig:"POSTGRES_URL"`
 	Workers             int      `default:"2"`
 	CollectionBlacklist []string `split_words:"true"`
+	CollectionAllowlist []string `split_words:"true"`
+	CollectionRoutes    []string `split_words:"true"`
+	RecordValidation    string   `split_words:"true" default:"off"`
+	LexiconDir          string   `split_words:"true"`
 	ScyllaDBAddr        string   `envconfig:"SCYLLADB_ADDR"`
 	ContactInfo         string   `split_words:"true"`
+	InstanceID          string   `split_words:"true"`
+	ChangeFeed          bool     `split_words:"true"`
+	PDSPolicyFile       string   `envconfig:"PDS_POLICY_FILE"`
+
+	Admin adminserver.Config
 }
 
 var config Config
@@ -54,6 +66,11 @@ func runMain(ctx context.Context) error {
 	if config.ContactInfo == "" {
 		config.ContactInfo = "<contact info unspecified>"
 	}
+	if config.InstanceID == "" {
+		hostname, _ := os.Hostname()
+		config.InstanceID = fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().Unix())
+	}
+	log.Info().Msgf("Instance ID: %q", config.InstanceID)
 
 	dbCfg, err := pgxpool.ParseConfig(config.DBUrl)
 	if err != nil {
@@ -82,11 +99,23 @@ func runMain(ctx context.Context) error {
 	}
 	log.Debug().Msgf("DB connection established")
 
+	if err := pds.WatchPolicy(ctx, db, config.PDSPolicyFile, "record-indexer"); err != nil {
+		return fmt.Errorf("loading PDS policy: %w", err)
+	}
+
 	limiter, err := NewLimiter(db)
 	if err != nil {
 		return fmt.Errorf("failed to create limiter: %w", err)
 	}
 
+	go func() {
+		for host := range pds.ListenForChanges(ctx, conn) {
+			if err := limiter.Reload(ctx, host); err != nil {
+				log.Error().Err(err).Msgf("Failed to reload crawl limit: %s", err)
+			}
+		}
+	}()
+
 	var session *gocqlx.Session
 	if config.ScyllaDBAddr != "" {
 		scylla := gocql.NewCluster(config.ScyllaDBAddr)
@@ -97,20 +126,47 @@ func runMain(ctx context.Context) error {
 		session = &s
 	}
 
+	router, err := routing.New(config.CollectionAllowlist, config.CollectionBlacklist, config.CollectionRoutes)
+	if err != nil {
+		return fmt.Errorf("parsing collection routes: %w", err)
+	}
+	if err := router.CheckTables(ctx, db); err != nil {
+		return err
+	}
+
+	validator, err := lexicon.NewValidator(lexicon.Mode(config.RecordValidation), config.LexiconDir)
+	if err != nil {
+		return fmt.Errorf("loading lexicons: %w", err)
+	}
+
 	ch := make(chan WorkItem)
 	pool := NewWorkerPool(ch, db, session, config.Workers, limiter, config.ContactInfo)
+	pool.SetRouter(router)
+	pool.SetValidator(validator)
+	if config.ChangeFeed {
+		pool.EnableChangeFeed()
+	}
 	if err := pool.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start worker pool: %w", err)
 	}
-	pool.BlacklistCollections(config.CollectionBlacklist)
 
-	scheduler := NewScheduler(ch, db)
+	scheduler := NewScheduler(ch, db, config.InstanceID)
 	if err := scheduler.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start scheduler: %w", err)
 	}
 
+	adminSrv, err := adminserver.New(config.Admin)
+	if err != nil {
+		return fmt.Errorf("creating admin server: %w", err)
+	}
+	AddAdminHandlers(adminSrv, limiter, pool, scheduler, db, session, router)
+	go func() {
+		if err := adminSrv.ListenAndServe(ctx); err != nil {
+			log.Error().Err(err).Msgf("Admin HTTP server failed: %s", err)
+		}
+	}()
+
 	log.Info().Msgf("Starting HTTP listener on %q...", config.MetricsPort)
-	AddAdminHandlers(limiter, pool)
 	http.Handle("/metrics", promhttp.Handler())
 	srv := &http.Server{Addr: fmt.Sprintf(":%s", config.MetricsPort)}
 	errCh := make(chan error)
@@ -15,7 +15,17 @@ var reposQueued = promauto.NewCounter(prometheus.CounterOpts{
 var queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "indexer_queue_length",
 	Help: "Current length of indexing queue",
-}, []string{"state"})
+}, []string{"state", "class"})
+
+var leasesHeld = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "indexer_leases_held",
+	Help: "Number of repos currently leased by this instance",
+})
+
+var fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_fetch_errors_count",
+	Help: "Number of failed repo fetches by error class",
+}, []string{"class"})
 
 var reposFetched = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "indexer_repos_fetched_count",
@@ -61,3 +71,23 @@ var largeRepoLockWaitTime = promauto.NewHistogram(prometheus.HistogramOpts{
 	Help:    "Amount of time spent waiting for the large repo lock",
 	Buckets: prometheus.ExponentialBucketsRange(0.001, 300, 30),
 })
+
+var rateLimitGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "indexer_rate_limit",
+	Help: "Current rate limit for fetching repos from a PDS, in requests per second",
+}, []string{"remote"})
+
+var rateLimitDecreases = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_rate_limit_decreases_count",
+	Help: "Number of times the rate limit for a PDS was lowered due to errors",
+}, []string{"remote"})
+
+var reposParked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_repos_parked_count",
+	Help: "Number of times a repo was put aside because its PDS is throttled",
+}, []string{"remote"})
+
+var recordValidationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "indexer_record_validation_errors_count",
+	Help: "Number of records that failed validation against their lexicon",
+}, []string{"collection"})
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/repo"
+)
+
+// fairQueue orders repos by their FetchPriority, and within the same
+// priority takes repos from different PDSs in a round-robin fashion,
+// so that a single large PDS can't starve all the others.
+type fairQueue struct {
+	classes map[repo.FetchPriority]*pdsRoundRobin
+	dids    map[string]*repo.Repo
+}
+
+type pdsRoundRobin struct {
+	queues map[models.ID][]*repo.Repo
+	// Order in which PDSs are visited, next one is at the front.
+	order []models.ID
+	len   int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		classes: map[repo.FetchPriority]*pdsRoundRobin{},
+		dids:    map[string]*repo.Repo{},
+	}
+}
+
+func (q *fairQueue) Len() int {
+	return len(q.dids)
+}
+
+func (q *fairQueue) Contains(did string) bool {
+	return q.dids[did] != nil
+}
+
+// Get returns the queued repo with the given DID, or nil.
+func (q *fairQueue) Get(did string) *repo.Repo {
+	return q.dids[did]
+}
+
+// LenByClass returns the number of queued repos for each priority.
+func (q *fairQueue) LenByClass() map[repo.FetchPriority]int {
+	r := map[repo.FetchPriority]int{}
+	for p, c := range q.classes {
+		r[p] = c.len
+	}
+	return r
+}
+
+func (q *fairQueue) Push(r *repo.Repo) {
+	if q.dids[r.DID] != nil {
+		return
+	}
+	c := q.classes[r.FetchPriority]
+	if c == nil {
+		c = &pdsRoundRobin{queues: map[models.ID][]*repo.Repo{}}
+		q.classes[r.FetchPriority] = c
+	}
+	if len(c.queues[r.PDS]) == 0 {
+		c.order = append(c.order, r.PDS)
+	}
+	c.queues[r.PDS] = append(c.queues[r.PDS], r)
+	c.len++
+	q.dids[r.DID] = r
+}
+
+// Remove removes the repo with the given DID from the queue, if it's there.
+func (q *fairQueue) Remove(did string) {
+	r := q.dids[did]
+	if r == nil {
+		return
+	}
+	c := q.classes[r.FetchPriority]
+	queue := c.queues[r.PDS]
+	for i := range queue {
+		if queue[i] == r {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		c.queues[r.PDS] = queue
+	} else {
+		delete(c.queues, r.PDS)
+		for i := range c.order {
+			if c.order[i] == r.PDS {
+				c.order = append(c.order[:i], c.order[i+1:]...)
+				break
+			}
+		}
+	}
+	c.len--
+	delete(q.dids, did)
+}
+
+// Pop removes and returns the next repo, or nil if the queue is empty.
+func (q *fairQueue) Pop() *repo.Repo {
+	c := q.top()
+	if c == nil {
+		return nil
+	}
+	pds := c.order[0]
+	c.order = c.order[1:]
+	r := c.queues[pds][0]
+	c.queues[pds] = c.queues[pds][1:]
+	if len(c.queues[pds]) > 0 {
+		// Move to the back of the line.
+		c.order = append(c.order, pds)
+	} else {
+		delete(c.queues, pds)
+	}
+	c.len--
+	delete(q.dids, r.DID)
+	return r
+}
+
+func (q *fairQueue) top() *pdsRoundRobin {
+	var best *pdsRoundRobin
+	bestPriority := repo.FetchPriority(0)
+	for p, c := range q.classes {
+		if c.len == 0 {
+			continue
+		}
+		if best == nil || p > bestPriority {
+			best = c
+			bestPriority = p
+		}
+	}
+	return best
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/uabluerail/indexer/repo"
+)
+
+func TestFairQueue(t *testing.T) {
+	type testCase struct {
+		name  string
+		input []repo.Repo
+		want  []string
+	}
+
+	testCases := []testCase{
+		{
+			name: "round robin across PDSs",
+			input: []repo.Repo{
+				{DID: "a1", PDS: 1},
+				{DID: "a2", PDS: 1},
+				{DID: "a3", PDS: 1},
+				{DID: "b1", PDS: 2},
+				{DID: "c1", PDS: 3},
+				{DID: "c2", PDS: 3},
+			},
+			want: []string{"a1", "b1", "c1", "a2", "c2", "a3"},
+		},
+		{
+			name: "higher priority first",
+			input: []repo.Repo{
+				{DID: "a1", PDS: 1},
+				{DID: "a2", PDS: 1, FetchPriority: repo.PriorityCursorReset},
+				{DID: "b1", PDS: 2, FetchPriority: repo.PriorityManual},
+				{DID: "b2", PDS: 2, FetchPriority: repo.PriorityTooBig},
+				{DID: "c1", PDS: 3, FetchPriority: repo.PriorityNeverIndexed},
+			},
+			want: []string{"b1", "b2", "a2", "c1", "a1"},
+		},
+		{
+			name: "duplicates are ignored",
+			input: []repo.Repo{
+				{DID: "a1", PDS: 1},
+				{DID: "a1", PDS: 1, FetchPriority: repo.PriorityManual},
+				{DID: "b1", PDS: 2},
+			},
+			want: []string{"a1", "b1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newFairQueue()
+			for i := range tc.input {
+				q.Push(&tc.input[i])
+			}
+			got := []string{}
+			for r := q.Pop(); r != nil; r = q.Pop() {
+				got = append(got, r.DID)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+			if q.Len() != 0 {
+				t.Errorf("queue is not empty after popping everything: %d", q.Len())
+			}
+		})
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	input := []repo.Repo{
+		{DID: "a1", PDS: 1},
+		{DID: "a2", PDS: 1},
+		{DID: "b1", PDS: 2},
+		{DID: "c1", PDS: 3},
+	}
+	q := newFairQueue()
+	for i := range input {
+		q.Push(&input[i])
+	}
+	q.Remove("a1")
+	q.Remove("b1")
+	q.Remove("unknown")
+
+	want := []string{"a2", "c1"}
+	got := []string{}
+	for r := q.Pop(); r != nil; r = q.Pop() {
+		got = append(got, r.DID)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("queue is not empty after popping everything: %d", q.Len())
+	}
+}
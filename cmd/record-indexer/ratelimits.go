@@ -3,8 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/imax9000/errors"
 	"github.com/rs/zerolog"
 	"github.com/uabluerail/indexer/pds"
 	"golang.org/x/time/rate"
@@ -13,10 +19,65 @@ import (
 
 const defaultRateLimit = 10
 
+const (
+	// Rate never goes below this, no matter how many errors we get.
+	minRateLimit = 0.5
+	// Added to the rate after every successful request.
+	additiveIncrease = 0.1
+	// Rate is multiplied by this on server errors and timeouts.
+	multiplicativeDecrease = 0.5
+	// Longest time a worker waits on the limiter before giving up
+	// the work item to be retried later.
+	maxWaitInWorker = 2 * time.Second
+)
+
+// Limiter controls the rate of requests to each PDS. The rate starts at the
+// configured crawl limit, which acts as a ceiling. It is lowered to the
+// policy published by the PDS in RateLimit-* response headers, and adjusted
+// with AIMD: slowly increased after successful requests, and halved on
+// server errors and timeouts.
 type Limiter struct {
 	mu      sync.RWMutex
 	db      *gorm.DB
-	limiter map[string]*rate.Limiter
+	limiter map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	limiter *rate.Limiter
+
+	mu sync.Mutex
+	// Configured crawl limit.
+	ceiling rate.Limit
+	// Rate derived from the RateLimit-Policy header, or rate.Inf if unknown.
+	policy rate.Limit
+	// Current rate, adjusted by AIMD.
+	current rate.Limit
+	// No requests should be made before this time.
+	pausedUntil time.Time
+}
+
+func newHostLimiter(ceiling rate.Limit) *hostLimiter {
+	return &hostLimiter{
+		limiter: rate.NewLimiter(ceiling, burstFor(ceiling)),
+		ceiling: ceiling,
+		policy:  rate.Inf,
+		current: ceiling,
+	}
+}
+
+func burstFor(limit rate.Limit) int {
+	return max(1, int(2*limit))
+}
+
+// apply must be called with h.mu held.
+func (h *hostLimiter) apply(name string) {
+	upper := min(h.ceiling, h.policy)
+	h.current = max(min(h.current, upper), min(minRateLimit, upper))
+	if h.limiter.Limit() != h.current {
+		h.limiter.SetLimit(h.current)
+		h.limiter.SetBurst(burstFor(h.current))
+	}
+	rateLimitGauge.WithLabelValues(name).Set(float64(h.current))
 }
 
 func NewLimiter(db *gorm.DB) (*Limiter, error) {
@@ -28,7 +89,7 @@ func NewLimiter(db *gorm.DB) (*Limiter, error) {
 
 	l := &Limiter{
 		db:      db,
-		limiter: map[string]*rate.Limiter{},
+		limiter: map[string]*hostLimiter{},
 	}
 
 	for _, remote := range remotes {
@@ -36,12 +97,12 @@ func NewLimiter(db *gorm.DB) (*Limiter, error) {
 		if limit == 0 {
 			limit = defaultRateLimit
 		}
-		l.limiter[remote.Host] = rate.NewLimiter(rate.Limit(limit), limit*2)
+		l.limiter[remote.Host] = newHostLimiter(rate.Limit(limit))
 	}
 	return l, nil
 }
 
-func (l *Limiter) getLimiter(name string) *rate.Limiter {
+func (l *Limiter) getLimiter(name string) *hostLimiter {
 	l.mu.RLock()
 	limiter := l.limiter[name]
 	l.mu.RUnlock()
@@ -50,33 +111,232 @@ func (l *Limiter) getLimiter(name string) *rate.Limiter {
 		return limiter
 	}
 
-	limiter = rate.NewLimiter(defaultRateLimit, defaultRateLimit*2)
 	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limiter := l.limiter[name]; limiter != nil {
+		return limiter
+	}
+	limiter = newHostLimiter(defaultRateLimit)
 	l.limiter[name] = limiter
-	l.mu.Unlock()
 	return limiter
 }
 
-func (l *Limiter) Wait(ctx context.Context, name string) error {
-	return l.getLimiter(name).Wait(ctx)
+// throttledError is returned when a request to the PDS can't be made
+// right now, and the work item should be put aside until the given time.
+type throttledError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("requests to %q are throttled until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// Acquire waits for a permission to make a request to the PDS. If that
+// would take longer than maxWaitInWorker, it returns *throttledError instead.
+func (l *Limiter) Acquire(ctx context.Context, name string) error {
+	h := l.getLimiter(name)
+
+	h.mu.Lock()
+	pausedUntil := h.pausedUntil
+	h.mu.Unlock()
+	if time.Now().Before(pausedUntil) {
+		return &throttledError{Host: name, Until: pausedUntil}
+	}
+
+	r := h.limiter.Reserve()
+	if !r.OK() {
+		return fmt.Errorf("rate limiter for %q does not allow any requests", name)
+	}
+	delay := r.Delay()
+	if delay > maxWaitInWorker {
+		r.Cancel()
+		return &throttledError{Host: name, Until: time.Now().Add(delay)}
+	}
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Pause stops all requests to the PDS until the given time.
+func (l *Limiter) Pause(ctx context.Context, name string, until time.Time) {
+	h := l.getLimiter(name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if until.After(h.pausedUntil) {
+		h.pausedUntil = until
+		zerolog.Ctx(ctx).Debug().Str("pds", name).Msgf("Pausing requests until %s", until)
+	}
+}
+
+// rateLimitHeaders contains values of RateLimit-* response headers.
+type rateLimitHeaders struct {
+	// Requests allowed per window, as published in RateLimit-Policy
+	// or RateLimit-Limit.
+	Limit int
+	// Window in seconds.
+	Window    int
+	Remaining int
+	Reset     time.Time
+}
+
+// parseRateLimitHeaders extracts rate limit information from response
+// headers. Returns nil if there is none.
+func parseRateLimitHeaders(header http.Header) *rateLimitHeaders {
+	limit, err := strconv.Atoi(header.Get("RateLimit-Limit"))
+	if err != nil {
+		return nil
+	}
+	r := &rateLimitHeaders{Limit: limit, Remaining: -1}
+
+	// Policy has the form of "3000;w=300", possibly with several
+	// comma-separated entries. Use the first one.
+	policy, _, _ := strings.Cut(header.Get("RateLimit-Policy"), ",")
+	parts := strings.Split(policy, ";")
+	if n, err := strconv.Atoi(strings.TrimSpace(parts[0])); err == nil {
+		r.Limit = n
+	}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k != "w" {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			r.Window = n
+		}
+	}
+
+	if n, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err == nil {
+		r.Remaining = n
+	}
+	// atproto implementations send a unix timestamp here, same as
+	// what indigo's xrpc client expects.
+	if n, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		r.Reset = time.Unix(n, 0)
+	}
+	return r
+}
+
+// Observe updates the state of the limiter based on the result of
+// a request to the PDS.
+func (l *Limiter) Observe(ctx context.Context, name string, resp *http.Response, err error) {
+	h := l.getLimiter(name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		if netErr, ok := errors.As[net.Error](err); ok && netErr.Timeout() {
+			h.current *= multiplicativeDecrease
+			rateLimitDecreases.WithLabelValues(name).Inc()
+			h.apply(name)
+		}
+		return
+	}
+
+	if headers := parseRateLimitHeaders(resp.Header); headers != nil {
+		if headers.Window > 0 {
+			policy := rate.Limit(float64(headers.Limit) / float64(headers.Window))
+			if policy != h.policy {
+				zerolog.Ctx(ctx).Debug().Str("pds", name).Msgf("Learned rate limit policy: %d requests per %d seconds", headers.Limit, headers.Window)
+			}
+			h.policy = policy
+		}
+		if (headers.Remaining == 0 || resp.StatusCode == http.StatusTooManyRequests) && headers.Reset.After(h.pausedUntil) {
+			h.pausedUntil = headers.Reset
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		h.current *= multiplicativeDecrease
+		rateLimitDecreases.WithLabelValues(name).Inc()
+	case resp.StatusCode < 400:
+		h.current = min(h.current+additiveIncrease, h.ceiling, h.policy)
+	}
+	h.apply(name)
+}
+
+// Transport returns an http.RoundTripper that reports results of all
+// requests made through it to the limiter.
+func (l *Limiter) Transport(ctx context.Context, name string, base http.RoundTripper) http.RoundTripper {
+	return &limiterTransport{ctx: ctx, base: base, limiter: l, name: name}
+}
+
+type limiterTransport struct {
+	ctx     context.Context
+	base    http.RoundTripper
+	limiter *Limiter
+	name    string
+}
+
+func (t *limiterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	t.limiter.Observe(t.ctx, t.name, resp, err)
+	return resp, err
 }
 
 func (l *Limiter) SetLimit(ctx context.Context, name string, limit rate.Limit) {
-	l.getLimiter(name).SetLimit(limit)
+	name = pds.NormalizeHost(name)
+	l.setCeiling(name, limit)
 	err := l.db.Model(&pds.PDS{}).Where(&pds.PDS{Host: name}).Updates(&pds.PDS{CrawlLimit: int(limit)}).Error
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to persist rate limit change for %q: %s", name, err)
 	}
 }
 
+// setCeiling changes the configured crawl limit. The current rate is reset
+// to it, subject to the policy published by the PDS.
+func (l *Limiter) setCeiling(name string, limit rate.Limit) {
+	h := l.getLimiter(name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ceiling = limit
+	h.current = limit
+	h.apply(name)
+}
+
+// Reload re-reads the crawl limit of the PDS from the database.
+func (l *Limiter) Reload(ctx context.Context, name string) error {
+	remote := pds.PDS{}
+	if err := l.db.WithContext(ctx).Model(&remote).Where(&pds.PDS{Host: name}).Take(&remote).Error; err != nil {
+		return fmt.Errorf("querying PDS %q: %w", name, err)
+	}
+	limit := remote.CrawlLimit
+	if limit == 0 {
+		limit = defaultRateLimit
+	}
+	h := l.getLimiter(remote.Host)
+	h.mu.Lock()
+	changed := h.ceiling != rate.Limit(limit)
+	h.mu.Unlock()
+	if changed {
+		l.setCeiling(remote.Host, rate.Limit(limit))
+		zerolog.Ctx(ctx).Info().Msgf("Crawl limit for %q set to %d", remote.Host, limit)
+	}
+	return nil
+}
+
 func (l *Limiter) SetAllLimits(ctx context.Context, limit rate.Limit) {
 	l.mu.RLock()
-	for name, limiter := range l.limiter {
-		limiter.SetLimit(limit)
+	names := make([]string, 0, len(l.limiter))
+	for name := range l.limiter {
+		names = append(names, name)
+	}
+	l.mu.RUnlock()
+
+	for _, name := range names {
+		l.setCeiling(name, limit)
 		err := l.db.Model(&pds.PDS{}).Where(&pds.PDS{Host: name}).Updates(&pds.PDS{CrawlLimit: int(limit)}).Error
 		if err != nil {
 			zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to persist rate limit change for %q: %s", name, err)
 		}
 	}
-	l.mu.RUnlock()
 }
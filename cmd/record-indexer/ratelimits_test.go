@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	type testCase struct {
+		headers map[string]string
+		want    *rateLimitHeaders
+	}
+
+	cases := []testCase{
+		{map[string]string{}, nil},
+		{map[string]string{"RateLimit-Limit": "3000"}, &rateLimitHeaders{Limit: 3000, Remaining: -1}},
+		{map[string]string{
+			"RateLimit-Limit":     "3000",
+			"RateLimit-Remaining": "0",
+			"RateLimit-Reset":     "1700000000",
+			"RateLimit-Policy":    "3000;w=300",
+		}, &rateLimitHeaders{Limit: 3000, Window: 300, Remaining: 0, Reset: time.Unix(1700000000, 0)}},
+		{map[string]string{
+			"RateLimit-Limit":  "100",
+			"RateLimit-Policy": "100;w=60, 1000;w=3600",
+		}, &rateLimitHeaders{Limit: 100, Window: 60, Remaining: -1}},
+	}
+
+	for _, tc := range cases {
+		header := http.Header{}
+		for k, v := range tc.headers {
+			header.Set(k, v)
+		}
+		got := parseRateLimitHeaders(header)
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("parseRateLimitHeaders(%v) = %+v, want %+v", tc.headers, got, tc.want)
+		}
+	}
+}
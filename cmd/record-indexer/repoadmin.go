@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/scylladb/gocqlx/qb"
+	"github.com/scylladb/gocqlx/v3"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/backlinks"
+	"github.com/uabluerail/indexer/graph"
+	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
+)
+
+// repoAdmin implements admin endpoints for operating on individual repos.
+type repoAdmin struct {
+	db        *gorm.DB
+	recordsDB *gocqlx.Session
+	router    *routing.Router
+	scheduler *Scheduler
+}
+
+type repoState struct {
+	Repo *repo.Repo `json:"repo"`
+	// Status in this instance's queue.
+	QueueStatus string `json:"queueStatus,omitempty"`
+	// Number of non-deleted records per collection. With ScyllaDB only
+	// the collections passed in the request are counted, plus the ones
+	// stored in separate Postgres tables.
+	Collections map[string]int64 `json:"collections"`
+}
+
+// tables returns the Postgres tables that can contain records: the default
+// one unless ScyllaDB is used, and the ones collections are routed to.
+func (a *repoAdmin) tables() []string {
+	tables := a.router.Tables()
+	if a.recordsDB == nil {
+		tables = append([]string{routing.DefaultTable}, tables...)
+	}
+	return tables
+}
+
+func (a *repoAdmin) getRepo(w http.ResponseWriter, r *http.Request) *repo.Repo {
+	did := r.FormValue("did")
+	if did == "" {
+		http.Error(w, "need did", http.StatusBadRequest)
+		return nil
+	}
+	row := &repo.Repo{}
+	err := a.db.WithContext(r.Context()).Model(row).Where(&repo.Repo{DID: did}).Take(row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "repo not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return row
+}
+
+func (a *repoAdmin) handleShow(w http.ResponseWriter, r *http.Request) {
+	row := a.getRepo(w, r)
+	if row == nil {
+		return
+	}
+
+	resp := repoState{
+		Repo:        row,
+		QueueStatus: a.scheduler.Status(row.DID),
+		Collections: map[string]int64{},
+	}
+
+	if a.recordsDB != nil {
+		for _, collection := range r.Form["collection"] {
+			// The table has a row per each version of a record, including
+			// deletions, so only the newest version of each rkey counts.
+			// Versions are ordered by at_rev descending, and grouping
+			// returns the first row of each group.
+			iter := a.recordsDB.Query(
+				qb.Select("bluesky.records").Columns("deleted").
+					Where(qb.Eq("repo"), qb.Eq("collection")).GroupBy("rkey").ToCql()).
+				WithContext(r.Context()).Bind(row.DID, collection).Iter()
+			var count int64
+			var deleted bool
+			for iter.Scan(&deleted) {
+				if !deleted {
+					count++
+				}
+				deleted = false
+			}
+			if err := iter.Close(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Collections[collection] = count
+		}
+	}
+	for _, table := range a.tables() {
+		counts := []struct {
+			Collection string
+			Count      int64
+		}{}
+		err := a.db.WithContext(r.Context()).Model(&repo.Record{}).Table(table).
+			Select("collection, count(*) as count").
+			Where("repo = ? and not coalesce(deleted, false)", row.ID).
+			Group("collection").Scan(&counts).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, c := range counts {
+			resp.Collections[c.Collection] += c.Count
+		}
+	}
+
+	writeJSON(w, resp)
+}
+
+// handleReindex schedules a fetch of the repo ahead of everything else.
+// With full=true all records are fetched, otherwise only the ones
+// changed since the last indexed rev.
+func (a *repoAdmin) handleReindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	row := a.getRepo(w, r)
+	if row == nil {
+		return
+	}
+	full := r.FormValue("full") == "true"
+
+	updates := map[string]interface{}{
+		"fetch_priority":   int(repo.PriorityManual),
+		"failed_attempts":  0,
+		"terminal":         false,
+		"last_error_class": "",
+	}
+	if full {
+		updates["last_indexed_rev"] = ""
+	}
+	err := a.db.WithContext(r.Context()).Model(&repo.Repo{}).Where(&repo.Repo{ID: row.ID}).Updates(updates).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.scheduler.Prioritize(r.Context(), row.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.db, "repo.reindex", row.DID, fmt.Sprintf("full=%t", full))
+	fmt.Fprintln(w, "OK")
+}
+
+func (a *repoAdmin) handleResetFailures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	row := a.getRepo(w, r)
+	if row == nil {
+		return
+	}
+
+	err := a.db.WithContext(r.Context()).Model(&repo.Repo{}).Where(&repo.Repo{ID: row.ID}).
+		Updates(map[string]interface{}{
+			"failed_attempts":  0,
+			"terminal":         false,
+			"last_error":       "",
+			"last_error_class": "",
+		}).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.db, "repo.resetFailures", row.DID, fmt.Sprintf("failed_attempts was %d", row.FailedAttempts))
+	fmt.Fprintln(w, "OK")
+}
+
+// handlePurge deletes stored records of the repo and data derived from them,
+// either all of them or only from the given collections, and resets its
+// indexing state so that it gets fetched again from scratch. With ScyllaDB
+// the collections to purge need to be listed explicitly.
+func (a *repoAdmin) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	row := a.getRepo(w, r)
+	if row == nil {
+		return
+	}
+	ctx := r.Context()
+
+	var deleted int64
+	if a.recordsDB != nil {
+		collections := r.Form["collection"]
+		if len(collections) == 0 {
+			http.Error(w, "need at least one collection", http.StatusBadRequest)
+			return
+		}
+		query := a.recordsDB.Query(qb.Delete("bluesky.records").
+			Where(qb.Eq("repo"), qb.Eq("collection")).ToCql()).WithContext(ctx)
+		defer query.Release()
+		for _, collection := range collections {
+			if err := query.Bind(row.DID, collection).Exec(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	for _, table := range a.tables() {
+		q := a.db.WithContext(ctx).Table(table).Where("repo = ?", row.ID)
+		if collections := r.Form["collection"]; len(collections) > 0 {
+			q = q.Where("collection in ?", collections)
+		}
+		result := q.Delete(&repo.Record{})
+		if result.Error != nil {
+			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleted += result.RowsAffected
+	}
+	if err := graph.Purge(ctx, a.db, row.DID, r.Form["collection"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := backlinks.Purge(ctx, a.db, row.ID, r.Form["collection"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err := a.db.WithContext(ctx).Model(&repo.Repo{}).Where(&repo.Repo{ID: row.ID}).
+		Updates(map[string]interface{}{
+			"last_indexed_rev":      "",
+			"first_rev_since_reset": "",
+		}).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, a.db, "repo.purge", row.DID, fmt.Sprintf("deleted %d records, collections: %v", deleted, r.Form["collection"]))
+	fmt.Fprintf(w, "OK, deleted %d records\n", deleted)
+}
+
+type fetchInfo struct {
+	DID     string  `json:"did"`
+	PDS     string  `json:"pds"`
+	Started string  `json:"started"`
+	Elapsed float64 `json:"elapsedSeconds"`
+	Bytes   int64   `json:"bytes"`
+}
+
+func handleFetches(pool *WorkerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := []fetchInfo{}
+		for _, f := range pool.InProgress() {
+			resp = append(resp, fetchInfo{
+				DID:     f.DID,
+				PDS:     f.PDS,
+				Started: f.Started.Format(time.RFC3339),
+				Elapsed: time.Since(f.Started).Seconds(),
+				Bytes:   f.Bytes(),
+			})
+		}
+		sort.Slice(resp, func(i, j int) bool { return resp[i].Elapsed > resp[j].Elapsed })
+		writeJSON(w, resp)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
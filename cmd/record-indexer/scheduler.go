@@ -12,52 +12,145 @@ import (
 	"gorm.io/gorm"
 )
 
+// How long a claimed repo stays reserved for this instance without
+// the lease being extended.
+const leaseDuration = 10 * time.Minute
+
 type Scheduler struct {
 	db     *gorm.DB
 	output chan<- WorkItem
+	// Identifies this instance in repos.lease_owner.
+	owner string
+
+	// Held while fillQueue is running, so that it never claims the same
+	// rows twice.
+	fillMu sync.Mutex
 
 	mu         sync.Mutex
-	queue      map[string]*repo.Repo
+	queue      *fairQueue
 	inProgress map[string]*repo.Repo
+	// Repos that were handed back by workers because their PDS is
+	// throttled. They are put back into the queue once the time comes.
+	parked map[string]parkedRepo
 }
 
-func NewScheduler(output chan<- WorkItem, db *gorm.DB) *Scheduler {
+type parkedRepo struct {
+	repo  *repo.Repo
+	until time.Time
+}
+
+func NewScheduler(output chan<- WorkItem, db *gorm.DB, owner string) *Scheduler {
 	return &Scheduler{
 		db:         db,
 		output:     output,
-		queue:      map[string]*repo.Repo{},
+		owner:      owner,
+		queue:      newFairQueue(),
 		inProgress: map[string]*repo.Repo{},
+		parked:     map[string]parkedRepo{},
 	}
 }
 
 func (s *Scheduler) Start(ctx context.Context) error {
+	// Leases left over from a previous run that didn't shut down cleanly
+	// are not backed by anything in memory, so drop them before claiming
+	// new ones.
+	if err := s.releaseLeases(ctx); err != nil {
+		return fmt.Errorf("releasing leases from a previous run: %w", err)
+	}
 	go s.run(ctx)
+	go s.heartbeat(ctx)
 	return nil
 }
 
+// heartbeat periodically extends leases on repos held by this instance,
+// and releases them on shutdown.
+func (s *Scheduler) heartbeat(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	t := time.NewTicker(leaseDuration / 5)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := s.releaseLeases(releaseCtx)
+			cancel()
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to release leases: %s", err)
+			}
+			return
+		case <-t.C:
+			held, err := s.extendLeases(ctx)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to extend leases: %s", err)
+				continue
+			}
+			leasesHeld.Set(float64(held))
+		}
+	}
+}
+
+// releaseLeases releases all leases owned by this instance.
+func (s *Scheduler) releaseLeases(ctx context.Context) error {
+	return s.db.WithContext(ctx).Model(&repo.Repo{}).
+		Where("lease_owner = ?", s.owner).
+		Updates(map[string]interface{}{"lease_owner": "", "lease_expires_at": nil}).Error
+}
+
+// extendLeases extends leases on the repos that are queued, in progress
+// or parked, and returns the number of leases extended.
+func (s *Scheduler) extendLeases(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	dids := make([]string, 0, s.queue.Len()+len(s.inProgress)+len(s.parked))
+	for did := range s.queue.dids {
+		dids = append(dids, did)
+	}
+	for did := range s.inProgress {
+		dids = append(dids, did)
+	}
+	for did := range s.parked {
+		dids = append(dids, did)
+	}
+	s.mu.Unlock()
+
+	var held int64
+	expires := time.Now().Add(leaseDuration)
+	for _, batch := range splitInBatshes(dids, 10000) {
+		result := s.db.WithContext(ctx).Model(&repo.Repo{}).
+			Where("lease_owner = ? AND did IN ?", s.owner, batch).
+			Update("lease_expires_at", expires)
+		if result.Error != nil {
+			return held, result.Error
+		}
+		held += result.RowsAffected
+	}
+	return held, nil
+}
+
 func (s *Scheduler) run(ctx context.Context) {
 	log := zerolog.Ctx(ctx)
 	t := time.NewTicker(time.Minute)
 	defer t.Stop()
+	unparkTicker := time.NewTicker(time.Second)
+	defer unparkTicker.Stop()
 
 	if err := s.fillQueue(ctx); err != nil {
 		log.Error().Err(err).Msgf("Failed to get more tasks for the queue: %s", err)
 	}
 
-	done := make(chan string)
+	done := make(chan WorkItem)
+	var next *WorkItem
 	for {
-		s.mu.Lock()
-		q := len(s.queue)
-		s.mu.Unlock()
-		if q > 0 {
-			next := WorkItem{signal: make(chan struct{})}
+		if next == nil {
 			s.mu.Lock()
-			for _, r := range s.queue {
-				next.Repo = r
-				break
+			if r := s.queue.Pop(); r != nil {
+				next = &WorkItem{Repo: r, signal: make(chan struct{}), parkUntil: &time.Time{}}
+				s.inProgress[r.DID] = r
 			}
 			s.mu.Unlock()
+		}
 
+		if next != nil {
 			select {
 			case <-ctx.Done():
 				return
@@ -67,25 +160,20 @@ func (s *Scheduler) run(ctx context.Context) {
 						log.Error().Err(err).Msgf("Failed to get more tasks for the queue: %s", err)
 					}
 				}()
-			case s.output <- next:
-				s.mu.Lock()
-				delete(s.queue, next.Repo.DID)
-				s.inProgress[next.Repo.DID] = next.Repo
-				s.mu.Unlock()
-
-				go func(did string, ch chan struct{}) {
+			case s.output <- *next:
+				go func(item WorkItem) {
 					select {
-					case <-ch:
+					case <-item.signal:
+						done <- item
 					case <-ctx.Done():
 					}
-					done <- did
-				}(next.Repo.DID, next.signal)
-				s.updateQueueLenMetrics()
-			case did := <-done:
-				s.mu.Lock()
-				delete(s.inProgress, did)
-				s.mu.Unlock()
+				}(*next)
+				next = nil
 				s.updateQueueLenMetrics()
+			case item := <-done:
+				s.finish(item)
+			case <-unparkTicker.C:
+				s.unpark()
 			}
 		} else {
 			select {
@@ -95,24 +183,79 @@ func (s *Scheduler) run(ctx context.Context) {
 				if err := s.fillQueue(ctx); err != nil {
 					log.Error().Err(err).Msgf("Failed to get more tasks for the queue: %s", err)
 				}
-			case did := <-done:
-				s.mu.Lock()
-				delete(s.inProgress, did)
-				s.mu.Unlock()
-				s.updateQueueLenMetrics()
+			case item := <-done:
+				s.finish(item)
+			case <-unparkTicker.C:
+				s.unpark()
 			}
 		}
 	}
 }
 
+// finish is called after a worker is done with the repo.
+func (s *Scheduler) finish(item WorkItem) {
+	s.mu.Lock()
+	delete(s.inProgress, item.Repo.DID)
+	if !item.parkUntil.IsZero() {
+		s.parked[item.Repo.DID] = parkedRepo{repo: item.Repo, until: *item.parkUntil}
+	}
+	s.mu.Unlock()
+	s.updateQueueLenMetrics()
+}
+
+// unpark moves parked repos that are due back into the queue.
+func (s *Scheduler) unpark() {
+	now := time.Now()
+	s.mu.Lock()
+	changed := false
+	for did, p := range s.parked {
+		if p.until.After(now) {
+			continue
+		}
+		delete(s.parked, did)
+		s.queue.Push(p.repo)
+		changed = true
+	}
+	s.mu.Unlock()
+	if changed {
+		s.updateQueueLenMetrics()
+	}
+}
+
+// needsFetchCondition selects repos that have data missing.
+const needsFetchCondition = `(
+	(last_indexed_rev is null OR last_indexed_rev = '')
+	OR
+	(first_rev_since_reset is not null AND first_rev_since_reset <> ''
+		AND last_indexed_rev < first_rev_since_reset)
+	OR
+	(repos.first_cursor_since_reset is not null AND repos.first_cursor_since_reset <> 0
+		AND repos.first_cursor_since_reset < pds.first_cursor_since_reset)
+	OR
+	fetch_priority >= ?
+)`
+
 func (s *Scheduler) fillQueue(ctx context.Context) error {
-	const maxQueueLen = 300000
-	const lowWatermark = 30000
-	const maxAttempts = 3
+	// Claimed repos are not available to other instances, so don't grab
+	// more than we can process within a reasonable time.
+	const maxQueueLen = 50000
+	const lowWatermark = 10000
 	log := zerolog.Ctx(ctx)
 
+	if !s.fillMu.TryLock() {
+		// Another call is still in progress, and will fill the queue anyway.
+		return nil
+	}
+	defer s.fillMu.Unlock()
+
+	// Manual requests are picked up right away, regardless of how much
+	// is already in the queue.
+	if err := s.claim(ctx, "true", nil, repo.PriorityManual, 1000); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
-	queueLen := len(s.queue) + len(s.inProgress)
+	queueLen := s.queue.Len() + len(s.inProgress) + len(s.parked)
 	s.mu.Unlock()
 	if queueLen >= lowWatermark {
 		return nil
@@ -121,18 +264,12 @@ func (s *Scheduler) fillQueue(ctx context.Context) error {
 	counts := []pdsCounts{}
 	err := s.db.Raw(`select * from (
 	  SELECT pds, count(*) FROM "repos" left join "pds" on repos.pds = pds.id WHERE
-	    (
-	      (last_indexed_rev is null OR last_indexed_rev = '') OR
-	      (first_rev_since_reset is not null AND first_rev_since_reset <> ''
-	        AND last_indexed_rev < first_rev_since_reset)
-	      OR
-	      ("repos".first_cursor_since_reset is not null AND "repos".first_cursor_since_reset <> 0
-	        AND "repos".first_cursor_since_reset < "pds".first_cursor_since_reset)
-	    )
-	  AND failed_attempts < 3
+	    `+needsFetchCondition+`
+	  AND `+retryCondition+`
 	  AND (not pds.disabled OR pds.disabled is null)
+	  AND (lease_expires_at is null OR lease_expires_at < now())
 	  GROUP BY pds
-	) order by count desc`).Scan(&counts).Error
+	) order by count desc`, append([]interface{}{int(repo.PriorityManual)}, retryConditionArgs()...)...).Scan(&counts).Error
 	if err != nil {
 		return fmt.Errorf("querying DB: %w", err)
 	}
@@ -146,52 +283,130 @@ func (s *Scheduler) fillQueue(ctx context.Context) error {
 	}
 
 	for _, batch := range batches {
-		repos := []repo.Repo{}
-
 		ids := []models.ID{}
 		for _, c := range batch {
 			ids = append(ids, c.PDS)
 		}
+		if err := s.claim(ctx, "pds IN ?", []interface{}{ids}, repo.PriorityDefault, perBatchLimit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// claim leases up to limit repos that need fetching and match the filter,
+// and adds them to the queue, highest priority first.
+//
+// Repos with a raised priority are also taken from the ones already leased
+// by this instance, so that they move ahead in the queue.
+func (s *Scheduler) claim(ctx context.Context, filter string, filterArgs []interface{}, minPriority repo.FetchPriority, limit int) error {
+	args := []interface{}{s.owner, time.Now().Add(leaseDuration), int(repo.PriorityManual)}
+	args = append(args, filterArgs...)
+	priorityFilter := "true"
+	ownLeases := "false"
+	if minPriority > repo.PriorityDefault {
+		// Spelled out, so that the partial index on fetch_priority can be
+		// used with any value of the parameter.
+		priorityFilter = "fetch_priority > 0"
+		ownLeases = "lease_owner = ?"
+	}
+	args = append(args, int(minPriority))
+	args = append(args, retryConditionArgs()...)
+	if minPriority > repo.PriorityDefault {
+		args = append(args, s.owner)
+	}
+	args = append(args, limit)
 
-		err := s.db.Raw(`SELECT repos.* FROM repos left join pds on repos.pds = pds.id WHERE pds IN ?
-			AND
-				(
-					(last_indexed_rev is null OR last_indexed_rev = '')
-					OR
-					(first_rev_since_reset is not null AND first_rev_since_reset <> ''
-						AND last_indexed_rev < first_rev_since_reset)
-					OR
-					(repos.first_cursor_since_reset is not null AND repos.first_cursor_since_reset <> 0
-						AND repos.first_cursor_since_reset < pds.first_cursor_since_reset)
-				)
-			AND failed_attempts < ? LIMIT ?`,
-			ids, maxAttempts, perBatchLimit).
-			Scan(&repos).Error
-
-		if err != nil {
-			return fmt.Errorf("querying DB: %w", err)
+	// Skip any repos that are being claimed concurrently by another instance.
+	repos := []repo.Repo{}
+	err := s.db.WithContext(ctx).Raw(`UPDATE repos SET lease_owner = ?, lease_expires_at = ?
+		WHERE id IN (
+			SELECT repos.id FROM repos left join pds on repos.pds = pds.id
+			WHERE `+needsFetchCondition+`
+			AND `+filter+`
+			AND `+priorityFilter+`
+			AND fetch_priority >= ?
+			AND `+retryCondition+`
+			AND (not pds.disabled OR pds.disabled is null)
+			AND (lease_expires_at is null OR lease_expires_at < now() OR `+ownLeases+`)
+			ORDER BY fetch_priority DESC, coalesce(last_indexed_rev, '') = '' DESC
+			LIMIT ?
+			FOR UPDATE OF repos SKIP LOCKED)
+		RETURNING *`, args...).
+		Scan(&repos).Error
+	if err != nil {
+		return fmt.Errorf("querying DB: %w", err)
+	}
+
+	s.mu.Lock()
+	for _, r := range repos {
+		copied := r
+		if copied.FetchPriority == repo.PriorityDefault && copied.LastIndexedRev == "" {
+			copied.FetchPriority = repo.PriorityNeverIndexed
 		}
-		s.mu.Lock()
-		for _, r := range repos {
-			if s.queue[r.DID] != nil || s.inProgress[r.DID] != nil {
+		if queued := s.queue.Get(r.DID); queued != nil {
+			if queued.FetchPriority >= copied.FetchPriority {
 				continue
 			}
-			copied := r
-			s.queue[r.DID] = &copied
-			reposQueued.Inc()
+			// Priority was raised after the repo was queued.
+			s.queue.Remove(r.DID)
+			s.queue.Push(&copied)
+			continue
 		}
-		s.mu.Unlock()
-		s.updateQueueLenMetrics()
+		if s.inProgress[r.DID] != nil || s.parked[r.DID].repo != nil {
+			continue
+		}
+		s.queue.Push(&copied)
+		reposQueued.Inc()
 	}
-
+	s.mu.Unlock()
+	s.updateQueueLenMetrics()
 	return nil
 }
 
+// Prioritize puts the repo at the front of this instance's queue, unless
+// it's being fetched already or another instance holds a lease on it. Its
+// fetch_priority must already be raised in the database.
+func (s *Scheduler) Prioritize(ctx context.Context, id models.ID) error {
+	return s.claim(ctx, "repos.id = ?", []interface{}{id}, repo.PriorityManual, 1)
+}
+
+// Status returns "queued", "inProgress" or "parked" if this instance has
+// the repo in its queue, or an empty string otherwise.
+func (s *Scheduler) Status(did string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.queue.Contains(did):
+		return "queued"
+	case s.inProgress[did] != nil:
+		return "inProgress"
+	case s.parked[did].repo != nil:
+		return "parked"
+	default:
+		return ""
+	}
+}
+
 func (s *Scheduler) updateQueueLenMetrics() {
 	s.mu.Lock()
-	queueLength.WithLabelValues("queued").Set(float64(len(s.queue)))
-	queueLength.WithLabelValues("inProgress").Set(float64(len(s.inProgress)))
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+
+	queued := s.queue.LenByClass()
+	inProgress := map[repo.FetchPriority]int{}
+	for _, r := range s.inProgress {
+		inProgress[r.FetchPriority]++
+	}
+	parked := map[repo.FetchPriority]int{}
+	for _, p := range s.parked {
+		parked[p.repo.FetchPriority]++
+	}
+	for _, p := range repo.Priorities {
+		queueLength.WithLabelValues("queued", p.String()).Set(float64(queued[p]))
+		queueLength.WithLabelValues("inProgress", p.String()).Set(float64(inProgress[p]))
+		queueLength.WithLabelValues("parked", p.String()).Set(float64(parked[p]))
+	}
 }
 
 type pdsCounts struct {
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/imax9000/errors"
+	"github.com/ipfs/go-cid"
 	"github.com/rs/zerolog"
 	"github.com/scylladb/gocqlx/qb"
 	"github.com/scylladb/gocqlx/v3"
@@ -22,9 +24,14 @@ import (
 	"github.com/bluesky-social/indigo/xrpc"
 
 	"github.com/uabluerail/bsky-tools/xrpcauth"
+	"github.com/uabluerail/indexer/backlinks"
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/graph"
+	"github.com/uabluerail/indexer/lexicon"
 	"github.com/uabluerail/indexer/models"
 	"github.com/uabluerail/indexer/pds"
 	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
 	"github.com/uabluerail/indexer/util/fix"
 	"github.com/uabluerail/indexer/util/resolver"
 )
@@ -35,31 +42,39 @@ const maxLargeReposInParallel = 10
 type WorkItem struct {
 	Repo   *repo.Repo
 	signal chan struct{}
+	// Set by the worker before closing signal if the repo couldn't be
+	// fetched because its PDS is throttled, and needs to be retried
+	// after the given time.
+	parkUntil *time.Time
 }
 
 type WorkerPool struct {
-	db                  *gorm.DB
-	recordsDB           *gocqlx.Session
-	input               <-chan WorkItem
-	limiter             *Limiter
-	collectionBlacklist map[string]bool
-	contactInfo         string
+	db          *gorm.DB
+	recordsDB   *gocqlx.Session
+	input       <-chan WorkItem
+	limiter     *Limiter
+	router      *routing.Router
+	validator   *lexicon.Validator
+	contactInfo string
+	changeFeed  bool
 
 	workerSignals []chan struct{}
 	resize        chan int
 
 	largeRepoLock chan struct{}
+
+	// In-progress fetches, keyed by DID.
+	fetches sync.Map
 }
 
 func NewWorkerPool(input <-chan WorkItem, db *gorm.DB, session *gocqlx.Session, size int, limiter *Limiter, contactInfo string) *WorkerPool {
 	r := &WorkerPool{
-		db:                  db,
-		recordsDB:           session,
-		input:               input,
-		limiter:             limiter,
-		resize:              make(chan int),
-		collectionBlacklist: map[string]bool{},
-		largeRepoLock:       make(chan struct{}, maxLargeReposInParallel),
+		db:            db,
+		recordsDB:     session,
+		input:         input,
+		limiter:       limiter,
+		resize:        make(chan int),
+		largeRepoLock: make(chan struct{}, maxLargeReposInParallel),
 	}
 	r.workerSignals = make([]chan struct{}, size)
 	for i := range r.workerSignals {
@@ -68,11 +83,23 @@ func NewWorkerPool(input <-chan WorkItem, db *gorm.DB, session *gocqlx.Session,
 	return r
 }
 
-func (p *WorkerPool) BlacklistCollections(colls []string) {
-	for _, c := range colls {
-		p.collectionBlacklist[c] = true
-	}
+// SetRouter sets the rules for storing records of each collection.
+func (p *WorkerPool) SetRouter(r *routing.Router) {
+	p.router = r
+}
+
+// SetValidator sets the validator for checking records against their
+// lexicons.
+func (p *WorkerPool) SetValidator(v *lexicon.Validator) {
+	p.validator = v
+}
+
+// EnableChangeFeed makes the pool append all fetched records to the
+// change feed.
+func (p *WorkerPool) EnableChangeFeed() {
+	p.changeFeed = true
 }
+
 func (p *WorkerPool) Start(ctx context.Context) error {
 	go p.run(ctx)
 	return nil
@@ -131,31 +158,63 @@ func (p *WorkerPool) worker(ctx context.Context, signal chan struct{}) {
 		case <-signal:
 			return
 		case work := <-p.input:
+			err := p.doWork(ctx, work)
+			if throttled, ok := errors.As[*throttledError](err); ok {
+				// Not a failure, the scheduler will hand the repo out again
+				// once the PDS is available. Lease is kept.
+				log.Debug().Str("pds", throttled.Host).Msgf("Parking %q until %s", work.Repo.DID, throttled.Until)
+				reposParked.WithLabelValues(throttled.Host).Inc()
+				*work.parkUntil = throttled.Until
+				close(work.signal)
+				continue
+			}
+			close(work.signal)
+
 			updates := &repo.Repo{}
-			if err := p.doWork(ctx, work); err != nil {
-				log.Error().Err(err).Msgf("Work task %q failed: %s", work.Repo.DID, err)
+			// Also release the lease taken by the scheduler.
+			columns := []interface{}{"last_index_attempt", "failed_attempts", "last_error_class", "terminal", "lease_owner", "lease_expires_at"}
+			if err != nil {
+				class := classifyFetchError(err)
+				log.Error().Err(err).Str("class", string(class)).Msgf("Work task %q failed: %s", work.Repo.DID, err)
 				updates.LastError = err.Error()
+				updates.LastErrorClass = class
 				updates.FailedAttempts = work.Repo.FailedAttempts + 1
+				if class.IsPermanent() {
+					updates.Terminal = true
+					updates.TerminalAt = time.Now()
+					columns = append(columns, "terminal_at")
+				}
 				reposIndexed.WithLabelValues("false").Inc()
+				fetchErrors.WithLabelValues(string(class)).Inc()
 			} else {
 				updates.FailedAttempts = 0
 				reposIndexed.WithLabelValues("true").Inc()
 			}
 			updates.LastIndexAttempt = time.Now()
-			err := p.db.Model(&repo.Repo{}).
+			succeeded := err == nil
+			err = p.db.Model(&repo.Repo{}).
 				Where(&repo.Repo{ID: work.Repo.ID}).
-				Select("last_error", "last_index_attempt", "failed_attempts").
+				Select("last_error", columns...).
 				Updates(updates).Error
 			if err != nil {
 				log.Error().Err(err).Msgf("Failed to update repo info for %q: %s", work.Repo.DID, err)
 			}
+			if succeeded {
+				// If the priority was raised while the fetch was in progress,
+				// keep it, so that the repo is fetched again.
+				err = p.db.Model(&repo.Repo{}).
+					Where("id = ? and fetch_priority <= ?", work.Repo.ID, int(work.Repo.FetchPriority)).
+					Update("fetch_priority", int(repo.PriorityDefault)).Error
+				if err != nil {
+					log.Error().Err(err).Msgf("Failed to reset fetch priority for %q: %s", work.Repo.DID, err)
+				}
+			}
 		}
 	}
 }
 
 func (p *WorkerPool) doWork(ctx context.Context, work WorkItem) error {
 	log := zerolog.Ctx(ctx).With().Str("did", work.Repo.DID).Logger()
-	defer close(work.signal)
 
 	u, pubKey, err := resolver.GetPDSEndpointAndPublicKey(ctx, work.Repo.DID)
 	if err != nil {
@@ -166,6 +225,9 @@ func (p *WorkerPool) doWork(ctx context.Context, work WorkItem) error {
 	if err != nil {
 		return fmt.Errorf("failed to get PDS records for %q: %w", u, err)
 	}
+	if d := pds.CheckPolicy(ctx, remote.Host); !d.Allowed {
+		return fmt.Errorf("PDS %q is not allowed by the policy (%s)", remote.Host, d.Reason())
+	}
 	if work.Repo.PDS != remote.ID {
 		if err := p.db.Model(&work.Repo).Where(&repo.Repo{ID: work.Repo.ID}).Updates(&repo.Repo{PDS: remote.ID}).Error; err != nil {
 			return fmt.Errorf("failed to update repo's PDS to %q: %w", u, err)
@@ -177,14 +239,21 @@ func (p *WorkerPool) doWork(ctx context.Context, work WorkItem) error {
 	client.Host = u.String()
 	client.Client = util.RobustHTTPClient()
 	client.Client.Timeout = 30 * time.Minute
+
+	progress := &fetchProgress{DID: work.Repo.DID, PDS: remote.Host, Started: time.Now()}
+	client.Client.Transport = &countingTransport{base: client.Client.Transport, counter: &progress.bytes}
+	if p.limiter != nil {
+		client.Client.Transport = p.limiter.Transport(ctx, remote.Host, client.Client.Transport)
+	}
+	p.fetches.Store(work.Repo.DID, progress)
+	defer p.fetches.Delete(work.Repo.DID)
 	userAgent := fmt.Sprintf("Go-http-client/1.1 indexerbot/0.1 (based on github.com/uabluerail/indexer; %s)", p.contactInfo)
 	client.UserAgent = &userAgent
 
 	knownCursorBeforeFetch := remote.FirstCursorSinceReset
 
-retry:
 	if p.limiter != nil {
-		if err := p.limiter.Wait(ctx, u.String()); err != nil {
+		if err := p.limiter.Acquire(ctx, remote.Host); err != nil {
 			return fmt.Errorf("failed to wait on rate limiter: %w", err)
 		}
 	}
@@ -194,21 +263,27 @@ retry:
 	b, err := comatproto.SyncGetRepo(ctx, client, work.Repo.DID, sinceRev)
 	if err != nil {
 		if err, ok := errors.As[*xrpc.Error](err); ok {
-			if err.IsThrottled() && err.Ratelimit != nil {
-				log.Debug().Str("pds", u.String()).Msgf("Hit a rate limit (%s), sleeping until %s", err.Ratelimit.Policy, err.Ratelimit.Reset)
-				time.Sleep(time.Until(err.Ratelimit.Reset))
-				goto retry
+			if err.IsThrottled() {
+				until := time.Now().Add(time.Minute)
+				if err.Ratelimit != nil && err.Ratelimit.Reset.After(time.Now()) {
+					until = err.Ratelimit.Reset
+				}
+				log.Debug().Str("pds", remote.Host).Msgf("Hit a rate limit, parking until %s", until)
+				if p.limiter != nil {
+					p.limiter.Pause(ctx, remote.Host, until)
+				}
+				return &throttledError{Host: remote.Host, Until: until}
 			}
 		}
 
-		reposFetched.WithLabelValues(u.String(), "false").Inc()
+		reposFetched.WithLabelValues(remote.Host, "false").Inc()
 		return fmt.Errorf("failed to fetch repo: %w", err)
 	}
 	if len(b) == 0 {
-		reposFetched.WithLabelValues(u.String(), "false").Inc()
-		return fmt.Errorf("PDS returned zero bytes")
+		reposFetched.WithLabelValues(remote.Host, "false").Inc()
+		return fmt.Errorf("%w: PDS returned zero bytes", errBadCAR)
 	}
-	reposFetched.WithLabelValues(u.String(), "true").Inc()
+	reposFetched.WithLabelValues(remote.Host, "true").Inc()
 
 	repoFetchSize.Observe(float64(len(b)))
 
@@ -264,35 +339,62 @@ retry:
 			l = len(b)
 		}
 		log.Debug().Err(err).Msgf("Total bytes fetched: %d. First few bytes: %q", len(b), string(b[:l]))
-		return fmt.Errorf("failed to read 'rev' from the fetched repo: %w", err)
+		return fmt.Errorf("%w: failed to read 'rev' from the fetched repo: %w", errBadCAR, err)
 	}
 
-	newRecs, err := repo.ExtractRecords(ctx, bytes.NewReader(b), pubKey)
+	newRecs, cids, err := repo.ExtractRecords(ctx, bytes.NewReader(b), pubKey)
 	if err != nil {
-		return fmt.Errorf("failed to extract records: %w", err)
+		return fmt.Errorf("%w: failed to extract records: %w", errBadCAR, err)
 	}
 	recordsFetched.Add(float64(len(newRecs)))
 
-	return p.insertRecords(ctx, newRecs, work, newRev, knownCursorBeforeFetch)
+	// A partial fetch only has the records changed since sinceRev, so
+	// missing records can be detected only in a full one.
+	return p.insertRecords(ctx, newRecs, cids, work, newRev, sinceRev == "", knownCursorBeforeFetch)
 }
 
-func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.RawMessage, work WorkItem, newRev string, knownCursorBeforeFetch int64) error {
+func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.RawMessage, cids map[string]cid.Cid, work WorkItem, newRev string, full bool, knownCursorBeforeFetch int64) error {
 	log := zerolog.Ctx(ctx)
 
 	recs := []repo.Record{}
+	// Records to store, grouped by Postgres table. Records for ScyllaDB
+	// are under the empty key.
+	stored := map[string][]repo.Record{}
+	invalid := []repo.InvalidRecord{}
+	// Keys of valid records, to clear their earlier invalid versions.
+	valid := map[string]bool{}
 	for k, v := range newRecs {
 		parts := strings.SplitN(k, "/", 2)
 		if len(parts) != 2 {
 			log.Warn().Msgf("Unexpected key format: %q", k)
 			continue
 		}
-		if p.collectionBlacklist[parts[0]] {
+		route := p.router.Route(parts[0])
+		if route.Action == routing.Drop {
 			continue
 		}
+		if err := p.validator.Validate(parts[0], v); err != nil {
+			recordValidationErrors.WithLabelValues(parts[0]).Inc()
+			invalid = append(invalid, repo.InvalidRecord{
+				Repo:       models.ID(work.Repo.ID),
+				Collection: parts[0],
+				Rkey:       parts[1],
+				AtRev:      newRev,
+				Content:    fix.EscapeNullCharForPostgres(v),
+				Error:      err.Error(),
+				Rejected:   p.validator.Strict(),
+			})
+			if p.validator.Strict() {
+				continue
+			}
+		} else {
+			valid[k] = true
+		}
 		rec := repo.Record{
 			Repo:       models.ID(work.Repo.ID),
 			Collection: parts[0],
 			Rkey:       parts[1],
+			CID:        cids[k].String(),
 			Content:    v,
 			AtRev:      newRev,
 		}
@@ -303,10 +405,27 @@ func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.
 			rec.Content = fix.EscapeNullCharForPostgres(rec.Content)
 		}
 		recs = append(recs, rec)
+
+		table := route.Table
+		if table == "" && p.recordsDB == nil {
+			table = routing.DefaultTable
+		}
+		switch {
+		case route.Action == routing.Metadata:
+			rec.Content = nil
+		case table != "" && p.recordsDB != nil:
+			// Routed to Postgres from ScyllaDB mode.
+			rec.Content = fix.EscapeNullCharForPostgres(rec.Content)
+		}
+		stored[table] = append(stored[table], rec)
 	}
 
-	if len(recs) > 0 {
-		if p.recordsDB != nil {
+	// Keys of the records that were actually inserted or updated, and
+	// records that are no longer in the repo.
+	written := map[string]bool{}
+	vanished := []backlinks.Record{}
+	for table, recs := range stored {
+		if table == "" {
 			collections := map[string]map[string]repo.Record{}
 			for _, rec := range recs {
 				if collections[rec.Collection] == nil {
@@ -322,6 +441,9 @@ func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.
 				Record  json.RawMessage `db:"record"`
 			}
 
+			// Collections that no longer have any records in the repo are
+			// not checked for vanished records, since ScyllaDB can't list
+			// them without a scan.
 			for collection, recs := range collections {
 				// Select all already existing records and remove from recs
 				// any that we already have.
@@ -346,70 +468,140 @@ func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.
 
 				// Record deduplication happens here.
 				lastRkey := ""
+				gone := []string{}
 				for _, row := range rows {
+					// First (newest) row with this rkey.
+					newest := lastRkey != row.Rkey
+					lastRkey = row.Rkey
+					if _, found := newRecs[collection+"/"+row.Rkey]; !found && full && newest && !row.Deleted {
+						gone = append(gone, row.Rkey)
+					}
+
 					rec, found := recs[row.Rkey]
 					if !found {
 						// No fetched record matches the row. Nothing to do.
-						lastRkey = row.Rkey
 						continue
 					}
 					if row.AtRev > rec.AtRev {
 						// We already have a newer row.
 						delete(recs, row.Rkey)
-						lastRkey = row.Rkey
 						continue
 					}
-					if lastRkey != row.Rkey {
-						// First (newest) row with this rkey.
-						if !row.Deleted && bytes.Equal(row.Record, rec.Content) {
-							// Same content, skip inserting a copy.
-							delete(recs, row.Rkey)
-						}
+					if newest && !row.Deleted && bytes.Equal(row.Record, rec.Content) {
+						// Same content, skip inserting a copy.
+						delete(recs, row.Rkey)
 					}
-					lastRkey = row.Rkey
 				}
 
 				// Now do the inserts. All records belong to the same partition,
 				// and we've removed all duplicates.
 				query := p.recordsDB.Query(qb.Insert("bluesky.records").
-					Columns("repo", "collection", "rkey", "at_rev", "record", "created_at").
+					Columns("repo", "collection", "rkey", "at_rev", "cid", "record", "created_at").
 					ToCql()).WithContext(ctx)
 				defer query.Release()
 				for _, rec := range recs {
-					err := query.Bind(work.Repo.DID, rec.Collection, rec.Rkey, rec.AtRev, rec.Content, time.Now()).Exec()
+					err := query.Bind(work.Repo.DID, rec.Collection, rec.Rkey, rec.AtRev, rec.CID, rec.Content, time.Now()).Exec()
 					if err != nil {
 						return fmt.Errorf("inserting record %s/%s/%s into the database: %w", work.Repo.DID, rec.Collection, rec.Rkey, err)
 					}
 					recordsInserted.Add(1)
+					written[rec.Collection+"/"+rec.Rkey] = true
 				}
-			}
-		} else {
-			for _, batch := range splitInBatshes(recs, 500) {
-				result := p.db.Model(&repo.Record{}).
-					Clauses(clause.OnConflict{
-						Where: clause.Where{Exprs: []clause.Expression{
-							clause.Neq{
-								Column: clause.Column{Name: "content", Table: "records"},
-								Value:  clause.Column{Name: "content", Table: "excluded"}},
-							clause.Or(
-								clause.Eq{Column: clause.Column{Name: "at_rev", Table: "records"}, Value: nil},
-								clause.Eq{Column: clause.Column{Name: "at_rev", Table: "records"}, Value: ""},
-								clause.Lt{
-									Column: clause.Column{Name: "at_rev", Table: "records"},
-									Value:  clause.Column{Name: "at_rev", Table: "excluded"}},
-							)}},
-						DoUpdates: clause.AssignmentColumns([]string{"content", "at_rev"}),
-						Columns:   []clause.Column{{Name: "repo"}, {Name: "collection"}, {Name: "rkey"}}}).
-					Create(batch)
-				if err := result.Error; err != nil {
-					return fmt.Errorf("inserting records into the database: %w", err)
+
+				tombstone := p.recordsDB.Query(qb.Insert("bluesky.records").
+					Columns("repo", "collection", "rkey", "at_rev", "deleted", "created_at").
+					ToCql()).WithContext(ctx)
+				defer tombstone.Release()
+				for _, rkey := range gone {
+					err := tombstone.Bind(work.Repo.DID, collection, rkey, newRev, true, time.Now()).Exec()
+					if err != nil {
+						return fmt.Errorf("marking %s/%s/%s as deleted: %w", work.Repo.DID, collection, rkey, err)
+					}
+					vanished = append(vanished, backlinks.Record{Collection: collection, Rkey: rkey})
 				}
-				recordsInserted.Add(float64(result.RowsAffected))
+			}
+			continue
+		}
+
+		for _, batch := range splitInBatshes(recs, 500) {
+			keys, err := upsertRecords(ctx, p.db, table, batch)
+			if err != nil {
+				return fmt.Errorf("inserting records into %q: %w", table, err)
+			}
+			recordsInserted.Add(float64(len(keys)))
+			for _, k := range keys {
+				written[k] = true
 			}
 		}
 	}
 
-	err := p.db.Model(&repo.Repo{}).Where(&repo.Repo{ID: work.Repo.ID}).
+	if full {
+		tables := p.router.Tables()
+		if p.recordsDB == nil {
+			tables = append([]string{routing.DefaultTable}, tables...)
+		}
+		for _, table := range tables {
+			gone, err := p.markVanished(ctx, table, work.Repo.ID, newRev, newRecs)
+			if err != nil {
+				return err
+			}
+			vanished = append(vanished, gone...)
+		}
+	}
+
+	if err := repo.SaveInvalidRecords(ctx, p.db, invalid); err != nil {
+		return fmt.Errorf("saving invalid records: %w", err)
+	}
+	err := repo.ClearInvalidRecords(ctx, p.db, work.Repo.ID, newRev, func(collection string, rkey string) bool {
+		k := collection + "/" + rkey
+		if _, found := newRecs[k]; !found {
+			// Deleted, if this is a full fetch.
+			return full
+		}
+		return valid[k]
+	})
+	if err != nil {
+		return fmt.Errorf("clearing invalid records: %w", err)
+	}
+
+	// Records that were skipped are either unchanged, or have a newer
+	// version already written by the consumer, so their backlinks, graph
+	// edges and changes are already up to date.
+	changed := append([]backlinks.Record{}, vanished...)
+	for _, rec := range recs {
+		if written[rec.Collection+"/"+rec.Rkey] {
+			changed = append(changed, backlinks.Record{Collection: rec.Collection, Rkey: rec.Rkey, Content: rec.Content})
+		}
+	}
+	if err := backlinks.Replace(ctx, p.db, work.Repo.ID, changed); err != nil {
+		return fmt.Errorf("updating backlinks: %w", err)
+	}
+	if err := graph.Update(ctx, p.db, work.Repo.DID, changed); err != nil {
+		return fmt.Errorf("updating graph edges: %w", err)
+	}
+	if p.changeFeed {
+		feed := []changes.Change{}
+		for _, rec := range changed {
+			action := changes.ActionUpsert
+			if rec.Content == nil {
+				action = changes.ActionDelete
+			}
+			feed = append(feed, changes.Change{
+				Repo:       work.Repo.DID,
+				Collection: rec.Collection,
+				Rkey:       rec.Rkey,
+				Rev:        newRev,
+				Action:     action,
+				Source:     changes.SourceBackfill,
+				Content:    rec.Content,
+			})
+		}
+		if err := changes.Append(ctx, p.db, feed); err != nil {
+			return fmt.Errorf("appending changes: %w", err)
+		}
+	}
+
+	err = p.db.Model(&repo.Repo{}).Where(&repo.Repo{ID: work.Repo.ID}).
 		Updates(&repo.Repo{LastIndexedRev: newRev}).Error
 	if err != nil {
 		return fmt.Errorf("updating repo rev: %w", err)
@@ -420,12 +612,100 @@ func (p *WorkerPool) insertRecords(ctx context.Context, newRecs map[string]json.
 			return fmt.Errorf("updating first_cursor_since_reset: %w", err)
 		}
 	}
-	// TODO: check for records that are missing in the repo download
-	// and mark them as deleted.
-
 	return nil
 }
 
+// upsertRecords inserts the records into the table, or updates existing
+// ones with an older rev and different content, including records that
+// were deleted and then created again. Returns "collection/rkey"
+// keys of the rows that were actually written.
+func upsertRecords(ctx context.Context, db *gorm.DB, table string, recs []repo.Record) ([]string, error) {
+	// gorm assigns RETURNING values to the records in order, regardless of
+	// which of them were skipped, so the statement is only built by gorm
+	// and executed directly.
+	stmt := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true}).
+		Model(&repo.Record{}).Table(table).
+		Clauses(clause.OnConflict{
+			Where: clause.Where{Exprs: []clause.Expression{
+				// Metadata-only records have NULL content, so the CID is
+				// what tells if they've changed.
+				clause.Or(
+					clause.Expr{SQL: "? is distinct from ?", Vars: []interface{}{
+						clause.Column{Name: "content", Table: table},
+						clause.Column{Name: "content", Table: "excluded"}}},
+					clause.Expr{SQL: "? is distinct from ?", Vars: []interface{}{
+						clause.Column{Name: "cid", Table: table},
+						clause.Column{Name: "cid", Table: "excluded"}}},
+					clause.Expr{SQL: "? is distinct from ?", Vars: []interface{}{
+						clause.Column{Name: "deleted", Table: table},
+						clause.Column{Name: "deleted", Table: "excluded"}}},
+				),
+				clause.Or(
+					clause.Eq{Column: clause.Column{Name: "at_rev", Table: table}, Value: nil},
+					clause.Eq{Column: clause.Column{Name: "at_rev", Table: table}, Value: ""},
+					clause.Lt{
+						Column: clause.Column{Name: "at_rev", Table: table},
+						Value:  clause.Column{Name: "at_rev", Table: "excluded"}},
+				)}},
+			DoUpdates: clause.AssignmentColumns([]string{"content", "cid", "at_rev", "deleted"}),
+			Columns:   []clause.Column{{Name: "repo"}, {Name: "collection"}, {Name: "rkey"}}},
+			clause.Returning{Columns: []clause.Column{{Name: "collection"}, {Name: "rkey"}}}).
+		Create(&recs)
+	if stmt.Error != nil {
+		return nil, stmt.Error
+	}
+
+	rows, err := db.Statement.ConnPool.QueryContext(ctx, stmt.Statement.SQL.String(), stmt.Statement.Vars...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var collection, rkey string
+		if err := rows.Scan(&collection, &rkey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, collection+"/"+rkey)
+	}
+	return keys, rows.Err()
+}
+
+// markVanished marks as deleted at the given rev the records of the repo in
+// the table that are not present in a full fetch of it, and returns them.
+func (p *WorkerPool) markVanished(ctx context.Context, table string, repoID models.ID, rev string, fetched map[string]json.RawMessage) ([]backlinks.Record, error) {
+	existing := []backlinks.Record{}
+	err := p.db.WithContext(ctx).Model(&repo.Record{}).Table(table).
+		Select("collection, rkey").
+		Where("repo = ? and not coalesce(deleted, false) and coalesce(at_rev, '') <= ?", repoID, rev).
+		Scan(&existing).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing records in %q: %w", table, err)
+	}
+
+	gone := []backlinks.Record{}
+	for _, r := range existing {
+		if _, found := fetched[r.Collection+"/"+r.Rkey]; !found {
+			gone = append(gone, backlinks.Record{Collection: r.Collection, Rkey: r.Rkey})
+		}
+	}
+	for _, batch := range splitInBatshes(gone, 500) {
+		keys := [][]interface{}{}
+		for _, r := range batch {
+			keys = append(keys, []interface{}{r.Collection, r.Rkey})
+		}
+		// Skip records that the consumer has written since they were
+		// listed above.
+		err := p.db.WithContext(ctx).Model(&repo.Record{}).Table(table).
+			Where("repo = ? and (collection, rkey) in ? and coalesce(at_rev, '') <= ?", repoID, keys, rev).
+			Updates(&repo.Record{Deleted: true, AtRev: rev}).Error
+		if err != nil {
+			return nil, fmt.Errorf("marking vanished records in %q as deleted: %w", table, err)
+		}
+	}
+	return gone, nil
+}
+
 // bumpFirstCursorSinceReset increases repo's FirstCursorSinceReset iff it is currently lower than the supplied value.
 func (p *WorkerPool) bumpFirstCursorSinceReset(repoId models.ID, cursorValue int64) error {
 	return p.db.Transaction(func(tx *gorm.DB) error {
@@ -443,6 +723,16 @@ func (p *WorkerPool) bumpFirstCursorSinceReset(repoId models.ID, cursorValue int
 	})
 }
 
+// InProgress returns all fetches that are currently in progress.
+func (p *WorkerPool) InProgress() []*fetchProgress {
+	r := []*fetchProgress{}
+	p.fetches.Range(func(key, value any) bool {
+		r = append(r, value.(*fetchProgress))
+		return true
+	})
+	return r
+}
+
 func splitInBatshes[T any](s []T, batchSize int) [][]T {
 	var r [][]T
 	for i := 0; i < len(s); i += batchSize {
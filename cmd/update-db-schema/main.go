@@ -2,17 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,18 +25,26 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/backlinks"
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/graph"
 	"github.com/uabluerail/indexer/pds"
 	"github.com/uabluerail/indexer/repo"
+	"github.com/uabluerail/indexer/routing"
 	"github.com/uabluerail/indexer/util/gormzerolog"
+	"github.com/uabluerail/indexer/webhooks"
 )
 
 type Config struct {
-	LogFile      string
-	LogFormat    string `default:"text"`
-	LogLevel     int64  `default:"1"`
-	DBUrl        string `envconfig:"POSTGRES_URL"`
-	ScyllaDBAddr string `envconfig:"SCYLLADB_ADDR"`
+	LogFile          string
+	LogFormat        string   `default:"text"`
+	LogLevel         int64    `default:"1"`
+	DBUrl            string   `envconfig:"POSTGRES_URL"`
+	ScyllaDBAddr     string   `envconfig:"SCYLLADB_ADDR"`
+	CollectionRoutes []string `split_words:"true"`
 }
 
 var config Config
@@ -56,14 +65,31 @@ func runMain(ctx context.Context) error {
 	log.Debug().Msgf("DB connection established")
 
 	for _, f := range []func(*gorm.DB) error{
+		audit.AutoMigrate,
+		backlinks.AutoMigrate,
+		changes.AutoMigrate,
+		graph.AutoMigrate,
 		pds.AutoMigrate,
 		repo.AutoMigrate,
+		webhooks.AutoMigrate,
 	} {
 		if err := f(db); err != nil {
 			return fmt.Errorf("auto-migrating DB schema: %w", err)
 		}
 	}
 
+	router, err := routing.New(nil, nil, config.CollectionRoutes)
+	if err != nil {
+		return fmt.Errorf("parsing collection routes: %w", err)
+	}
+	if err := createRoutedTables(ctx, db, router); err != nil {
+		return err
+	}
+
+	if err := mergeDuplicatePDSs(ctx, db); err != nil {
+		return fmt.Errorf("merging duplicate PDS records: %w", err)
+	}
+
 	if config.ScyllaDBAddr != "" {
 		scylla := gocql.NewCluster(config.ScyllaDBAddr)
 		session, err := gocqlx.WrapSession(scylla.CreateSession())
@@ -83,6 +109,7 @@ func runMain(ctx context.Context) error {
 			rkey text,
 			created_at timestamp,
 			at_rev text,
+			cid text,
 			deleted boolean,
 			record text,
 			PRIMARY KEY ((repo, collection), rkey, at_rev)
@@ -90,12 +117,57 @@ func runMain(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("Creating records table: %w", err)
 		}
+
+		// Tables created before record CIDs were stored don't have the column yet.
+		var column string
+		err = session.Session.Query(`SELECT column_name FROM system_schema.columns
+			WHERE keyspace_name = 'bluesky' AND table_name = 'records' AND column_name = 'cid'`).
+			WithContext(ctx).Scan(&column)
+		switch {
+		case errors.Is(err, gocql.ErrNotFound):
+			if err := session.ExecStmt(`ALTER TABLE bluesky.records ADD cid text`); err != nil {
+				return fmt.Errorf("Adding cid column to records table: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("Checking for cid column in records table: %w", err)
+		}
 	}
 
 	log.Debug().Msgf("DB schema updated")
 	return nil
 }
 
+// createRoutedTables creates the extra tables used by collection routes,
+// with the same columns and indexes as the default records table, and adds
+// columns that were introduced after a table was created.
+func createRoutedTables(ctx context.Context, db *gorm.DB, router *routing.Router) error {
+	s, err := schema.Parse(&repo.Record{}, &sync.Map{}, db.NamingStrategy)
+	if err != nil {
+		return fmt.Errorf("parsing records schema: %w", err)
+	}
+	for _, table := range router.Tables() {
+		err := db.WithContext(ctx).Exec(fmt.Sprintf(
+			"create table if not exists %q (like %q including defaults including constraints including indexes)",
+			table, routing.DefaultTable)).Error
+		if err != nil {
+			return fmt.Errorf("creating table %q: %w", table, err)
+		}
+
+		// AutoMigrate can't be used here, since it would try to create
+		// indexes with the same names as on the default table.
+		m := db.WithContext(ctx).Table(table).Migrator()
+		for _, name := range s.DBNames {
+			if m.HasColumn(&repo.Record{}, name) {
+				continue
+			}
+			if err := m.AddColumn(&repo.Record{}, name); err != nil {
+				return fmt.Errorf("adding column %q to %q: %w", name, table, err)
+			}
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.StringVar(&config.LogFile, "log", "", "Path to the log file. If empty, will log to stderr")
 	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/repo"
+)
+
+// mergeDuplicatePDSs finds PDS rows that have the same host after
+// normalization, and merges each such group into a single row.
+func mergeDuplicatePDSs(ctx context.Context, db *gorm.DB) error {
+	log := zerolog.Ctx(ctx)
+
+	remotes := []pds.PDS{}
+	if err := db.WithContext(ctx).Order("id").Find(&remotes).Error; err != nil {
+		return fmt.Errorf("querying the list of PDSs: %w", err)
+	}
+
+	groups := map[string][]pds.PDS{}
+	for _, remote := range remotes {
+		host := pds.NormalizeHost(remote.Host)
+		groups[host] = append(groups[host], remote)
+	}
+
+	for host, group := range groups {
+		if len(group) == 1 && group[0].Host == host {
+			continue
+		}
+
+		// Keep the row that made the most progress consuming the firehose,
+		// to minimize the amount of events that need to be re-processed.
+		keep := group[0]
+		for _, remote := range group[1:] {
+			if remote.Cursor > keep.Cursor {
+				keep = remote
+			}
+		}
+
+		log.Info().Msgf("Merging %d PDS rows into %q (id %d)", len(group), host, keep.ID)
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, remote := range group {
+				if remote.ID == keep.ID {
+					continue
+				}
+				if err := repointPDS(tx, remote.ID, keep.ID); err != nil {
+					return fmt.Errorf("repointing references from %q: %w", remote.Host, err)
+				}
+				if err := tx.Delete(&pds.PDS{}, remote.ID).Error; err != nil {
+					return fmt.Errorf("deleting %q: %w", remote.Host, err)
+				}
+				err := audit.Record(ctx, tx, audit.Entry{
+					Actor:   "update-db-schema",
+					Action:  "pds.merge",
+					Target:  host,
+					Details: fmt.Sprintf("merged %q (id %d) into id %d", remote.Host, remote.ID, keep.ID),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if keep.Host != host {
+				if err := tx.Model(&pds.PDS{}).Where(&pds.PDS{ID: keep.ID}).Updates(&pds.PDS{Host: host}).Error; err != nil {
+					return fmt.Errorf("renaming %q to %q: %w", keep.Host, host, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("merging duplicates of %q: %w", host, err)
+		}
+	}
+	return nil
+}
+
+func repointPDS(tx *gorm.DB, from models.ID, to models.ID) error {
+	if err := tx.Model(&repo.Repo{}).Where("pds = ?", from).Update("pds", to).Error; err != nil {
+		return fmt.Errorf("updating repos: %w", err)
+	}
+	if err := tx.Model(&repo.BadRecord{}).Where("pds = ?", from).Update("pds", to).Error; err != nil {
+		return fmt.Errorf("updating bad_records: %w", err)
+	}
+	if err := tx.Model(&pds.Metadata{}).Where("pds = ?", from).Update("pds", to).Error; err != nil {
+		return fmt.Errorf("updating pds_metadata: %w", err)
+	}
+	err := tx.Exec(`delete from pds_sources where pds = ? and source in (select source from pds_sources where pds = ?)`, from, to).Error
+	if err != nil {
+		return fmt.Errorf("deleting duplicate pds_sources: %w", err)
+	}
+	if err := tx.Model(&pds.Source{}).Where("pds = ?", from).Update("pds", to).Error; err != nil {
+		return fmt.Errorf("updating pds_sources: %w", err)
+	}
+	return nil
+}
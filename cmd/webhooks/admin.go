@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/util/adminserver"
+	"github.com/uabluerail/indexer/webhooks"
+)
+
+const serviceName = "webhooks"
+
+type adminHandlers struct {
+	db *gorm.DB
+}
+
+func addAdminHandlers(srv *adminserver.Server, db *gorm.DB) {
+	h := &adminHandlers{db: db}
+	srv.HandleFunc("/webhooks/list", adminserver.RoleRead, h.handleList)
+	srv.HandleFunc("/webhooks/create", adminserver.RoleWrite, h.handleCreate)
+	srv.HandleFunc("/webhooks/delete", adminserver.RoleWrite, h.handleDelete)
+	srv.HandleFunc("/webhooks/disable", adminserver.RoleWrite, h.handleSetDisabled(true))
+	srv.HandleFunc("/webhooks/enable", adminserver.RoleWrite, h.handleSetDisabled(false))
+	srv.HandleFunc("/webhooks/deadLetters", adminserver.RoleRead, h.handleDeadLetters)
+}
+
+func (h *adminHandlers) handleList(w http.ResponseWriter, r *http.Request) {
+	hooks := []webhooks.Hook{}
+	if err := h.db.WithContext(r.Context()).Order("id").Find(&hooks).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, hooks)
+}
+
+// handleCreate registers a new hook. Unless the cursor parameter is given,
+// it starts with the latest change in the feed. The response is the only
+// place where the secret is returned.
+func (h *adminHandlers) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	hook := &webhooks.Hook{
+		URL:          r.FormValue("url"),
+		Secret:       r.FormValue("secret"),
+		Collection:   r.FormValue("collection"),
+		DID:          r.FormValue("did"),
+		Action:       r.FormValue("action"),
+		ContentPath:  r.FormValue("contentPath"),
+		ContentValue: r.FormValue("contentValue"),
+	}
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "need an http(s) url", http.StatusBadRequest)
+		return
+	}
+	if hook.Collection != "" {
+		if _, err := syntax.ParseNSID(hook.Collection); err != nil {
+			http.Error(w, fmt.Sprintf("invalid collection %q", hook.Collection), http.StatusBadRequest)
+			return
+		}
+	}
+	if hook.DID != "" {
+		if _, err := syntax.ParseDID(hook.DID); err != nil {
+			http.Error(w, fmt.Sprintf("invalid DID %q", hook.DID), http.StatusBadRequest)
+			return
+		}
+	}
+	switch hook.Action {
+	case "", changes.ActionUpsert, changes.ActionDelete:
+	default:
+		http.Error(w, fmt.Sprintf("action must be %q or %q", changes.ActionUpsert, changes.ActionDelete), http.StatusBadRequest)
+		return
+	}
+	if hook.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = hex.EncodeToString(b)
+	}
+	if s := r.FormValue("cursor"); s != "" {
+		seq, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", s), http.StatusBadRequest)
+			return
+		}
+		hook.LastSeq = seq
+	} else {
+		seq, err := changes.LastSeq(ctx, h.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hook.LastSeq = seq
+	}
+
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(hook).Error; err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.Entry{
+			Actor:   adminserver.Actor(ctx, serviceName),
+			Action:  "webhooks.create",
+			Target:  strconv.FormatUint(uint64(hook.ID), 10),
+			Details: fmt.Sprintf("%s (requested from %s)", hook.URL, r.RemoteAddr),
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		*webhooks.Hook
+		Secret string `json:"secret"`
+	}{hook, hook.Secret})
+}
+
+// getHook checks that the request is a POST and looks up the hook
+// specified in it. On failure it writes the response and returns nil.
+func (h *adminHandlers) getHook(w http.ResponseWriter, r *http.Request) *webhooks.Hook {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return nil
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "need id", http.StatusBadRequest)
+		return nil
+	}
+	hook := &webhooks.Hook{}
+	err = h.db.WithContext(r.Context()).Where(&webhooks.Hook{ID: models.ID(id)}).Take(hook).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return hook
+}
+
+func (h *adminHandlers) handleDelete(w http.ResponseWriter, r *http.Request) {
+	hook := h.getHook(w, r)
+	if hook == nil {
+		return
+	}
+	ctx := r.Context()
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(&webhooks.DeadLetter{Hook: hook.ID}).Delete(&webhooks.DeadLetter{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(hook).Error; err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.Entry{
+			Actor:   adminserver.Actor(ctx, serviceName),
+			Action:  "webhooks.delete",
+			Target:  strconv.FormatUint(uint64(hook.ID), 10),
+			Details: fmt.Sprintf("%s (requested from %s)", hook.URL, r.RemoteAddr),
+		})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func (h *adminHandlers) handleSetDisabled(disabled bool) http.HandlerFunc {
+	action := "webhooks.enable"
+	if disabled {
+		action = "webhooks.disable"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook := h.getHook(w, r)
+		if hook == nil {
+			return
+		}
+		if hook.Disabled == disabled {
+			fmt.Fprintln(w, "OK, nothing changed")
+			return
+		}
+		ctx := r.Context()
+		err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&webhooks.Hook{}).Where(&webhooks.Hook{ID: hook.ID}).
+				Updates(map[string]any{"disabled": disabled}).Error
+			if err != nil {
+				return err
+			}
+			return audit.Record(ctx, tx, audit.Entry{
+				Actor:   adminserver.Actor(ctx, serviceName),
+				Action:  action,
+				Target:  strconv.FormatUint(uint64(hook.ID), 10),
+				Details: fmt.Sprintf("requested from %s", r.RemoteAddr),
+			})
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+func (h *adminHandlers) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.FormValue("limit"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+		limit = min(v, 1000)
+	}
+	q := h.db.WithContext(r.Context()).Order("id desc").Limit(limit)
+	if s := r.FormValue("id"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id %q", s), http.StatusBadRequest)
+			return
+		}
+		q = q.Where(&webhooks.DeadLetter{Hook: models.ID(id)})
+	}
+	letters := []webhooks.DeadLetter{}
+	if err := q.Find(&letters).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, letters)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
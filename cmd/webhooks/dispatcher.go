@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/webhooks"
+)
+
+const (
+	changesPageSize = 500
+	pollInterval    = time.Second
+	reloadInterval  = 10 * time.Second
+)
+
+// Dispatcher runs a delivery loop for each enabled hook, and restarts
+// them when hooks are changed.
+type Dispatcher struct {
+	db          *gorm.DB
+	client      *http.Client
+	maxAttempts int
+	userAgent   string
+}
+
+type runningHook struct {
+	cancel    context.CancelFunc
+	done      chan struct{}
+	updatedAt time.Time
+}
+
+func NewDispatcher(db *gorm.DB, timeout time.Duration, maxAttempts int, contactInfo string) *Dispatcher {
+	return &Dispatcher{
+		db:          db,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		userAgent:   fmt.Sprintf("uabluerail-indexer/webhooks (contact: %s)", contactInfo),
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	running := map[models.ID]runningHook{}
+	stop := func(id models.ID) {
+		running[id].cancel()
+		<-running[id].done
+		delete(running, id)
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		hooks := []webhooks.Hook{}
+		if err := d.db.WithContext(ctx).Where("not disabled").Find(&hooks).Error; err != nil {
+			log.Error().Err(err).Msgf("Failed to load webhooks: %s", err)
+		} else {
+			enabled := map[models.ID]webhooks.Hook{}
+			for _, h := range hooks {
+				enabled[h.ID] = h
+			}
+			for id, r := range running {
+				if h, found := enabled[id]; !found || !h.UpdatedAt.Equal(r.updatedAt) {
+					log.Info().Msgf("Stopping webhook %d", id)
+					stop(id)
+				}
+			}
+			for id, h := range enabled {
+				if _, found := running[id]; found {
+					continue
+				}
+				log.Info().Msgf("Starting webhook %d (%s)", id, h.URL)
+				hookCtx, cancel := context.WithCancel(ctx)
+				r := runningHook{cancel: cancel, done: make(chan struct{}), updatedAt: h.UpdatedAt}
+				running[id] = r
+				go func(h webhooks.Hook) {
+					defer close(r.done)
+					d.runHook(hookCtx, h)
+				}(h)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for id := range running {
+				stop(id)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runHook delivers matching changes to the hook, in order, until the
+// context is cancelled.
+func (d *Dispatcher) runHook(ctx context.Context, hook webhooks.Hook) {
+	hookLabel := strconv.FormatUint(uint64(hook.ID), 10)
+	log := zerolog.Ctx(ctx).With().Uint64("hook", uint64(hook.ID)).Logger()
+	ctx = log.WithContext(ctx)
+	defer func() {
+		deliveryAttempts.DeletePartialMatch(prometheus.Labels{"hook": hookLabel})
+		deliveryDuration.DeletePartialMatch(prometheus.Labels{"hook": hookLabel})
+		deadLetters.DeletePartialMatch(prometheus.Labels{"hook": hookLabel})
+		lastDeliveredSeq.DeletePartialMatch(prometheus.Labels{"hook": hookLabel})
+	}()
+
+	after := hook.LastSeq
+	saved := after
+	save := func() {
+		if after == saved {
+			return
+		}
+		// Not using ctx here, to save progress on shutdown too. UpdateColumn
+		// doesn't touch updated_at, so it doesn't restart the hook.
+		err := d.db.Model(&webhooks.Hook{}).Where(&webhooks.Hook{ID: hook.ID}).
+			UpdateColumn("last_seq", after).Error
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to save progress: %s", err)
+			return
+		}
+		saved = after
+		lastDeliveredSeq.WithLabelValues(hookLabel).Set(float64(after))
+	}
+	defer save()
+
+	filter := hook.Filter()
+	for {
+		batch, err := changes.Read(ctx, d.db, after, filter, changesPageSize)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msgf("Failed to read changes: %s", err)
+		}
+		for i := range batch {
+			c := &batch[i]
+			if hook.Match(c) {
+				if err := d.deliver(ctx, &hook, hookLabel, c); err != nil {
+					// Only fails when the context is cancelled.
+					return
+				}
+			}
+			after = c.Seq
+		}
+		save()
+
+		if len(batch) == changesPageSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// deliver sends the change to the hook, retrying with backoff. If all
+// attempts fail, the change is put into the dead-letter table. Returns
+// an error only if the context was cancelled.
+func (d *Dispatcher) deliver(ctx context.Context, hook *webhooks.Hook, hookLabel string, c *changes.Change) error {
+	log := zerolog.Ctx(ctx)
+	body, err := json.Marshal(c)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to marshal change %d, skipping: %s", c.Seq, err)
+		return nil
+	}
+
+	attempts := 0
+	var lastErr error
+	b := backoff.NewExponentialBackOff(
+		backoff.WithMaxElapsedTime(0),
+		backoff.WithInitialInterval(time.Second),
+		backoff.WithMaxInterval(5*time.Minute),
+	)
+	err = backoff.Retry(func() error {
+		attempts++
+		lastErr = d.post(ctx, hook, hookLabel, c.Seq, body)
+		if lastErr == nil {
+			deliveryAttempts.WithLabelValues(hookLabel, "ok").Inc()
+			return nil
+		}
+		deliveryAttempts.WithLabelValues(hookLabel, "failed").Inc()
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		}
+		log.Debug().Err(lastErr).Int64("seq", c.Seq).Msgf("Delivery attempt %d failed: %s", attempts, lastErr)
+		return lastErr
+	}, backoff.WithContext(backoff.WithMaxRetries(b, uint64(d.maxAttempts-1)), ctx))
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	log.Warn().Err(lastErr).Int64("seq", c.Seq).Msgf("Giving up on delivering change %d after %d attempts: %s", c.Seq, attempts, lastErr)
+	err = d.db.WithContext(ctx).Create(&webhooks.DeadLetter{
+		Hook:      hook.ID,
+		Seq:       c.Seq,
+		Payload:   body,
+		Attempts:  attempts,
+		LastError: lastErr.Error(),
+	}).Error
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to write dead letter for change %d: %s", c.Seq, err)
+	}
+	deadLetters.WithLabelValues(hookLabel).Inc()
+	return nil
+}
+
+func (d *Dispatcher) post(ctx context.Context, hook *webhooks.Hook, hookLabel string, seq int64, body []byte) error {
+	start := time.Now()
+	defer func() { deliveryDuration.WithLabelValues(hookLabel).Observe(time.Since(start).Seconds()) }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", d.userAgent)
+	req.Header.Set("X-Webhook-Id", strconv.FormatUint(uint64(hook.ID), 10))
+	req.Header.Set("X-Webhook-Seq", strconv.FormatInt(seq, 10))
+	req.Header.Set("X-Webhook-Signature", webhooks.Signature(hook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, msg)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		// Not going to get better with retries.
+		return backoff.Permanent(err)
+	}
+	return err
+}
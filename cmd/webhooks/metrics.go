@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhooks_delivery_attempts_count",
+	Help: "Number of attempts to deliver a change to a webhook",
+}, []string{"hook", "result"})
+
+var deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "webhooks_delivery_duration_seconds",
+	Help:    "Time spent on a single delivery attempt",
+	Buckets: prometheus.ExponentialBucketsRange(0.01, 30, 20),
+}, []string{"hook"})
+
+var deadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhooks_dead_letters_count",
+	Help: "Number of changes moved to the dead-letter table after all attempts have failed",
+}, []string{"hook"})
+
+var lastDeliveredSeq = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "webhooks_last_processed_seq",
+	Help: "Seq of the last change processed for a webhook",
+}, []string{"hook"})
@@ -0,0 +1,232 @@
+// Package graph maintains typed tables of social graph edges (follows,
+// blocks, list items, likes and reposts), extracted from records as they
+// are indexed.
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/uabluerail/indexer/backlinks"
+)
+
+// Edge is a record pointing from the repo that contains it to a target.
+// It is keyed by (source, rkey), since each table holds a single collection.
+type Edge struct {
+	// DID of the repo containing the record.
+	Source string `gorm:"primaryKey"`
+	Rkey   string `gorm:"primaryKey"`
+	// DID for follows, blocks and list items, AT-URI for likes and reposts.
+	Target string `gorm:"index;not null"`
+}
+
+type Follow struct{ Edge }
+
+func (Follow) TableName() string { return "graph_follows" }
+
+type Block struct{ Edge }
+
+func (Block) TableName() string { return "graph_blocks" }
+
+type ListItem struct {
+	Edge
+	// AT-URI of the list.
+	List string `gorm:"index;not null"`
+}
+
+func (ListItem) TableName() string { return "graph_list_items" }
+
+type Like struct{ Edge }
+
+func (Like) TableName() string { return "graph_likes" }
+
+type Repost struct{ Edge }
+
+func (Repost) TableName() string { return "graph_reposts" }
+
+func AutoMigrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Follow{}, &Block{}, &ListItem{}, &Like{}, &Repost{}); err != nil {
+		return err
+	}
+	// Authors of liked posts, for the export of DIDs.
+	return db.Exec(`create index if not exists idx_graph_likes_target_did
+		on graph_likes (split_part(target, '/', 3))`).Error
+}
+
+// kind describes how records of a collection are mapped onto an edge table.
+type kind struct {
+	table string
+	// SQL expressions over records.content, used by Rebuild. Must produce
+	// the same values as decode.
+	columns map[string]string
+	// decode returns values of the columns other than source and rkey, or
+	// nil if the record is malformed.
+	decode func(content json.RawMessage) map[string]interface{}
+}
+
+const (
+	didSubject = `records.content ->> 'subject'`
+	uriSubject = `records.content -> 'subject' ->> 'uri'`
+	listURI    = `records.content ->> 'list'`
+)
+
+// prefixes of valid values, for both decode and Rebuild.
+var prefixes = map[string]string{
+	didSubject: "did:",
+	uriSubject: "at://",
+	listURI:    "at://",
+}
+
+func decodeDIDSubject(content json.RawMessage) map[string]interface{} {
+	v := struct {
+		Subject string `json:"subject"`
+	}{}
+	if json.Unmarshal(content, &v) != nil || !strings.HasPrefix(v.Subject, prefixes[didSubject]) {
+		return nil
+	}
+	return map[string]interface{}{"target": v.Subject}
+}
+
+func decodeURISubject(content json.RawMessage) map[string]interface{} {
+	v := struct {
+		Subject struct {
+			URI string `json:"uri"`
+		} `json:"subject"`
+	}{}
+	if json.Unmarshal(content, &v) != nil || !strings.HasPrefix(v.Subject.URI, prefixes[uriSubject]) {
+		return nil
+	}
+	return map[string]interface{}{"target": v.Subject.URI}
+}
+
+func decodeListItem(content json.RawMessage) map[string]interface{} {
+	r := decodeDIDSubject(content)
+	if r == nil {
+		return nil
+	}
+	v := struct {
+		List string `json:"list"`
+	}{}
+	if json.Unmarshal(content, &v) != nil || !strings.HasPrefix(v.List, prefixes[listURI]) {
+		return nil
+	}
+	r["list"] = v.List
+	return r
+}
+
+var kinds = map[string]kind{
+	"app.bsky.graph.follow": {
+		table:   Follow{}.TableName(),
+		columns: map[string]string{"target": didSubject},
+		decode:  decodeDIDSubject,
+	},
+	"app.bsky.graph.block": {
+		table:   Block{}.TableName(),
+		columns: map[string]string{"target": didSubject},
+		decode:  decodeDIDSubject,
+	},
+	"app.bsky.graph.listitem": {
+		table:   ListItem{}.TableName(),
+		columns: map[string]string{"target": didSubject, "list": listURI},
+		decode:  decodeListItem,
+	},
+	"app.bsky.feed.like": {
+		table:   Like{}.TableName(),
+		columns: map[string]string{"target": uriSubject},
+		decode:  decodeURISubject,
+	},
+	"app.bsky.feed.repost": {
+		table:   Repost{}.TableName(),
+		columns: map[string]string{"target": uriSubject},
+		decode:  decodeURISubject,
+	},
+}
+
+// Collections returns the list of collections that have edge tables.
+func Collections() []string {
+	r := []string{}
+	for c := range kinds {
+		r = append(r, c)
+	}
+	return r
+}
+
+const batchSize = 500
+
+// Update replaces edges created by the given records of the repo. Records
+// with nil content are treated as deleted. Records from collections
+// without an edge table are ignored.
+func Update(ctx context.Context, db *gorm.DB, did string, records []backlinks.Record) error {
+	byCollection := map[string][]backlinks.Record{}
+	for _, r := range records {
+		if _, ok := kinds[r.Collection]; ok {
+			byCollection[r.Collection] = append(byCollection[r.Collection], r)
+		}
+	}
+
+	for collection, recs := range byCollection {
+		k := kinds[collection]
+		for start := 0; start < len(recs); start += batchSize {
+			batch := recs[start:min(start+batchSize, len(recs))]
+
+			rkeys := []string{}
+			rows := []map[string]interface{}{}
+			for _, r := range batch {
+				rkeys = append(rkeys, r.Rkey)
+				if r.Content == nil {
+					continue
+				}
+				row := k.decode(r.Content)
+				if row == nil {
+					continue
+				}
+				row["source"] = did
+				row["rkey"] = r.Rkey
+				rows = append(rows, row)
+			}
+
+			err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				err := tx.Exec(fmt.Sprintf("delete from %q where source = ? and rkey in ?", k.table), did, rkeys).Error
+				if err != nil {
+					return fmt.Errorf("deleting old edges from %q: %w", k.table, err)
+				}
+				if len(rows) == 0 {
+					return nil
+				}
+				err = tx.Table(k.table).Clauses(clause.OnConflict{DoNothing: true}).Create(rows).Error
+				if err != nil {
+					return fmt.Errorf("inserting edges into %q: %w", k.table, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Purge removes all edges from the repo. If collections are given, only
+// edges from them are removed.
+func Purge(ctx context.Context, db *gorm.DB, did string, collections []string) error {
+	if len(collections) == 0 {
+		collections = Collections()
+	}
+	for _, collection := range collections {
+		k, ok := kinds[collection]
+		if !ok {
+			continue
+		}
+		err := db.WithContext(ctx).Exec(fmt.Sprintf("delete from %q where source = ?", k.table), did).Error
+		if err != nil {
+			return fmt.Errorf("deleting edges from %q: %w", k.table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package graph
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	type testCase struct {
+		collection string
+		input      string
+		want       map[string]interface{}
+	}
+
+	cases := []testCase{
+		{"app.bsky.graph.follow", `{"subject":"did:plc:a"}`,
+			map[string]interface{}{"target": "did:plc:a"}},
+		{"app.bsky.graph.block", `{"subject":"at://did:plc:a"}`, nil},
+		{"app.bsky.graph.listitem", `{"subject":"did:plc:a","list":"at://did:plc:b/app.bsky.graph.list/1"}`,
+			map[string]interface{}{"target": "did:plc:a", "list": "at://did:plc:b/app.bsky.graph.list/1"}},
+		{"app.bsky.graph.listitem", `{"subject":"did:plc:a"}`, nil},
+		{"app.bsky.feed.like", `{"subject":{"cid":"bafy","uri":"at://did:plc:a/app.bsky.feed.post/1"}}`,
+			map[string]interface{}{"target": "at://did:plc:a/app.bsky.feed.post/1"}},
+		{"app.bsky.feed.repost", `{"subject":"did:plc:a"}`, nil},
+		{"app.bsky.feed.like", `not json`, nil},
+	}
+
+	for _, tc := range cases {
+		got := kinds[tc.collection].decode(json.RawMessage(tc.input))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("decode(%q, %s) = %v, want %v", tc.collection, tc.input, got, tc.want)
+		}
+	}
+}
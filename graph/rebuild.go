@@ -0,0 +1,64 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/models"
+)
+
+// Truncate removes all edges of the collection.
+func Truncate(ctx context.Context, db *gorm.DB, collection string) error {
+	k, ok := kinds[collection]
+	if !ok {
+		return fmt.Errorf("no edge table for collection %q", collection)
+	}
+	if err := db.WithContext(ctx).Exec(fmt.Sprintf("truncate table %q", k.table)).Error; err != nil {
+		return fmt.Errorf("truncating %q: %w", k.table, err)
+	}
+	return nil
+}
+
+// Rebuild populates the edge table of the collection from the given records
+// table, for repos with IDs in [from, to). Existing edges are kept, so
+// it's safe to re-run over the same range. Returns the number of inserted
+// edges.
+func Rebuild(ctx context.Context, db *gorm.DB, records string, collection string, from models.ID, to models.ID) (int64, error) {
+	k, ok := kinds[collection]
+	if !ok {
+		return 0, fmt.Errorf("no edge table for collection %q", collection)
+	}
+
+	names := []string{}
+	for name := range k.columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exprs := []string{}
+	conds := []string{}
+	args := []interface{}{collection, from, to}
+	for _, name := range names {
+		exprs = append(exprs, k.columns[name])
+		conds = append(conds, fmt.Sprintf("%s like ?", k.columns[name]))
+		args = append(args, prefixes[k.columns[name]]+"%")
+	}
+
+	query := fmt.Sprintf(`insert into %q (source, rkey, %s)
+		select repos.did, records.rkey, %s
+		from %q as records join repos on repos.id = records.repo
+		where records.collection = ? and records.repo >= ? and records.repo < ?
+			and records.deleted is not true and %s
+		on conflict do nothing`,
+		k.table, strings.Join(names, ", "), strings.Join(exprs, ", "), records, strings.Join(conds, " and "))
+
+	r := db.WithContext(ctx).Exec(query, args...)
+	if r.Error != nil {
+		return 0, fmt.Errorf("rebuilding %q from %q: %w", k.table, records, r.Error)
+	}
+	return r.RowsAffected, nil
+}
@@ -0,0 +1,174 @@
+// Package lexicon validates records against their Lexicon schemas.
+//
+// Only the parts of schemas describing record data are used, and
+// definitions for app.bsky.* and com.atproto.* records are bundled.
+// Schemas for other collections can be loaded from a directory.
+package lexicon
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed lexicons
+var bundled embed.FS
+
+// Doc is a Lexicon schema file.
+type Doc struct {
+	Lexicon int             `json:"lexicon"`
+	ID      string          `json:"id"`
+	Defs    map[string]*Def `json:"defs"`
+}
+
+// Def is a single schema definition. It has the union of fields of all
+// types used in record schemas, with unused ones left empty.
+type Def struct {
+	Type string `json:"type"`
+
+	// record
+	Key    string `json:"key"`
+	Record *Def   `json:"record"`
+
+	// object
+	Required   []string        `json:"required"`
+	Nullable   []string        `json:"nullable"`
+	Properties map[string]*Def `json:"properties"`
+
+	// array
+	Items *Def `json:"items"`
+
+	// array, string, bytes
+	MinLength *int `json:"minLength"`
+	MaxLength *int `json:"maxLength"`
+
+	// string
+	Format       string `json:"format"`
+	MinGraphemes *int   `json:"minGraphemes"`
+	MaxGraphemes *int   `json:"maxGraphemes"`
+
+	// integer
+	Minimum *int64 `json:"minimum"`
+	Maximum *int64 `json:"maximum"`
+
+	// string, integer, boolean
+	Enum  []any `json:"enum"`
+	Const any   `json:"const"`
+
+	// ref, union
+	Ref    string   `json:"ref"`
+	Refs   []string `json:"refs"`
+	Closed bool     `json:"closed"`
+
+	// blob
+	Accept  []string `json:"accept"`
+	MaxSize *int64   `json:"maxSize"`
+}
+
+// Catalog is a set of schema definitions, indexed by their fully
+// qualified names ("<nsid>#<name>").
+type Catalog struct {
+	defs map[string]*Def
+}
+
+// NewCatalog loads the bundled schemas and, if dir is not empty, all
+// *.json files in it. Custom schemas replace bundled ones with the same ID.
+func NewCatalog(dir string) (*Catalog, error) {
+	c := &Catalog{defs: map[string]*Def{}}
+	if err := c.addFS(bundled, "lexicons"); err != nil {
+		return nil, fmt.Errorf("loading bundled schemas: %w", err)
+	}
+	if dir != "" {
+		if err := c.addFS(os.DirFS(dir), "."); err != nil {
+			return nil, fmt.Errorf("loading schemas from %q: %w", dir, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Catalog) addFS(fsys fs.FS, root string) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(p) != ".json" {
+			return nil
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		if err := c.Add(b); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		return nil
+	})
+}
+
+// Add parses a schema file and adds its definitions to the catalog.
+func (c *Catalog) Add(b []byte) error {
+	doc := &Doc{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	// To compare integer enum values as json.Number.
+	d.UseNumber()
+	if err := d.Decode(doc); err != nil {
+		return err
+	}
+	if doc.Lexicon != 1 {
+		return fmt.Errorf("unsupported lexicon version %d", doc.Lexicon)
+	}
+	if doc.ID == "" {
+		return errors.New("missing id")
+	}
+	for name, def := range doc.Defs {
+		if def == nil {
+			continue
+		}
+		resolveRefs(doc.ID, def)
+		c.defs[doc.ID+"#"+name] = def
+	}
+	return nil
+}
+
+// resolveRefs replaces references in def and its children with fully
+// qualified names, so that they can be looked up without knowing which
+// file they came from.
+func resolveRefs(id string, def *Def) {
+	if def == nil {
+		return
+	}
+	if def.Ref != "" {
+		def.Ref = qualify(id, def.Ref)
+	}
+	for i := range def.Refs {
+		def.Refs[i] = qualify(id, def.Refs[i])
+	}
+	resolveRefs(id, def.Record)
+	resolveRefs(id, def.Items)
+	for _, p := range def.Properties {
+		resolveRefs(id, p)
+	}
+}
+
+// qualify turns a reference ("#name", "<nsid>" or "<nsid>#name") into a
+// fully qualified name.
+func qualify(id string, ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "#"):
+		return id + ref
+	case !strings.Contains(ref, "#"):
+		return ref + "#main"
+	default:
+		return ref
+	}
+}
+
+func (c *Catalog) lookup(name string) *Def {
+	return c.defs[qualify("", name)]
+}
@@ -0,0 +1,144 @@
+package lexicon
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	testCID  = "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"
+	testBlob = `{"$type": "blob", "ref": {"/": "bafkreibme22gw2h7y2h7tg2fhqotaqjucnbc24deqo72b6mkl2egezxhvy"}, "mimeType": "image/jpeg", "size": 12345}`
+)
+
+func TestValidateRecord(t *testing.T) {
+	type testCase struct {
+		name       string
+		collection string
+		content    string
+		// Expected error path, or empty if the record is valid.
+		wantErr string
+	}
+
+	strongRef := `{"uri": "at://did:plc:abc/app.bsky.feed.post/3k2a", "cid": "` + testCID + `"}`
+
+	cases := []testCase{
+		{name: "post", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "привіт", "langs": ["uk"], "createdAt": "2024-01-01T00:00:00Z",
+				"reply": {"root": ` + strongRef + `, "parent": ` + strongRef + `},
+				"facets": [{"index": {"byteStart": 0, "byteEnd": 6}, "features": [{"$type": "app.bsky.richtext.facet#tag", "tag": "hi"}]}],
+				"embed": {"$type": "app.bsky.embed.images", "images": [{"image": ` + testBlob + `, "alt": "", "aspectRatio": {"width": 4, "height": 3}}]}}`},
+		{name: "missing field", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "hi"}`, wantErr: "createdAt"},
+		{name: "too many graphemes", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "` + strings.Repeat("👍🏽", 301) + `", "createdAt": "2024-01-01T00:00:00Z"}`, wantErr: "text"},
+		{name: "graphemes, not bytes", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "` + strings.Repeat("👍🏽", 300) + `", "createdAt": "2024-01-01T00:00:00Z"}`},
+		{name: "bad language", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "langs": ["en", "???"], "createdAt": "2024-01-01T00:00:00Z"}`, wantErr: "langs[1]"},
+		{name: "bad nested ref", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "createdAt": "2024-01-01T00:00:00Z",
+				"embed": {"$type": "app.bsky.embed.recordWithMedia", "record": {"record": {"uri": "at://did:plc:abc/app.bsky.feed.post/3k2a", "cid": "nope"}},
+					"media": {"$type": "app.bsky.embed.external", "external": {"uri": "https://example.com", "title": "", "description": ""}}}}`,
+			wantErr: "embed.record.record.cid"},
+		{name: "unknown type in open union", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "createdAt": "2024-01-01T00:00:00Z", "embed": {"$type": "com.example.embed", "x": 1}}`},
+		{name: "union without type", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "createdAt": "2024-01-01T00:00:00Z", "embed": {"images": []}}`, wantErr: "embed.$type"},
+		{name: "negative integer", collection: "app.bsky.feed.post",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "createdAt": "2024-01-01T00:00:00Z",
+				"facets": [{"index": {"byteStart": -1, "byteEnd": 6}, "features": []}]}`, wantErr: "facets[0].index.byteStart"},
+		{name: "like", collection: "app.bsky.feed.like",
+			content: `{"$type": "app.bsky.feed.like", "subject": ` + strongRef + `, "createdAt": "2024-01-01T00:00:00.000Z"}`},
+		{name: "follow with bad DID", collection: "app.bsky.graph.follow",
+			content: `{"$type": "app.bsky.graph.follow", "subject": "bob", "createdAt": "2024-01-01T00:00:00Z"}`, wantErr: "subject"},
+		{name: "profile", collection: "app.bsky.actor.profile",
+			content: `{"$type": "app.bsky.actor.profile", "displayName": "Bob", "avatar": ` + testBlob + `}`},
+		{name: "legacy blob", collection: "app.bsky.actor.profile",
+			content: `{"$type": "app.bsky.actor.profile", "avatar": {"cid": "` + testCID + `", "mimeType": "image/png"}}`},
+		{name: "blob type", collection: "app.bsky.actor.profile",
+			content: `{"$type": "app.bsky.actor.profile", "avatar": ` + strings.Replace(testBlob, "image/jpeg", "image/gif", 1) + `}`, wantErr: "avatar"},
+		{name: "blob size", collection: "app.bsky.actor.profile",
+			content: `{"$type": "app.bsky.actor.profile", "avatar": ` + strings.Replace(testBlob, "12345", "1000001", 1) + `}`, wantErr: "avatar"},
+		{name: "type mismatch", collection: "app.bsky.feed.like",
+			content: `{"$type": "app.bsky.feed.post", "text": "", "createdAt": "2024-01-01T00:00:00Z"}`, wantErr: "$type"},
+		{name: "no type", collection: "app.bsky.feed.like",
+			content: `{"createdAt": "2024-01-01T00:00:00Z"}`, wantErr: "$type"},
+		{name: "unknown collection", collection: "com.example.thing",
+			content: `{"$type": "com.example.thing", "anything": [1, 2, 3]}`},
+	}
+
+	catalog, err := NewCatalog("")
+	if err != nil {
+		t.Fatalf("NewCatalog: %s", err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := catalog.ValidateRecord(tc.collection, json.RawMessage(tc.content))
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			verr := &Error{}
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a validation error at %q, got %v", tc.wantErr, err)
+			}
+			if verr.Path != tc.wantErr {
+				t.Errorf("error at %q (%s), want at %q", verr.Path, verr, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCustomSchema(t *testing.T) {
+	catalog, err := NewCatalog("")
+	if err != nil {
+		t.Fatalf("NewCatalog: %s", err)
+	}
+	err = catalog.Add([]byte(`{
+		"lexicon": 1,
+		"id": "com.example.vote",
+		"defs": {
+			"main": {
+				"type": "record",
+				"key": "tid",
+				"record": {
+					"type": "object",
+					"required": ["choice", "weight"],
+					"nullable": ["comment"],
+					"properties": {
+						"choice": {"type": "union", "refs": ["#yes", "#no"], "closed": true},
+						"weight": {"type": "integer", "enum": [1, 2, 5]},
+						"comment": {"type": "string"},
+						"subject": {"type": "ref", "ref": "com.atproto.repo.strongRef"}
+					}
+				}
+			},
+			"yes": {"type": "object", "properties": {}},
+			"no": {"type": "object", "properties": {"reason": {"type": "string", "enum": ["spam", "other"]}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+
+	for content, wantValid := range map[string]bool{
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 2}`:                              true,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#no", "reason": "spam"}, "weight": 1}`:             true,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#no", "reason": "boring"}, "weight": 1}`:           false,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#maybe"}, "weight": 1}`:                            false,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 3}`:                              false,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 1.5}`:                            false,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 1, "comment": null}`:             true,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 1, "subject": {"uri": "x"}}`:     false,
+		`{"$type": "com.example.vote", "choice": {"$type": "com.example.vote#yes"}, "weight": 1, "comment": "ok", "extra": 1}`: true,
+	} {
+		err := catalog.ValidateRecord("com.example.vote", json.RawMessage(content))
+		if (err == nil) != wantValid {
+			t.Errorf("ValidateRecord(%s) = %v, want valid: %v", content, err, wantValid)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package lexicon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/rivo/uniseg"
+)
+
+type Mode string
+
+const (
+	// Don't validate records.
+	Off Mode = "off"
+	// Store invalid records as usual, and also note them in the quarantine table.
+	Lenient Mode = "lenient"
+	// Store invalid records only in the quarantine table.
+	Strict Mode = "strict"
+)
+
+// Error describes why a record doesn't match its schema.
+type Error struct {
+	// Path to the offending value, e.g. "embed.images[0].alt".
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validator checks records on ingest. A nil validator accepts everything.
+type Validator struct {
+	catalog *Catalog
+	mode    Mode
+}
+
+// NewValidator returns a validator using the bundled schemas and the ones
+// from dir. If mode is Off, it returns nil.
+func NewValidator(mode Mode, dir string) (*Validator, error) {
+	switch mode {
+	case Off, "":
+		return nil, nil
+	case Lenient, Strict:
+	default:
+		return nil, fmt.Errorf("unknown validation mode %q, must be one of %q, %q or %q", mode, Off, Lenient, Strict)
+	}
+	catalog, err := NewCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{catalog: catalog, mode: mode}, nil
+}
+
+// Strict returns true if invalid records must not be stored.
+func (v *Validator) Strict() bool {
+	return v != nil && v.mode == Strict
+}
+
+// Validate checks a record from the given collection, in DAG-JSON form.
+// Records with a $type that has no known schema are considered valid.
+func (v *Validator) Validate(collection string, content json.RawMessage) error {
+	if v == nil {
+		return nil
+	}
+	return v.catalog.ValidateRecord(collection, content)
+}
+
+// ValidateRecord checks a record from the given collection, in DAG-JSON
+// form, against the schema of its $type. Records with a $type that has no
+// known schema are considered valid.
+func (c *Catalog) ValidateRecord(collection string, content json.RawMessage) error {
+	var value any
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	if err := d.Decode(&value); err != nil {
+		return &Error{Message: fmt.Sprintf("invalid JSON: %s", err)}
+	}
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return &Error{Message: "record is not an object"}
+	}
+	typ, ok := obj["$type"].(string)
+	if !ok {
+		return &Error{Path: "$type", Message: "missing or not a string"}
+	}
+	if typ != collection {
+		return &Error{Path: "$type", Message: fmt.Sprintf("%q doesn't match collection %q", typ, collection)}
+	}
+	def := c.lookup(typ)
+	if def == nil || def.Type != "record" || def.Record == nil {
+		return nil
+	}
+	return c.validate("", def.Record, value)
+}
+
+func (c *Catalog) validate(path string, def *Def, value any) error {
+	fail := func(format string, args ...any) error {
+		return &Error{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	switch def.Type {
+	case "null":
+		if value != nil {
+			return fail("expected null")
+		}
+	case "boolean":
+		b, ok := value.(bool)
+		if !ok {
+			return fail("expected a boolean")
+		}
+		if def.Const != nil && def.Const != b {
+			return fail("must be %v", def.Const)
+		}
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return fail("expected an integer")
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fail("expected an integer, got %s", n)
+		}
+		if def.Minimum != nil && i < *def.Minimum {
+			return fail("%d is less than minimum %d", i, *def.Minimum)
+		}
+		if def.Maximum != nil && i > *def.Maximum {
+			return fail("%d is greater than maximum %d", i, *def.Maximum)
+		}
+		if !matchesEnum(def, n.String()) {
+			return fail("%d is not one of allowed values", i)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fail("expected a string")
+		}
+		return c.validateString(path, def, s)
+	case "bytes":
+		b, ok := dagJSONBytes(value)
+		if !ok {
+			return fail("expected bytes")
+		}
+		if def.MinLength != nil && len(b) < *def.MinLength {
+			return fail("shorter than %d bytes", *def.MinLength)
+		}
+		if def.MaxLength != nil && len(b) > *def.MaxLength {
+			return fail("longer than %d bytes", *def.MaxLength)
+		}
+	case "cid-link":
+		if _, ok := dagJSONLink(value); !ok {
+			return fail("expected a CID link")
+		}
+	case "blob":
+		return validateBlob(path, def, value)
+	case "unknown":
+		if _, ok := value.(map[string]any); !ok {
+			return fail("expected an object")
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			return fail("expected an array")
+		}
+		if def.MinLength != nil && len(arr) < *def.MinLength {
+			return fail("has less than %d items", *def.MinLength)
+		}
+		if def.MaxLength != nil && len(arr) > *def.MaxLength {
+			return fail("has more than %d items", *def.MaxLength)
+		}
+		if def.Items == nil {
+			return nil
+		}
+		for i, item := range arr {
+			if err := c.validate(fmt.Sprintf("%s[%d]", path, i), def.Items, item); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fail("expected an object")
+		}
+		for _, name := range def.Required {
+			if _, found := obj[name]; !found {
+				return &Error{Path: join(path, name), Message: "missing required field"}
+			}
+		}
+		// Sorted for the reported error to not depend on map order.
+		names := make([]string, 0, len(def.Properties))
+		for name := range def.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop := def.Properties[name]
+			v, found := obj[name]
+			if !found || prop == nil {
+				continue
+			}
+			if v == nil && slices.Contains(def.Nullable, name) {
+				continue
+			}
+			if err := c.validate(join(path, name), prop, v); err != nil {
+				return err
+			}
+		}
+	case "ref":
+		ref := c.lookup(def.Ref)
+		if ref == nil {
+			return fail("unknown schema %q", def.Ref)
+		}
+		return c.validate(path, ref, value)
+	case "union":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fail("expected an object")
+		}
+		typ, ok := obj["$type"].(string)
+		if !ok {
+			return &Error{Path: join(path, "$type"), Message: "missing or not a string"}
+		}
+		name := qualify("", typ)
+		listed := slices.Contains(def.Refs, name)
+		if !listed && def.Closed {
+			return fail("$type %q is not allowed here", typ)
+		}
+		// Open unions can contain anything, but the value is still
+		// checked if the type is known.
+		ref := c.lookup(name)
+		if ref == nil {
+			if listed {
+				return fail("unknown schema %q", typ)
+			}
+			return nil
+		}
+		return c.validate(path, ref, value)
+	case "record":
+		if def.Record == nil {
+			return nil
+		}
+		return c.validate(path, def.Record, value)
+	default:
+		// Tokens and non-data types can't describe a value. Treat them
+		// as a broken schema rather than a broken record.
+		return nil
+	}
+	return nil
+}
+
+func (c *Catalog) validateString(path string, def *Def, s string) error {
+	fail := func(format string, args ...any) error {
+		return &Error{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	// Lengths are in bytes of the UTF-8 encoding.
+	if def.MinLength != nil && len(s) < *def.MinLength {
+		return fail("shorter than %d bytes", *def.MinLength)
+	}
+	if def.MaxLength != nil && len(s) > *def.MaxLength {
+		return fail("longer than %d bytes", *def.MaxLength)
+	}
+	if def.MinGraphemes != nil || def.MaxGraphemes != nil {
+		n := uniseg.GraphemeClusterCount(s)
+		if def.MinGraphemes != nil && n < *def.MinGraphemes {
+			return fail("shorter than %d graphemes", *def.MinGraphemes)
+		}
+		if def.MaxGraphemes != nil && n > *def.MaxGraphemes {
+			return fail("longer than %d graphemes", *def.MaxGraphemes)
+		}
+	}
+	if !matchesEnum(def, s) {
+		return fail("%q is not one of allowed values", s)
+	}
+	if def.Format != "" {
+		if err := checkFormat(def.Format, s); err != nil {
+			return fail("invalid %s: %s", def.Format, err)
+		}
+	}
+	return nil
+}
+
+func checkFormat(format string, s string) error {
+	var err error
+	switch format {
+	case "datetime":
+		// Plenty of older records have timestamps that only loosely
+		// follow the spec, but are still usable.
+		_, err = syntax.ParseDatetimeLenient(s)
+	case "uri":
+		_, err = syntax.ParseURI(s)
+	case "at-uri":
+		_, err = syntax.ParseATURI(s)
+	case "did":
+		_, err = syntax.ParseDID(s)
+	case "handle":
+		_, err = syntax.ParseHandle(s)
+	case "at-identifier":
+		_, err = syntax.ParseAtIdentifier(s)
+	case "nsid":
+		_, err = syntax.ParseNSID(s)
+	case "cid":
+		_, err = syntax.ParseCID(s)
+	case "language":
+		_, err = syntax.ParseLanguage(s)
+	case "tid":
+		_, err = syntax.ParseTID(s)
+	case "record-key":
+		_, err = syntax.ParseRecordKey(s)
+	}
+	return err
+}
+
+// matchesEnum checks the value against enum and const of the definition.
+// Values are compared in their string form, which works for both strings
+// and integers.
+func matchesEnum(def *Def, value string) bool {
+	if def.Const != nil && fmt.Sprint(def.Const) != value {
+		return false
+	}
+	if len(def.Enum) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(def.Enum, func(v any) bool { return fmt.Sprint(v) == value })
+}
+
+func validateBlob(path string, def *Def, value any) error {
+	fail := func(format string, args ...any) error {
+		return &Error{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return fail("expected a blob")
+	}
+	mimeType, ok := obj["mimeType"].(string)
+	if !ok || mimeType == "" {
+		return fail("blob is missing mimeType")
+	}
+	if len(def.Accept) > 0 && !slices.ContainsFunc(def.Accept, func(pattern string) bool {
+		prefix, isGlob := strings.CutSuffix(pattern, "*")
+		if isGlob {
+			return strings.HasPrefix(mimeType, prefix)
+		}
+		return mimeType == pattern
+	}) {
+		return fail("blob type %q is not accepted", mimeType)
+	}
+
+	if obj["$type"] != "blob" {
+		// Legacy blob format, with just a CID string and a MIME type.
+		if s, ok := obj["cid"].(string); !ok {
+			return fail("expected a blob")
+		} else if _, err := syntax.ParseCID(s); err != nil {
+			return fail("invalid blob CID: %s", err)
+		}
+		return nil
+	}
+	if _, ok := dagJSONLink(obj["ref"]); !ok {
+		return fail("blob is missing ref")
+	}
+	size, ok := obj["size"].(json.Number)
+	if !ok {
+		return fail("blob is missing size")
+	}
+	n, err := strconv.ParseInt(size.String(), 10, 64)
+	if err != nil || n < 0 {
+		return fail("invalid blob size %s", size)
+	}
+	if def.MaxSize != nil && n > *def.MaxSize {
+		return fail("blob size %d is larger than %d", n, *def.MaxSize)
+	}
+	return nil
+}
+
+// dagJSONLink extracts a CID from its DAG-JSON form {"/": "<cid>"}.
+func dagJSONLink(value any) (string, bool) {
+	obj, ok := value.(map[string]any)
+	if !ok || len(obj) != 1 {
+		return "", false
+	}
+	s, ok := obj["/"].(string)
+	if !ok {
+		return "", false
+	}
+	if _, err := syntax.ParseCID(s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// dagJSONBytes decodes bytes from their DAG-JSON form {"/": {"bytes": "<base64>"}}.
+func dagJSONBytes(value any) ([]byte, bool) {
+	obj, ok := value.(map[string]any)
+	if !ok || len(obj) != 1 {
+		return nil, false
+	}
+	inner, ok := obj["/"].(map[string]any)
+	if !ok || len(inner) != 1 {
+		return nil, false
+	}
+	s, ok := inner["bytes"].(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,315 @@
+// Package admin implements HTTP endpoints for managing PDSs, shared by
+// the services that work with them.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/models"
+	"github.com/uabluerail/indexer/pds"
+	"github.com/uabluerail/indexer/util/adminserver"
+)
+
+type handlers struct {
+	db *gorm.DB
+	// Name of the service, recorded in the audit log together with
+	// the name of the authenticated principal.
+	service string
+}
+
+// AddHandlers registers PDS admin endpoints on the admin server.
+func AddHandlers(srv *adminserver.Server, db *gorm.DB, service string) {
+	h := &handlers{db: db, service: service}
+	srv.HandleFunc("/pds/list", adminserver.RoleRead, h.handleList)
+	srv.HandleFunc("/pds/health", adminserver.RoleRead, h.handleHealth)
+	srv.HandleFunc("/pds/disable", adminserver.RoleWrite, h.handleSetDisabled(true))
+	srv.HandleFunc("/pds/enable", adminserver.RoleWrite, h.handleSetDisabled(false))
+	srv.HandleFunc("/pds/relist", adminserver.RoleWrite, h.handleRelist)
+	srv.HandleFunc("/pds/setCursor", adminserver.RoleWrite, h.handleSetCursor)
+	srv.HandleFunc("/pds/setCrawlLimit", adminserver.RoleWrite, h.handleSetCrawlLimit)
+}
+
+type pdsInfo struct {
+	Host                  string    `json:"host"`
+	Disabled              bool      `json:"disabled"`
+	DisabledBy            string    `json:"disabledBy,omitempty"`
+	Cursor                int64     `json:"cursor"`
+	FirstCursorSinceReset int64     `json:"firstCursorSinceReset"`
+	LastEventAt           time.Time `json:"lastEventAt"`
+	// Seconds since the consumer last recorded an event.
+	LagSeconds float64   `json:"lagSeconds,omitempty"`
+	LastList   time.Time `json:"lastList"`
+	// Set if the last listing failed, the next one starts after that.
+	ListRetryAt     *time.Time `json:"listRetryAt,omitempty"`
+	CrawlLimit      int        `json:"crawlLimit"`
+	RepoCount       int64      `json:"repoCount"`
+	LastConnectedAt time.Time  `json:"lastConnectedAt"`
+	// Number of consecutive failures to connect.
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	LastError           string `json:"lastError,omitempty"`
+}
+
+func (h *handlers) handleList(w http.ResponseWriter, r *http.Request) {
+	q := h.db.WithContext(r.Context()).Model(&pds.PDS{}).Order("host")
+	if host := r.FormValue("host"); host != "" {
+		q = q.Where(&pds.PDS{Host: pds.NormalizeHost(host)})
+	}
+	remotes := []pds.PDS{}
+	if err := q.Find(&remotes).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ids := []models.ID{}
+	for _, remote := range remotes {
+		ids = append(ids, remote.ID)
+	}
+	counts := []struct {
+		PDS   models.ID
+		Count int64
+	}{}
+	err := h.db.WithContext(r.Context()).Raw(`select pds, count(*) as count from repos where pds in ? group by pds`, ids).
+		Scan(&counts).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	repoCounts := map[models.ID]int64{}
+	for _, c := range counts {
+		repoCounts[c.PDS] = c.Count
+	}
+
+	resp := []pdsInfo{}
+	for _, remote := range remotes {
+		info := pdsInfo{
+			Host:                  remote.Host,
+			Disabled:              remote.Disabled,
+			DisabledBy:            remote.DisabledBy,
+			Cursor:                remote.Cursor,
+			FirstCursorSinceReset: remote.FirstCursorSinceReset,
+			LastEventAt:           remote.LastEventAt,
+			LastList:              remote.LastList,
+			ListRetryAt:           optionalTime(remote.ListRetryAt),
+			CrawlLimit:            remote.CrawlLimit,
+			RepoCount:             repoCounts[remote.ID],
+			LastConnectedAt:       remote.LastConnectedAt,
+			ConsecutiveFailures:   remote.ConsecutiveFailures,
+			LastError:             remote.LastError,
+		}
+		if !remote.LastEventAt.IsZero() && !remote.Disabled {
+			info.LagSeconds = time.Since(remote.LastEventAt).Seconds()
+		}
+		resp = append(resp, info)
+	}
+	writeJSON(w, resp)
+}
+
+type pdsHealth struct {
+	Host       string `json:"host"`
+	Disabled   bool   `json:"disabled"`
+	DisabledBy string `json:"disabledBy,omitempty"`
+	// Omitted if it never happened.
+	LastConnectedAt     *time.Time `json:"lastConnectedAt,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	DNSStatus           string     `json:"dnsStatus,omitempty"`
+	TLSStatus           string     `json:"tlsStatus,omitempty"`
+	LastProbe           *time.Time `json:"lastProbe,omitempty"`
+}
+
+// optionalTime returns nil for the zero time, so that it's omitted from
+// the JSON output.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (h *handlers) handleHealth(w http.ResponseWriter, r *http.Request) {
+	q := h.db.WithContext(r.Context()).Model(&pds.PDS{}).Order("host")
+	if host := r.FormValue("host"); host != "" {
+		q = q.Where(&pds.PDS{Host: pds.NormalizeHost(host)})
+	}
+	if r.FormValue("unhealthy") != "" {
+		q = q.Where("consecutive_failures > 0 or disabled_by = ?", pds.DisabledByHealth)
+	}
+
+	remotes := []pds.PDS{}
+	if err := q.Find(&remotes).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := []pdsHealth{}
+	for _, remote := range remotes {
+		resp = append(resp, pdsHealth{
+			Host:                remote.Host,
+			Disabled:            remote.Disabled,
+			DisabledBy:          remote.DisabledBy,
+			LastConnectedAt:     optionalTime(remote.LastConnectedAt),
+			ConsecutiveFailures: remote.ConsecutiveFailures,
+			LastError:           remote.LastError,
+			DNSStatus:           remote.DNSStatus,
+			TLSStatus:           remote.TLSStatus,
+			LastProbe:           optionalTime(remote.LastProbe),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// getPDS checks that the request is a POST and looks up the PDS
+// specified in it. On failure it writes the response and returns nil.
+func (h *handlers) getPDS(w http.ResponseWriter, r *http.Request) *pds.PDS {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return nil
+	}
+	host := r.FormValue("host")
+	if host == "" {
+		http.Error(w, "need host", http.StatusBadRequest)
+		return nil
+	}
+	remote := &pds.PDS{}
+	err := h.db.WithContext(r.Context()).Model(remote).Where(&pds.PDS{Host: pds.NormalizeHost(host)}).Take(remote).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "PDS not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return remote
+}
+
+func (h *handlers) handleSetDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		remote := h.getPDS(w, r)
+		if remote == nil {
+			return
+		}
+		if !disabled {
+			if d := pds.CheckPolicy(r.Context(), remote.Host); !d.Allowed {
+				http.Error(w, fmt.Sprintf("host %q is not allowed (%s)", remote.Host, d.Reason()), http.StatusForbidden)
+				return
+			}
+		}
+
+		by := pds.DisabledByAdmin
+		if !disabled {
+			by = ""
+		}
+		changed, err := pds.SetDisabled(r.Context(), h.db, remote, disabled, by, adminserver.Actor(r.Context(), h.service), h.details(r, r.FormValue("reason")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !changed {
+			fmt.Fprintln(w, "OK, nothing changed")
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// handleRelist makes the lister list repos of the PDS again, from scratch.
+// A pass that is already running notices the reset when it next saves
+// its progress, and stops.
+func (h *handlers) handleRelist(w http.ResponseWriter, r *http.Request) {
+	remote := h.getPDS(w, r)
+	if remote == nil {
+		return
+	}
+	h.update(w, r, remote, "pds.relist", map[string]any{
+		"last_list":         nil,
+		"list_retry_at":     nil,
+		"list_started_at":   nil,
+		"list_cursor":       "",
+		"list_repos_seen":   0,
+		"list_repos_failed": 0,
+	}, "")
+}
+
+// handleSetCursor changes the firehose cursor. Without the cursor
+// parameter the cursor is reset, and the consumer starts from the
+// current position of the firehose.
+func (h *handlers) handleSetCursor(w http.ResponseWriter, r *http.Request) {
+	remote := h.getPDS(w, r)
+	if remote == nil {
+		return
+	}
+	cursor := int64(0)
+	if s := r.FormValue("cursor"); s != "" {
+		var err error
+		cursor, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || cursor < 0 {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	h.update(w, r, remote, "pds.setCursor", map[string]any{"cursor": cursor},
+		fmt.Sprintf("cursor %d -> %d", remote.Cursor, cursor))
+}
+
+func (h *handlers) handleSetCrawlLimit(w http.ResponseWriter, r *http.Request) {
+	remote := h.getPDS(w, r)
+	if remote == nil {
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 0 {
+		http.Error(w, "need non-negative limit", http.StatusBadRequest)
+		return
+	}
+	h.update(w, r, remote, "pds.setCrawlLimit", map[string]any{"crawl_limit": limit},
+		fmt.Sprintf("crawl limit %d -> %d", remote.CrawlLimit, limit))
+}
+
+// update applies the changes to the PDS row, records them in the audit log
+// and notifies other services, all in one transaction.
+func (h *handlers) update(w http.ResponseWriter, r *http.Request, remote *pds.PDS, action string, updates map[string]any, details string) {
+	ctx := r.Context()
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&pds.PDS{}).Where(&pds.PDS{ID: remote.ID}).Updates(updates).Error; err != nil {
+			return err
+		}
+		err := audit.Record(ctx, tx, audit.Entry{
+			Actor:   adminserver.Actor(ctx, h.service),
+			Action:  action,
+			Target:  remote.Host,
+			Details: h.details(r, details),
+		})
+		if err != nil {
+			return err
+		}
+		return pds.NotifyChanged(ctx, tx, remote.Host)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func (h *handlers) details(r *http.Request, details string) string {
+	if details == "" {
+		return fmt.Sprintf("requested from %s", r.RemoteAddr)
+	}
+	return fmt.Sprintf("%s (requested from %s)", details, r.RemoteAddr)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
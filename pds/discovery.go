@@ -0,0 +1,82 @@
+package pds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/uabluerail/indexer/models"
+)
+
+// Values of Source.Source
+const (
+	SourceJetstream = "jetstream"
+	SourceRelay     = "relay"
+	SourcePLC       = "plc"
+	SourceManual    = "manual"
+)
+
+// Source records how a PDS was discovered. A PDS can have multiple sources,
+// CreatedAt is the first time the PDS was seen by the given source.
+type Source struct {
+	ID        models.ID `gorm:"primarykey"`
+	CreatedAt time.Time
+	PDS       models.ID `gorm:"uniqueIndex:idx_pds_source,priority:1"`
+	Source    string    `gorm:"uniqueIndex:idx_pds_source,priority:2"`
+}
+
+func (Source) TableName() string {
+	return "pds_sources"
+}
+
+// DiscoveryCursor stores progress of a discovery source that needs it, so it
+// can resume after a restart.
+type DiscoveryCursor struct {
+	Source    string `gorm:"primarykey"`
+	UpdatedAt time.Time
+	Cursor    string
+}
+
+func (DiscoveryCursor) TableName() string {
+	return "pds_discovery_cursors"
+}
+
+// RecordDiscovery ensures that the PDS exists and records the source
+// it was discovered from.
+func RecordDiscovery(ctx context.Context, db *gorm.DB, host string, source string) (*PDS, error) {
+	remote, err := EnsureExists(ctx, db, host)
+	if err != nil {
+		return nil, err
+	}
+	err = db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&Source{PDS: remote.ID, Source: source}).Error
+	if err != nil {
+		return nil, fmt.Errorf("recording discovery source of %q: %w", remote.Host, err)
+	}
+	return remote, nil
+}
+
+func GetDiscoveryCursor(ctx context.Context, db *gorm.DB, source string) (string, error) {
+	c := DiscoveryCursor{}
+	err := db.WithContext(ctx).Model(&c).Where(&DiscoveryCursor{Source: source}).Take(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("querying cursor for %q: %w", source, err)
+	}
+	return c.Cursor, nil
+}
+
+func SetDiscoveryCursor(ctx context.Context, db *gorm.DB, source string, cursor string) error {
+	err := db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&DiscoveryCursor{Source: source, Cursor: cursor}).Error
+	if err != nil {
+		return fmt.Errorf("updating cursor for %q: %w", source, err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package pds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// A PDS gets disabled once it has failed this many times in a row and we
+// haven't been able to talk to it for at least HealthMinDowntime.
+const (
+	HealthFailureThreshold = 20
+	HealthMinDowntime      = 24 * time.Hour
+)
+
+// Values of PDS.DNSStatus and PDS.TLSStatus
+const (
+	StatusOK       = "ok"
+	StatusNotFound = "not_found"
+	StatusInvalid  = "invalid"
+	StatusError    = "error"
+)
+
+// RecordSuccess marks the PDS as reachable.
+func RecordSuccess(ctx context.Context, db *gorm.DB, remote *PDS) error {
+	now := time.Now()
+	err := db.WithContext(ctx).Model(&PDS{}).Where("id = ?", remote.ID).
+		Updates(map[string]any{
+			"last_connected_at":    now,
+			"consecutive_failures": 0,
+			"last_error":           "",
+			"dns_status":           StatusOK,
+			"tls_status":           tlsStatusOnSuccess(remote.Host),
+		}).Error
+	if err != nil {
+		return fmt.Errorf("updating health status of %q: %w", remote.Host, err)
+	}
+	remote.LastConnectedAt = now
+	remote.ConsecutiveFailures = 0
+	remote.LastError = ""
+	return nil
+}
+
+// RecordFailure updates health status of the PDS after a failed attempt to
+// talk to it, and disables the PDS if it looks dead.
+func RecordFailure(ctx context.Context, db *gorm.DB, remote *PDS, failure error, actor string) error {
+	dnsStatus, tlsStatus := classifyError(failure)
+
+	updates := map[string]any{
+		"consecutive_failures": gorm.Expr("coalesce(consecutive_failures, 0) + 1"),
+		"last_error":           failure.Error(),
+	}
+	if dnsStatus != "" {
+		updates["dns_status"] = dnsStatus
+	}
+	if tlsStatus != "" {
+		updates["tls_status"] = tlsStatus
+	}
+
+	// Not reading into `remote` directly, since the caller might have some
+	// fields (e.g., cursor) that are more up to date than what's in the DB.
+	current := PDS{}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&PDS{}).Where("id = ?", remote.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Model(&PDS{}).Where("id = ?", remote.ID).Take(&current).Error
+	})
+	if err != nil {
+		return fmt.Errorf("updating health status of %q: %w", remote.Host, err)
+	}
+	remote.ConsecutiveFailures = current.ConsecutiveFailures
+	remote.LastError = current.LastError
+	remote.DNSStatus = current.DNSStatus
+	remote.TLSStatus = current.TLSStatus
+
+	if current.Disabled || current.ConsecutiveFailures < HealthFailureThreshold {
+		return nil
+	}
+	lastAlive := current.LastConnectedAt
+	if lastAlive.IsZero() || lastAlive.Before(current.CreatedAt) {
+		lastAlive = current.CreatedAt
+	}
+	if time.Since(lastAlive) < HealthMinDowntime {
+		return nil
+	}
+
+	reason := fmt.Sprintf("%d consecutive failures, last successful connection at %s, last error: %s",
+		current.ConsecutiveFailures, current.LastConnectedAt.Format(time.RFC3339), current.LastError)
+	zerolog.Ctx(ctx).Warn().Msgf("PDS %q looks dead, disabling it: %s", remote.Host, reason)
+	_, err = SetDisabled(ctx, db, remote, true, DisabledByHealth, actor, reason)
+	return err
+}
+
+// Probe checks if the PDS is up by resolving its hostname and calling
+// /xrpc/_health endpoint.
+func Probe(ctx context.Context, client *http.Client, host string) error {
+	_, err := getHealth(ctx, client, host)
+	return err
+}
+
+type healthResponse struct {
+	Version string `json:"version"`
+}
+
+func getHealth(ctx context.Context, client *http.Client, host string) (*healthResponse, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL %q: %w", host, err)
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return nil, fmt.Errorf("resolving %q: %w", u.Hostname(), err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath("xrpc", "_health").String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", req.URL, resp.StatusCode)
+	}
+
+	r := &healthResponse{}
+	// Not all implementations return a JSON body, and for the purposes of
+	// checking if the PDS is up we don't really care.
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(r)
+	return r, nil
+}
+
+func tlsStatusOnSuccess(host string) string {
+	if strings.HasPrefix(host, "https://") {
+		return StatusOK
+	}
+	return ""
+}
+
+// classifyError returns DNS and TLS status values implied by the error.
+// Empty string means that the error doesn't tell anything about the
+// corresponding status.
+func classifyError(err error) (dnsStatus string, tlsStatus string) {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return StatusNotFound, ""
+		}
+		return StatusError, ""
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var unknownAuthErr x509.UnknownAuthorityError
+	if errors.As(err, &certErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &unknownAuthErr) {
+		return StatusOK, StatusInvalid
+	}
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		return StatusOK, StatusError
+	}
+
+	// Some HTTP clients don't wrap the underlying errors, so fall back to
+	// looking at the message.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no such host"):
+		return StatusNotFound, ""
+	case strings.Contains(msg, "x509: "), strings.Contains(msg, "tls: failed to verify"):
+		return StatusOK, StatusInvalid
+	case strings.Contains(msg, "tls: "):
+		return StatusOK, StatusError
+	}
+	return "", ""
+}
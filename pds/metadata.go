@@ -0,0 +1,128 @@
+package pds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/uabluerail/indexer/models"
+)
+
+// Metadata is a snapshot of what a PDS tells about itself via
+// com.atproto.server.describeServer and /xrpc/_health. A new row is added
+// only when something changes, so the table contains the history of
+// changes for each PDS.
+type Metadata struct {
+	ID        models.ID `gorm:"primarykey"`
+	CreatedAt time.Time
+	// Last time this snapshot was confirmed to be current.
+	CheckedAt                 time.Time
+	PDS                       models.ID `gorm:"index:idx_pds_metadata_pds_id,priority:1"`
+	Healthy                   bool
+	Version                   string
+	DID                       string `gorm:"column:did"`
+	InviteCodeRequired        bool
+	PhoneVerificationRequired bool
+	AvailableUserDomains      json.RawMessage `gorm:"type:JSONB"`
+	Links                     json.RawMessage `gorm:"type:JSONB"`
+	Contact                   json.RawMessage `gorm:"type:JSONB"`
+	Error                     string
+}
+
+func (Metadata) TableName() string {
+	return "pds_metadata"
+}
+
+// FetchMetadata queries the PDS for its metadata. Errors are recorded in the
+// returned value instead of being returned.
+func FetchMetadata(ctx context.Context, client *xrpc.Client, remote *PDS) *Metadata {
+	r := &Metadata{PDS: remote.ID}
+	errs := []error{}
+
+	httpClient := client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	health, err := getHealth(ctx, httpClient, remote.Host)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("_health: %w", err))
+	} else {
+		r.Healthy = true
+		r.Version = health.Version
+	}
+
+	desc, err := comatproto.ServerDescribeServer(ctx, client)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("describeServer: %w", err))
+	} else {
+		r.DID = desc.Did
+		r.InviteCodeRequired = desc.InviteCodeRequired != nil && *desc.InviteCodeRequired
+		r.PhoneVerificationRequired = desc.PhoneVerificationRequired != nil && *desc.PhoneVerificationRequired
+		r.AvailableUserDomains, _ = json.Marshal(desc.AvailableUserDomains)
+		if desc.Links != nil {
+			r.Links, _ = json.Marshal(desc.Links)
+		}
+		if desc.Contact != nil {
+			r.Contact, _ = json.Marshal(desc.Contact)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// StoreMetadata adds a new metadata row if anything has changed since the
+// last one, otherwise just bumps CheckedAt of the latest row.
+func StoreMetadata(ctx context.Context, db *gorm.DB, m *Metadata) error {
+	m.CheckedAt = time.Now()
+
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		last := Metadata{}
+		err := tx.Model(&last).Where(&Metadata{PDS: m.PDS}).Order("id desc").Take(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("querying latest metadata: %w", err)
+		}
+		if err == nil && last.sameAs(m) {
+			return tx.Model(&last).Where(&Metadata{ID: last.ID}).Updates(&Metadata{CheckedAt: m.CheckedAt}).Error
+		}
+		return tx.Create(m).Error
+	})
+}
+
+func (m *Metadata) sameAs(other *Metadata) bool {
+	return m.Healthy == other.Healthy &&
+		m.Version == other.Version &&
+		m.DID == other.DID &&
+		m.InviteCodeRequired == other.InviteCodeRequired &&
+		m.PhoneVerificationRequired == other.PhoneVerificationRequired &&
+		jsonEqual(m.AvailableUserDomains, other.AvailableUserDomains) &&
+		jsonEqual(m.Links, other.Links) &&
+		jsonEqual(m.Contact, other.Contact) &&
+		m.Error == other.Error
+}
+
+// jsonEqual compares two JSON values, ignoring the formatting differences
+// that are introduced by JSONB.
+func jsonEqual(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return bytes.Equal(ca, cb)
+}
@@ -0,0 +1,75 @@
+package pds
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// Postgres channel that receives the host of a PDS whenever its settings
+// are changed by an operator, so that services can react right away
+// instead of waiting for their next periodic refresh.
+const changesChannel = "pds_changed"
+
+// NotifyChanged tells all listening services that the PDS row was changed.
+// When called inside a transaction, the notification is delivered on commit.
+func NotifyChanged(ctx context.Context, db *gorm.DB, host string) error {
+	if err := db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", changesChannel, host).Error; err != nil {
+		return fmt.Errorf("sending change notification for %q: %w", host, err)
+	}
+	return nil
+}
+
+// ListenForChanges returns a channel that receives hosts of changed PDSs.
+// Connection failures are retried until ctx is done, at which point the
+// channel is closed.
+func ListenForChanges(ctx context.Context, pool *pgxpool.Pool) <-chan string {
+	ch := make(chan string, 100)
+	go func() {
+		defer close(ch)
+		log := zerolog.Ctx(ctx)
+		for {
+			err := listenOnce(ctx, pool, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msgf("Listening for PDS changes failed (will be restarted): %s", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+	return ch
+}
+
+func listenOnce(ctx context.Context, pool *pgxpool.Pool, ch chan<- string) error {
+	pooled, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	// The connection will have LISTEN state attached to it,
+	// so take it out of the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return fmt.Errorf("LISTEN: %w", err)
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+		case ch <- n.Payload:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -3,10 +3,12 @@ package pds
 import (
 	"context"
 	"fmt"
-	"path/filepath"
+	"net"
+	"net/url"
 	"strings"
 	"time"
 
+	"golang.org/x/net/idna"
 	"gorm.io/gorm"
 
 	"github.com/uabluerail/indexer/models"
@@ -14,11 +16,12 @@ import (
 
 const Unknown models.ID = 0
 
-var whitelist []string = []string{
-	"https://bsky.social",
-	"https://*.bsky.network",
-	"https://*",
-}
+// Values of PDS.DisabledBy
+const (
+	DisabledByPolicy = "policy"
+	DisabledByHealth = "health"
+	DisabledByAdmin  = "admin"
+)
 
 type PDS struct {
 	ID                    models.ID `gorm:"primarykey"`
@@ -30,20 +33,65 @@ type PDS struct {
 	LastList              time.Time
 	CrawlLimit            int
 	Disabled              bool `gorm:"default:false"`
+	DisabledBy            string
+
+	// State of the current listRepos pass, used to resume it after
+	// interruption. ListCursor is empty when no pass is in progress.
+	ListCursor      string
+	ListStartedAt   time.Time
+	ListReposSeen   int64 `gorm:"default:0"`
+	ListReposFailed int64 `gorm:"default:0"`
+	// Set after a failed pass, the next one isn't started before that.
+	ListRetryAt time.Time
+
+	// Health status, see health.go
+	LastConnectedAt     time.Time
+	LastEventAt         time.Time
+	ConsecutiveFailures int `gorm:"default:0"`
+	LastError           string
+	DNSStatus           string `gorm:"column:dns_status"`
+	TLSStatus           string `gorm:"column:tls_status"`
+	LastProbe           time.Time
 }
 
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&PDS{})
+	return db.AutoMigrate(&PDS{}, &Rule{}, &Metadata{}, &Source{}, &DiscoveryCursor{})
 }
 
+// NormalizeHost converts a PDS URL into canonical form: lowercase scheme and
+// hostname, IDNs converted to punycode, default port removed, and without
+// path, query or fragment.
 func NormalizeHost(host string) string {
-	return strings.TrimRight(host, "/")
+	u, err := url.Parse(strings.TrimSpace(host))
+	if err != nil || u.Host == "" {
+		return strings.TrimRight(host, "/")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	hostname := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if ascii, err := idna.Lookup.ToASCII(hostname); err == nil {
+		hostname = ascii
+	}
+
+	port := u.Port()
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		port = ""
+	}
+
+	if port != "" {
+		return scheme + "://" + net.JoinHostPort(hostname, port)
+	}
+	if strings.Contains(hostname, ":") {
+		// IPv6 address
+		return scheme + "://[" + hostname + "]"
+	}
+	return scheme + "://" + hostname
 }
 
 func EnsureExists(ctx context.Context, db *gorm.DB, host string) (*PDS, error) {
 	host = NormalizeHost(host)
-	if !IsWhitelisted(host) {
-		return nil, fmt.Errorf("host %q is not whitelisted", host)
+	if d := CheckPolicy(ctx, host); !d.Allowed {
+		return nil, fmt.Errorf("host %q is not allowed (%s)", host, d.Reason())
 	}
 	remote := PDS{Host: host}
 	if err := db.Model(&remote).Where(&PDS{Host: host}).FirstOrCreate(&remote).Error; err != nil {
@@ -51,13 +99,3 @@ func EnsureExists(ctx context.Context, db *gorm.DB, host string) (*PDS, error) {
 	}
 	return &remote, nil
 }
-
-func IsWhitelisted(host string) bool {
-	host = NormalizeHost(host)
-	for _, p := range whitelist {
-		if match, _ := filepath.Match(p, host); match {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,35 @@
+package pds
+
+import (
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	type testCase struct{ input, want string }
+
+	cases := []testCase{
+		{"https://bsky.social", "https://bsky.social"},
+		{"https://bsky.social/", "https://bsky.social"},
+		{"https://PDS.Example.com", "https://pds.example.com"},
+		{"HTTPS://pds.example.com", "https://pds.example.com"},
+		{"https://pds.example.com:443", "https://pds.example.com"},
+		{"https://pds.example.com:8443/", "https://pds.example.com:8443"},
+		{"http://pds.example.com:80", "http://pds.example.com"},
+		{"http://pds.example.com:443", "http://pds.example.com:443"},
+		{"https://pds.example.com/xrpc/", "https://pds.example.com"},
+		{"https://pds.example.com/?foo=bar#baz", "https://pds.example.com"},
+		{"https://pds.example.com.", "https://pds.example.com"},
+		{"https://пдс.example.com", "https://xn--d1avh.example.com"},
+		{"https://xn--d1avh.example.com", "https://xn--d1avh.example.com"},
+		{"https://[2001:DB8::1]:443", "https://[2001:db8::1]"},
+		{"https://[2001:db8::1]:8080", "https://[2001:db8::1]:8080"},
+		{"https://127.0.0.1:2583", "https://127.0.0.1:2583"},
+	}
+
+	for _, tc := range cases {
+		got := NormalizeHost(tc.input)
+		if got != tc.want {
+			t.Errorf("NormalizeHost(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
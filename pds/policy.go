@@ -0,0 +1,361 @@
+package pds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/audit"
+	"github.com/uabluerail/indexer/models"
+)
+
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Rule is a single entry of the PDS policy. Exactly one of Pattern or CIDR
+// must be set. Pattern is matched against the whole normalized host URL
+// using filepath.Match syntax, CIDR is matched against the IP addresses
+// the host resolves to.
+type Rule struct {
+	ID        models.ID `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Priority  int       `gorm:"default:0" json:"-"`
+	Action    Action    `json:"action"`
+	Pattern   string    `json:"pattern,omitempty"`
+	CIDR      string    `gorm:"column:cidr" json:"cidr,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+func (Rule) TableName() string {
+	return "pds_policy_rules"
+}
+
+var defaultRules = []Rule{
+	{Action: Allow, Pattern: "https://bsky.social"},
+	{Action: Allow, Pattern: "https://*.bsky.network"},
+	{Action: Allow, Pattern: "https://*"},
+}
+
+type compiledRule struct {
+	Rule
+	network *net.IPNet
+}
+
+// Policy is an ordered list of rules. The first matching rule decides if
+// a host is allowed, hosts that don't match any rule are denied.
+type Policy struct {
+	rules []compiledRule
+
+	// Cache of resolved addresses, to avoid a DNS lookup on every evaluation.
+	addrCache sync.Map
+}
+
+const addrCacheTTL = 10 * time.Minute
+
+// Maximum number of hosts evaluated at the same time by ReevaluateAll.
+const reevaluateConcurrency = 50
+
+type cachedAddrs struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+type Decision struct {
+	Allowed bool
+	Rule    *Rule
+}
+
+func (d Decision) Reason() string {
+	if d.Rule == nil {
+		return "no matching policy rule"
+	}
+	what := d.Rule.Pattern
+	if d.Rule.CIDR != "" {
+		what = d.Rule.CIDR
+	}
+	if d.Rule.Reason == "" {
+		return fmt.Sprintf("%s %s", d.Rule.Action, what)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Rule.Action, what, d.Rule.Reason)
+}
+
+func NewPolicy(rules []Rule) (*Policy, error) {
+	p := &Policy{}
+	for i, r := range rules {
+		if r.Action != Allow && r.Action != Deny {
+			return nil, fmt.Errorf("rule %d: invalid action %q", i, r.Action)
+		}
+		if (r.Pattern == "") == (r.CIDR == "") {
+			return nil, fmt.Errorf("rule %d: exactly one of pattern or cidr must be specified", i)
+		}
+		c := compiledRule{Rule: r}
+		if r.Pattern != "" {
+			if _, err := filepath.Match(r.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i, r.Pattern, err)
+			}
+		} else {
+			_, network, err := net.ParseCIDR(r.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid CIDR %q: %w", i, r.CIDR, err)
+			}
+			c.network = network
+		}
+		p.rules = append(p.rules, c)
+	}
+	return p, nil
+}
+
+func (p *Policy) Evaluate(ctx context.Context, host string) Decision {
+	host = NormalizeHost(host)
+
+	var addrs []net.IP
+	resolved := false
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.network == nil {
+			if match, _ := filepath.Match(r.Pattern, host); match {
+				return Decision{Allowed: r.Action == Allow, Rule: &r.Rule}
+			}
+			continue
+		}
+
+		if !resolved {
+			addrs = p.hostAddrs(ctx, host)
+			resolved = true
+		}
+		for _, addr := range addrs {
+			if r.network.Contains(addr) {
+				return Decision{Allowed: r.Action == Allow, Rule: &r.Rule}
+			}
+		}
+	}
+	return Decision{Allowed: false}
+}
+
+func (p *Policy) equal(other *Policy) bool {
+	return slices.EqualFunc(p.rules, other.rules, func(a, b compiledRule) bool {
+		return a.Action == b.Action && a.Pattern == b.Pattern && a.CIDR == b.CIDR && a.Reason == b.Reason
+	})
+}
+
+// hostAddrs returns IP addresses of the host part of the URL. Lookup
+// failures are not reported, CIDR rules just don't match in that case.
+func (p *Policy) hostAddrs(ctx context.Context, host string) []net.IP {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return []net.IP{ip}
+	}
+	if v, ok := p.addrCache.Load(u.Hostname()); ok && time.Now().Before(v.(cachedAddrs).expires) {
+		return v.(cachedAddrs).addrs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	r := []net.IP{}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msgf("Failed to resolve %q for policy evaluation: %s", u.Hostname(), err)
+	}
+	for _, a := range addrs {
+		r = append(r, a.IP)
+	}
+	p.addrCache.Store(u.Hostname(), cachedAddrs{addrs: r, expires: time.Now().Add(addrCacheTTL)})
+	return r
+}
+
+var currentPolicy atomic.Pointer[Policy]
+
+func init() {
+	p, err := NewPolicy(defaultRules)
+	if err != nil {
+		panic(err)
+	}
+	currentPolicy.Store(p)
+}
+
+func CheckPolicy(ctx context.Context, host string) Decision {
+	return currentPolicy.Load().Evaluate(ctx, host)
+}
+
+func IsAllowed(ctx context.Context, host string) bool {
+	return CheckPolicy(ctx, host).Allowed
+}
+
+type policyFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadPolicy builds a policy from the rules stored in the database, followed
+// by the rules from the file (if one is specified). If neither has any rules,
+// the default policy that allows any HTTPS host is used.
+func LoadPolicy(ctx context.Context, db *gorm.DB, file string) (*Policy, error) {
+	rules := []Rule{}
+	if err := db.WithContext(ctx).Order("priority, id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("querying policy rules: %w", err)
+	}
+
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading policy file: %w", err)
+		}
+		f := policyFile{}
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("parsing policy file %q: %w", file, err)
+		}
+		rules = append(rules, f.Rules...)
+	}
+
+	if len(rules) == 0 {
+		rules = defaultRules
+	}
+	return NewPolicy(rules)
+}
+
+// WatchPolicy loads the policy and keeps reloading it in the background.
+// All known PDSs get re-evaluated against it in the background after the
+// first load, and again every time the policy changes.
+func WatchPolicy(ctx context.Context, db *gorm.DB, file string, actor string) error {
+	p, err := LoadPolicy(ctx, db, file)
+	if err != nil {
+		return err
+	}
+	currentPolicy.Store(p)
+
+	go func() {
+		log := zerolog.Ctx(ctx)
+		// CIDR rules need a DNS lookup for every host, so with many PDSs
+		// this can take a while.
+		if err := ReevaluateAll(ctx, db, actor); err != nil {
+			log.Error().Err(err).Msgf("Failed to apply PDS policy: %s", err)
+		}
+
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p, err := LoadPolicy(ctx, db, file)
+				if err != nil {
+					log.Error().Err(err).Msgf("Failed to reload PDS policy (keeping the old one): %s", err)
+					continue
+				}
+				if p.equal(currentPolicy.Load()) {
+					continue
+				}
+				log.Info().Msgf("PDS policy changed, re-evaluating known PDSs...")
+				currentPolicy.Store(p)
+				if err := ReevaluateAll(ctx, db, actor); err != nil {
+					log.Error().Err(err).Msgf("Failed to apply PDS policy: %s", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ReevaluateAll disables PDSs that are denied by the current policy, and
+// re-enables those that were previously disabled by the policy but are
+// allowed now. A failure to update one PDS doesn't stop the rest, all errors
+// are returned together.
+func ReevaluateAll(ctx context.Context, db *gorm.DB, actor string) error {
+	log := zerolog.Ctx(ctx)
+
+	remotes := []PDS{}
+	if err := db.WithContext(ctx).Find(&remotes).Error; err != nil {
+		return fmt.Errorf("querying the list of known PDSs: %w", err)
+	}
+
+	// CIDR rules need a DNS lookup for every host, so do them in parallel.
+	decisions := make([]Decision, len(remotes))
+	sem := make(chan struct{}, reevaluateConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range remotes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			decisions[i] = CheckPolicy(ctx, remotes[i].Host)
+		}(i)
+	}
+	wg.Wait()
+
+	errs := []error{}
+	for i, remote := range remotes {
+		d := decisions[i]
+		switch {
+		case !d.Allowed && !remote.Disabled:
+			log.Info().Msgf("PDS %q is not allowed by the policy (%s), disabling it", remote.Host, d.Reason())
+			if _, err := SetDisabled(ctx, db, &remote, true, DisabledByPolicy, actor, d.Reason()); err != nil {
+				errs = append(errs, fmt.Errorf("disabling %q: %w", remote.Host, err))
+			}
+		case d.Allowed && remote.Disabled && remote.DisabledBy == DisabledByPolicy:
+			log.Info().Msgf("PDS %q is allowed by the policy (%s), enabling it", remote.Host, d.Reason())
+			if _, err := SetDisabled(ctx, db, &remote, false, "", actor, d.Reason()); err != nil {
+				errs = append(errs, fmt.Errorf("enabling %q: %w", remote.Host, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetDisabled changes the Disabled flag of the PDS and writes an audit log
+// entry. Returns false if the flag already had the requested value.
+func SetDisabled(ctx context.Context, db *gorm.DB, remote *PDS, disabled bool, by string, actor string, reason string) (bool, error) {
+	changed := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&PDS{}).
+			Where("id = ? AND disabled IS DISTINCT FROM ?", remote.ID, disabled).
+			Updates(map[string]any{"disabled": disabled, "disabled_by": by})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		changed = true
+		if err := NotifyChanged(ctx, tx, remote.Host); err != nil {
+			return err
+		}
+
+		action := "enable"
+		if disabled {
+			action = "disable"
+		}
+		return audit.Record(ctx, tx, audit.Entry{
+			Actor:   actor,
+			Action:  "pds." + action,
+			Target:  remote.Host,
+			Details: reason,
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("updating PDS %q: %w", remote.Host, err)
+	}
+	remote.Disabled = disabled
+	remote.DisabledBy = by
+	return changed, nil
+}
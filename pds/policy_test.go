@@ -0,0 +1,54 @@
+package pds
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := NewPolicy([]Rule{
+		{Action: Deny, Pattern: "https://*.example.com", Reason: "spam"},
+		{Action: Deny, CIDR: "10.0.0.0/8", Reason: "private network"},
+		{Action: Allow, Pattern: "https://*"},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy: %s", err)
+	}
+
+	type testCase struct {
+		host string
+		want bool
+	}
+
+	cases := []testCase{
+		{"https://bsky.social", true},
+		{"https://bsky.social/", true},
+		{"https://pds.example.com", false},
+		{"https://10.1.2.3", false},
+		{"https://192.168.1.1", true},
+		{"http://bsky.social", false},
+	}
+
+	for _, tc := range cases {
+		got := policy.Evaluate(context.Background(), tc.host)
+		if got.Allowed != tc.want {
+			t.Errorf("Evaluate(%q) = %v (%s), want %v", tc.host, got.Allowed, got.Reason(), tc.want)
+		}
+	}
+}
+
+func TestNewPolicyValidation(t *testing.T) {
+	cases := [][]Rule{
+		{{Action: "maybe", Pattern: "https://*"}},
+		{{Action: Allow}},
+		{{Action: Allow, Pattern: "https://*", CIDR: "10.0.0.0/8"}},
+		{{Action: Deny, CIDR: "10.0.0.0"}},
+		{{Action: Deny, Pattern: "https://["}},
+	}
+
+	for _, rules := range cases {
+		if _, err := NewPolicy(rules); err == nil {
+			t.Errorf("NewPolicy(%+v) succeeded, want an error", rules)
+		}
+	}
+}
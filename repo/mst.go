@@ -21,12 +21,14 @@ import (
 
 var ErrInvalidSignature = fmt.Errorf("commit signature is not valid")
 
-func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[string]json.RawMessage, error) {
+// ExtractRecords returns the records from a repo CAR file as DAG-JSON,
+// along with their CIDs, keyed by "collection/rkey".
+func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[string]json.RawMessage, map[string]cid.Cid, error) {
 	log := zerolog.Ctx(ctx)
 
 	r, err := car.NewCarReader(b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to construct CAR reader: %w", err)
+		return nil, nil, fmt.Errorf("failed to construct CAR reader: %w", err)
 	}
 
 	blocks := map[cid.Cid][]byte{}
@@ -36,11 +38,11 @@ func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[st
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("reading next block: %w", err)
+			return nil, nil, fmt.Errorf("reading next block: %w", err)
 		}
 		c, err := block.Cid().Prefix().Sum(block.RawData())
 		if err != nil {
-			return nil, fmt.Errorf("failed to calculate CID from content")
+			return nil, nil, fmt.Errorf("failed to calculate CID from content")
 		}
 		if c.Equals(block.Cid()) {
 			blocks[block.Cid()] = block.RawData()
@@ -52,7 +54,7 @@ func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[st
 
 	records := map[string]cid.Cid{}
 	if len(r.Header.Roots) == 0 {
-		return nil, fmt.Errorf("CAR has zero roots specified")
+		return nil, nil, fmt.Errorf("CAR has zero roots specified")
 	}
 
 	// https://atproto.com/specs/repository specifies that the first root
@@ -61,19 +63,19 @@ func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[st
 
 	// TODO: verify that a root is a commit record and validate signature
 	if _, found := blocks[root]; !found {
-		return nil, fmt.Errorf("root block is missing")
+		return nil, nil, fmt.Errorf("root block is missing")
 	}
 	valid, err := verifyCommitSignature(ctx, blocks[root], signingKey)
 	if err != nil {
-		return nil, fmt.Errorf("commit signature verification failed: %w", err)
+		return nil, nil, fmt.Errorf("commit signature verification failed: %w", err)
 	}
 	if !valid {
-		return nil, ErrInvalidSignature
+		return nil, nil, ErrInvalidSignature
 	}
 
 	cids, err := findRecords(blocks, root, nil, nil, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for k, v := range cids {
 		records[k] = v
@@ -83,15 +85,15 @@ func ExtractRecords(ctx context.Context, b io.Reader, signingKey string) (map[st
 	for k, c := range records {
 		builder := basicnode.Prototype.Any.NewBuilder()
 		if err := (&dagcbor.DecodeOptions{AllowLinks: true}).Decode(builder, bytes.NewReader(blocks[c])); err != nil {
-			return nil, fmt.Errorf("unmarshaling %q: %w", c.String(), err)
+			return nil, nil, fmt.Errorf("unmarshaling %q: %w", c.String(), err)
 		}
 		w := bytes.NewBuffer(nil)
 		if err := (dagjson.EncodeOptions{EncodeLinks: true, EncodeBytes: true}).Encode(builder.Build(), w); err != nil {
-			return nil, fmt.Errorf("marshaling %q as JSON: %w", c.String(), err)
+			return nil, nil, fmt.Errorf("marshaling %q as JSON: %w", c.String(), err)
 		}
 		res[k] = w.Bytes()
 	}
-	return res, nil
+	return res, records, nil
 }
 
 const maxDepth = 128
@@ -8,12 +8,85 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/uabluerail/indexer/models"
 	"github.com/uabluerail/indexer/pds"
 	"github.com/uabluerail/indexer/util/resolver"
 )
 
+// FetchPriority determines the order in which repos are fetched by the
+// record indexer. Higher values are fetched first.
+type FetchPriority int
+
+const (
+	// Not marked.
+	PriorityDefault FetchPriority = iota
+	// Never fetched successfully. It is not stored in the database: the
+	// record indexer assigns it to repos with PriorityDefault and no
+	// LastIndexedRev when it claims them.
+	PriorityNeverIndexed
+	// PDS cursor was reset, so we might have missed some events.
+	PriorityCursorReset
+	// Commit was too big to be sent over the firehose, or listed rev is
+	// ahead of ours.
+	PriorityTooBig
+	// Requested by an operator.
+	PriorityManual
+)
+
+func (p FetchPriority) String() string {
+	switch p {
+	case PriorityDefault:
+		return "default"
+	case PriorityNeverIndexed:
+		return "never_indexed"
+	case PriorityCursorReset:
+		return "cursor_reset"
+	case PriorityTooBig:
+		return "too_big"
+	case PriorityManual:
+		return "manual"
+	default:
+		return fmt.Sprintf("priority_%d", int(p))
+	}
+}
+
+// Priorities lists all known values of FetchPriority, from highest to lowest.
+var Priorities = []FetchPriority{PriorityManual, PriorityTooBig, PriorityCursorReset, PriorityNeverIndexed, PriorityDefault}
+
+// RaisePriority sets repo's FetchPriority to p, unless it is already higher.
+func RaisePriority(ctx context.Context, db *gorm.DB, id models.ID, p FetchPriority) error {
+	return db.WithContext(ctx).Model(&Repo{}).Where(&Repo{ID: id}).
+		Update("fetch_priority", gorm.Expr("greatest(fetch_priority, ?)", int(p))).Error
+}
+
+// FetchErrorClass is the kind of the last error encountered while fetching a repo.
+type FetchErrorClass string
+
+const (
+	ErrorNone FetchErrorClass = ""
+	// Permanent errors.
+	ErrorNotFound  FetchErrorClass = "not_found"
+	ErrorTakendown FetchErrorClass = "takendown"
+	// Transient errors.
+	ErrorInactive  FetchErrorClass = "inactive"
+	ErrorRateLimit FetchErrorClass = "ratelimit"
+	ErrorTimeout   FetchErrorClass = "timeout"
+	ErrorBadCAR    FetchErrorClass = "bad_car"
+	ErrorOther     FetchErrorClass = "other"
+)
+
+// IsPermanent returns true if retrying the fetch won't help.
+func (c FetchErrorClass) IsPermanent() bool {
+	switch c {
+	case ErrorNotFound, ErrorTakendown:
+		return true
+	default:
+		return false
+	}
+}
+
 type Repo struct {
 	ID                    models.ID `gorm:"primarykey"`
 	CreatedAt             time.Time
@@ -29,6 +102,27 @@ type Repo struct {
 	LastError             string
 	FailedAttempts        int `gorm:"default:0"`
 	LastKnownKey          string
+	// Kind of the last fetch error. Together with FailedAttempts and
+	// LastIndexAttempt determines when the next attempt is made.
+	LastErrorClass FetchErrorClass
+	// Set when fetching failed with a permanent error. Such repos are
+	// not retried, LastErrorClass holds the reason.
+	Terminal   bool `gorm:"default:false"`
+	TerminalAt time.Time
+	// Account status as reported by the PDS in com.atproto.sync.listRepos.
+	AccountActive bool `gorm:"default:true"`
+	AccountStatus string
+	LastListedAt  time.Time
+	// Set when the PDS this repo is attributed to didn't include it in
+	// a complete listing. Such repos need their DID re-resolved, as they
+	// have likely moved or been deleted.
+	MissingFromListing bool `gorm:"default:false;index:idx_missing_from_listing,where:missing_from_listing"`
+	// Record indexer instance that is currently working on this repo.
+	// The lease is extended periodically while the instance is alive.
+	LeaseOwner     string `gorm:"index:idx_repo_lease_owner,where:lease_owner <> ''"`
+	LeaseExpiresAt time.Time
+	// Reset back to PriorityDefault after a successful fetch.
+	FetchPriority FetchPriority `gorm:"default:0;index:idx_repo_fetch_priority,where:fetch_priority > 0"`
 }
 
 type Record struct {
@@ -39,6 +133,7 @@ type Record struct {
 	Collection string          `gorm:"index:idx_repo_record_key,unique,priority:2;not null"`
 	Rkey       string          `gorm:"index:idx_repo_record_key,unique,priority:3"`
 	AtRev      string          `gorm:"index:idx_repo_rev"`
+	CID        string          `gorm:"column:cid"`
 	Content    json.RawMessage `gorm:"type:JSONB"`
 	Deleted    bool            `gorm:"default:false"`
 }
@@ -52,8 +147,66 @@ type BadRecord struct {
 	Content   []byte
 }
 
+// InvalidRecord is the latest version of a record that failed validation
+// against its lexicon. In strict mode such records are stored only here.
+type InvalidRecord struct {
+	ID         models.ID `gorm:"primarykey"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Repo       models.ID `gorm:"index:idx_invalid_record_key,unique,priority:1;not null"`
+	Collection string    `gorm:"index:idx_invalid_record_key,unique,priority:2;not null;index"`
+	Rkey       string    `gorm:"index:idx_invalid_record_key,unique,priority:3"`
+	AtRev      string
+	Content    json.RawMessage `gorm:"type:JSONB"`
+	Error      string
+	// Set if the record was not stored in the records table.
+	Rejected bool
+}
+
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&Repo{}, &Record{}, &BadRecord{})
+	return db.AutoMigrate(&Repo{}, &Record{}, &BadRecord{}, &InvalidRecord{})
+}
+
+// SaveInvalidRecords upserts records into the quarantine table. Content
+// must already be escaped for Postgres.
+func SaveInvalidRecords(ctx context.Context, db *gorm.DB, recs []InvalidRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	return db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "repo"}, {Name: "collection"}, {Name: "rkey"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "at_rev", "content", "error", "rejected"}),
+	}).CreateInBatches(recs, 500).Error
+}
+
+// ClearInvalidRecords deletes quarantined records of the repo, saved at
+// revs up to the given one, for which replaced returns true: those that were
+// deleted or replaced with a valid version since.
+func ClearInvalidRecords(ctx context.Context, db *gorm.DB, repo models.ID, rev string, replaced func(collection string, rkey string) bool) error {
+	// Most repos have none, so checking first is cheaper than deleting
+	// by keys.
+	existing := []InvalidRecord{}
+	err := db.WithContext(ctx).Model(&InvalidRecord{}).
+		Select("id, collection, rkey").
+		Where("repo = ?", repo).
+		Find(&existing).Error
+	if err != nil {
+		return fmt.Errorf("querying invalid records: %w", err)
+	}
+	ids := []models.ID{}
+	for _, r := range existing {
+		if replaced(r.Collection, r.Rkey) {
+			ids = append(ids, r.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	err = db.WithContext(ctx).Where("id in ? and at_rev <= ?", ids, rev).Delete(&InvalidRecord{}).Error
+	if err != nil {
+		return fmt.Errorf("deleting invalid records: %w", err)
+	}
+	return nil
 }
 
 func EnsureExists(ctx context.Context, db *gorm.DB, did string) (*Repo, bool, error) {
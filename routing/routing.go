@@ -0,0 +1,182 @@
+// Package routing decides where records of each collection are stored:
+// in the default store, in a separate Postgres table, without content,
+// or not at all.
+package routing
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+type Action string
+
+const (
+	// Store the record in the default store.
+	Store Action = "store"
+	// Store only the fact that the record exists and its rev, without content.
+	Metadata Action = "metadata"
+	// Don't store the record at all.
+	Drop Action = "drop"
+)
+
+// DefaultTable is the Postgres table records are stored in by default.
+const DefaultTable = "records"
+
+type Route struct {
+	Action Action
+	// If set, the record is stored in this Postgres table instead of the
+	// default store, even when ScyllaDB is used.
+	Table string
+}
+
+type rule struct {
+	pattern *regexp.Regexp
+	route   Route
+}
+
+// Router maps collections to routes. Collections not matching the
+// allow-list, or matching the deny-list, are dropped. Otherwise the first
+// matching rule applies, and if there is none the record is stored in
+// the default store.
+type Router struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+	rules []rule
+
+	// Cached results, there is only a handful of distinct collections.
+	cache sync.Map
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// New creates a router. Allow and deny are lists of NSID patterns, where
+// "*" matches any sequence of characters (e.g. "app.bsky.graph.*").
+// Each route rule has the form "<pattern>=<route>", where route is one of
+// "store", "metadata", "drop" or "table:<name>".
+func New(allow []string, deny []string, rules []string) (*Router, error) {
+	r := &Router{}
+	for _, p := range allow {
+		re, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		r.allow = append(r.allow, re)
+	}
+	for _, p := range deny {
+		re, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		r.deny = append(r.deny, re)
+	}
+	for _, s := range rules {
+		pattern, spec, found := strings.Cut(s, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid route %q: expected <pattern>=<route>", s)
+		}
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		route, err := parseRoute(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", s, err)
+		}
+		r.rules = append(r.rules, rule{pattern: re, route: route})
+	}
+	return r, nil
+}
+
+func compilePattern(p string) (*regexp.Regexp, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return nil, fmt.Errorf("empty collection pattern")
+	}
+	parts := strings.Split(p, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$"), nil
+}
+
+func parseRoute(s string) (Route, error) {
+	switch s := strings.TrimSpace(s); {
+	case s == string(Store), s == string(Metadata), s == string(Drop):
+		return Route{Action: Action(s)}, nil
+	case strings.HasPrefix(s, "table:"):
+		table := strings.TrimPrefix(s, "table:")
+		if !tableNameRegexp.MatchString(table) {
+			return Route{}, fmt.Errorf("invalid table name %q", table)
+		}
+		if table == DefaultTable {
+			return Route{Action: Store}, nil
+		}
+		return Route{Action: Store, Table: table}, nil
+	default:
+		return Route{}, fmt.Errorf("unknown route %q", s)
+	}
+}
+
+func matchAny(patterns []*regexp.Regexp, collection string) bool {
+	return slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool { return re.MatchString(collection) })
+}
+
+// Route returns the route for records in the collection. A nil router
+// stores everything in the default store.
+func (r *Router) Route(collection string) Route {
+	if r == nil {
+		return Route{Action: Store}
+	}
+	if v, ok := r.cache.Load(collection); ok {
+		return v.(Route)
+	}
+	route := r.route(collection)
+	r.cache.Store(collection, route)
+	return route
+}
+
+func (r *Router) route(collection string) Route {
+	if len(r.allow) > 0 && !matchAny(r.allow, collection) {
+		return Route{Action: Drop}
+	}
+	if matchAny(r.deny, collection) {
+		return Route{Action: Drop}
+	}
+	for _, rule := range r.rules {
+		if rule.pattern.MatchString(collection) {
+			return rule.route
+		}
+	}
+	return Route{Action: Store}
+}
+
+// Tables returns the names of all extra tables used by the routes.
+func (r *Router) Tables() []string {
+	if r == nil {
+		return nil
+	}
+	tables := []string{}
+	for _, rule := range r.rules {
+		if rule.route.Table != "" && !slices.Contains(tables, rule.route.Table) {
+			tables = append(tables, rule.route.Table)
+		}
+	}
+	return tables
+}
+
+// CheckTables returns an error if any of the extra tables used by the
+// routes doesn't exist. They are created by update-db-schema.
+func (r *Router) CheckTables(ctx context.Context, db *gorm.DB) error {
+	for _, table := range r.Tables() {
+		if !db.WithContext(ctx).Migrator().HasTable(table) {
+			return fmt.Errorf("table %q doesn't exist, run update-db-schema with the same COLLECTION_ROUTES", table)
+		}
+	}
+	return nil
+}
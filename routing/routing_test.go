@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	type testCase struct {
+		name       string
+		allow      []string
+		deny       []string
+		rules      []string
+		collection string
+		want       Route
+	}
+
+	cases := []testCase{
+		{name: "default", collection: "app.bsky.feed.post", want: Route{Action: Store}},
+		{name: "allowed", allow: []string{"app.bsky.graph.*"},
+			collection: "app.bsky.graph.follow", want: Route{Action: Store}},
+		{name: "not allowed", allow: []string{"app.bsky.graph.*"},
+			collection: "app.bsky.feed.post", want: Route{Action: Drop}},
+		{name: "dot is literal", allow: []string{"app.bsky.graph.*"},
+			collection: "app.bsky.graphxfollow", want: Route{Action: Drop}},
+		{name: "exact allow", allow: []string{"app.bsky.feed.post", "app.bsky.graph.*"},
+			collection: "app.bsky.feed.post", want: Route{Action: Store}},
+		{name: "denied", deny: []string{"app.bsky.feed.like"},
+			collection: "app.bsky.feed.like", want: Route{Action: Drop}},
+		{name: "deny wins over allow", allow: []string{"app.bsky.*"}, deny: []string{"app.bsky.feed.*"},
+			collection: "app.bsky.feed.like", want: Route{Action: Drop}},
+		{name: "metadata", rules: []string{"app.bsky.feed.like=metadata"},
+			collection: "app.bsky.feed.like", want: Route{Action: Metadata}},
+		{name: "table", rules: []string{"app.bsky.graph.*=table:records_graph"},
+			collection: "app.bsky.graph.block", want: Route{Action: Store, Table: "records_graph"}},
+		{name: "default table", rules: []string{"app.bsky.graph.*=table:records"},
+			collection: "app.bsky.graph.block", want: Route{Action: Store}},
+		{name: "first rule wins", rules: []string{"app.bsky.feed.like=drop", "app.bsky.feed.*=metadata"},
+			collection: "app.bsky.feed.like", want: Route{Action: Drop}},
+		{name: "first rule wins 2", rules: []string{"app.bsky.feed.like=drop", "app.bsky.feed.*=metadata"},
+			collection: "app.bsky.feed.repost", want: Route{Action: Metadata}},
+		{name: "rules after allow-list", allow: []string{"app.bsky.graph.*"}, rules: []string{"*=metadata"},
+			collection: "app.bsky.feed.post", want: Route{Action: Drop}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(tc.allow, tc.deny, tc.rules)
+			if err != nil {
+				t.Fatalf("New: %s", err)
+			}
+			// Second call is served from cache.
+			for i := 0; i < 2; i++ {
+				if got := r.Route(tc.collection); !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("Route(%q) = %+v, want %+v", tc.collection, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, rule := range []string{
+		"app.bsky.feed.like",
+		"app.bsky.feed.like=keep",
+		"app.bsky.feed.like=table:",
+		"app.bsky.feed.like=table:Records; drop table records",
+		"=drop",
+	} {
+		if _, err := New(nil, nil, []string{rule}); err == nil {
+			t.Errorf("New(%q) succeeded, expected an error", rule)
+		}
+	}
+}
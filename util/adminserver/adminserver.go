@@ -0,0 +1,237 @@
+// Package adminserver implements a separate HTTP listener for admin and
+// debug endpoints, with authentication by bearer tokens or TLS client
+// certificates.
+package adminserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+type Role string
+
+const (
+	// Can only use endpoints that don't change anything.
+	RoleRead Role = "read"
+	// Can use all endpoints.
+	RoleWrite Role = "write"
+)
+
+func (r Role) allows(required Role) bool {
+	switch r {
+	case RoleWrite:
+		return true
+	case RoleRead:
+		return required == RoleRead
+	default:
+		return false
+	}
+}
+
+// Config is meant to be embedded into service configs, e.g.
+//
+//	Admin adminserver.Config
+//
+// which results in environment variables like LISTER_ADMIN_PORT.
+type Config struct {
+	Port string
+	// JSON file with the list of principals allowed to use the endpoints.
+	TokensFile string `split_words:"true"`
+	// Server certificate and key. If set, the listener uses TLS.
+	TLSCert string `split_words:"true"`
+	TLSKey  string `split_words:"true"`
+	// CA for verifying client certificates. Clients presenting a valid
+	// certificate are identified by its CommonName.
+	ClientCA string `split_words:"true"`
+}
+
+// Principal is someone who can use admin endpoints. Principals with a
+// token authenticate with "Authorization: Bearer <token>", and all
+// principals can authenticate with a client certificate issued for
+// their name.
+type Principal struct {
+	Name  string `json:"name"`
+	Role  Role   `json:"role"`
+	Token string `json:"token,omitempty"`
+}
+
+type tokensFile struct {
+	Principals []Principal `json:"principals"`
+}
+
+type Server struct {
+	config     Config
+	mux        *http.ServeMux
+	principals []Principal
+}
+
+func New(config Config) (*Server, error) {
+	if config.ClientCA != "" && config.TLSCert == "" {
+		// Client certificates can only be checked over TLS, and silently
+		// falling back to plain HTTP would be worse than not starting.
+		return nil, fmt.Errorf("client CA is set, but TLS certificate is not: client certificates require TLS")
+	}
+
+	s := &Server{
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+
+	if config.TokensFile != "" {
+		b, err := os.ReadFile(config.TokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", config.TokensFile, err)
+		}
+		f := tokensFile{}
+		// Empty file is the same as no principals, which allows to
+		// mount /dev/null when none are configured.
+		if len(bytes.TrimSpace(b)) > 0 {
+			if err := json.Unmarshal(b, &f); err != nil {
+				return nil, fmt.Errorf("parsing %q: %w", config.TokensFile, err)
+			}
+		}
+		for _, p := range f.Principals {
+			if p.Name == "" {
+				return nil, fmt.Errorf("%q: principal without a name", config.TokensFile)
+			}
+			if p.Role != RoleRead && p.Role != RoleWrite {
+				return nil, fmt.Errorf("%q: invalid role %q for %q", config.TokensFile, p.Role, p.Name)
+			}
+		}
+		s.principals = f.Principals
+	}
+
+	s.HandleFunc("/debug/pprof/", RoleRead, pprof.Index)
+	s.HandleFunc("/debug/pprof/cmdline", RoleRead, pprof.Cmdline)
+	s.HandleFunc("/debug/pprof/profile", RoleRead, pprof.Profile)
+	s.HandleFunc("/debug/pprof/symbol", RoleRead, pprof.Symbol)
+	s.HandleFunc("/debug/pprof/trace", RoleRead, pprof.Trace)
+	return s, nil
+}
+
+func (s *Server) Handle(pattern string, role Role, handler http.Handler) {
+	s.mux.Handle(pattern, s.authenticate(role, handler))
+}
+
+func (s *Server) HandleFunc(pattern string, role Role, handler http.HandlerFunc) {
+	s.Handle(pattern, role, handler)
+}
+
+type actorKey struct{}
+
+// Actor returns the name of the authenticated principal that made the
+// request, prefixed with the service name, for use in the audit log.
+func Actor(ctx context.Context, service string) string {
+	name, _ := ctx.Value(actorKey{}).(string)
+	if name == "" {
+		return service
+	}
+	return service + ":" + name
+}
+
+func (s *Server) authenticate(required Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.principal(r)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !p.Role.allows(required) {
+			http.Error(w, fmt.Sprintf("%q is not allowed to do this", p.Name), http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), actorKey{}, p.Name)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) principal(r *http.Request) *Principal {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range s.principals {
+			if s.principals[i].Name == name {
+				return &s.principals[i]
+			}
+		}
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil
+	}
+	var match *Principal
+	// Compare with every token to not leak which one matched via timing.
+	for i := range s.principals {
+		p := &s.principals[i]
+		if p.Token != "" && subtle.ConstantTimeCompare([]byte(p.Token), []byte(token)) == 1 {
+			match = p
+		}
+	}
+	return match
+}
+
+// ListenAndServe runs the server until ctx is done. If no port is
+// configured, it does nothing.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	if s.config.Port == "" {
+		log.Warn().Msgf("Admin port is not configured, admin endpoints are disabled")
+		return nil
+	}
+	if len(s.principals) == 0 {
+		log.Warn().Msgf("No admin principals are configured, all admin requests will be rejected")
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", s.config.Port), Handler: s.mux}
+	if s.config.ClientCA != "" {
+		b, err := os.ReadFile(s.config.ClientCA)
+		if err != nil {
+			return fmt.Errorf("reading %q: %w", s.config.ClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %q", s.config.ClientCA)
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs: pool,
+			// Bearer tokens are still accepted without a certificate.
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info().Msgf("Starting admin HTTP listener on %q...", s.config.Port)
+		if s.config.TLSCert != "" {
+			errCh <- srv.ListenAndServeTLS(s.config.TLSCert, s.config.TLSKey)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		if err := srv.Shutdown(context.Background()); err != nil {
+			return fmt.Errorf("admin HTTP server shutdown failed: %w", err)
+		}
+		return nil
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,183 @@
+package adminserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthentication(t *testing.T) {
+	type testCase struct {
+		path       string
+		token      string
+		wantStatus int
+		wantActor  string
+	}
+
+	s := &Server{
+		mux: http.NewServeMux(),
+		principals: []Principal{
+			{Name: "alice", Role: RoleWrite, Token: "secret-write"},
+			{Name: "bob", Role: RoleRead, Token: "secret-read"},
+			{Name: "carol", Role: RoleWrite},
+		},
+	}
+	actor := ""
+	handler := func(w http.ResponseWriter, r *http.Request) { actor = Actor(r.Context(), "test") }
+	s.HandleFunc("/read", RoleRead, handler)
+	s.HandleFunc("/write", RoleWrite, handler)
+
+	cases := []testCase{
+		{"/read", "", http.StatusUnauthorized, ""},
+		{"/read", "wrong", http.StatusUnauthorized, ""},
+		{"/read", "secret-read", http.StatusOK, "test:bob"},
+		{"/read", "secret-write", http.StatusOK, "test:alice"},
+		{"/write", "secret-read", http.StatusForbidden, ""},
+		{"/write", "secret-write", http.StatusOK, "test:alice"},
+	}
+
+	for _, tc := range cases {
+		actor = ""
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		if w.Code != tc.wantStatus || actor != tc.wantActor {
+			t.Errorf("%s with token %q: got status %d and actor %q, want %d and %q",
+				tc.path, tc.token, w.Code, actor, tc.wantStatus, tc.wantActor)
+		}
+	}
+}
+
+// newCert issues a certificate for the given CommonName, signed by parent.
+// With nil parent the certificate is a self-signed CA.
+func newCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("creating certificate for %q: %s", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate for %q: %s", name, err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	type testCase struct {
+		path       string
+		cert       *tls.Certificate
+		wantStatus int
+		wantActor  string
+	}
+
+	s := &Server{
+		mux: http.NewServeMux(),
+		principals: []Principal{
+			{Name: "alice", Role: RoleWrite, Token: "secret-write"},
+			{Name: "bob", Role: RoleRead},
+		},
+	}
+	actor := ""
+	handler := func(w http.ResponseWriter, r *http.Request) { actor = Actor(r.Context(), "test") }
+	s.HandleFunc("/read", RoleRead, handler)
+	s.HandleFunc("/write", RoleWrite, handler)
+
+	ca := newCert(t, "test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	ts := httptest.NewUnstartedServer(s.mux)
+	ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	alice := newCert(t, "alice", &ca)
+	bob := newCert(t, "bob", &ca)
+	mallory := newCert(t, "mallory", &ca)
+
+	cases := []testCase{
+		{"/read", nil, http.StatusUnauthorized, ""},
+		{"/read", &bob, http.StatusOK, "test:bob"},
+		{"/write", &bob, http.StatusForbidden, ""},
+		{"/write", &alice, http.StatusOK, "test:alice"},
+		{"/read", &mallory, http.StatusUnauthorized, ""},
+	}
+
+	for _, tc := range cases {
+		actor = ""
+		client := ts.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		if tc.cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*tc.cert}
+		}
+		client.Transport = transport
+		name := "no certificate"
+		if tc.cert != nil {
+			name = tc.cert.Leaf.Subject.CommonName
+		}
+
+		resp, err := client.Post(ts.URL+tc.path, "", nil)
+		if err != nil {
+			t.Errorf("%s with %s: %s", tc.path, name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus || actor != tc.wantActor {
+			t.Errorf("%s with %s: got status %d and actor %q, want %d and %q",
+				tc.path, name, resp.StatusCode, actor, tc.wantStatus, tc.wantActor)
+		}
+	}
+
+	// Certificates from other CAs are rejected, even if the name matches.
+	otherCA := newCert(t, "other CA", nil)
+	forged := newCert(t, "alice", &otherCA)
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	// Client would not pick a certificate that the server can't verify,
+	// so force it.
+	transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &forged, nil
+	}
+	client.Transport = transport
+	if resp, err := client.Post(ts.URL+"/write", "", nil); err == nil {
+		resp.Body.Close()
+		t.Errorf("request with a certificate from an untrusted CA got status %d, expected TLS handshake to fail", resp.StatusCode)
+	}
+}
+
+func TestClientCARequiresTLS(t *testing.T) {
+	if _, err := New(Config{Port: "8081", ClientCA: "ca.pem"}); err == nil {
+		t.Errorf("New() with a client CA but without a TLS certificate succeeded, expected an error")
+	}
+}
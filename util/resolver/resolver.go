@@ -84,7 +84,8 @@ func GetPDSEndpointAndPublicKey(ctx context.Context, did string) (*url.URL, stri
 	}
 
 	key := ""
-	for _, m := range doc.VerificationMethod {
+	for i := range doc.VerificationMethod {
+		m := &doc.VerificationMethod[i]
 		if m.ID != fmt.Sprintf("%s#atproto", did) {
 			continue
 		}
@@ -0,0 +1,160 @@
+// Package webhooks defines webhooks that receive matching changes from the
+// change feed, and the dead-letter table for failed deliveries.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/uabluerail/indexer/changes"
+	"github.com/uabluerail/indexer/models"
+)
+
+// Hook is a registered webhook. Empty conditions match everything, and
+// a change is delivered only if it matches all of them.
+type Hook struct {
+	ID        models.ID `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	URL       string    `gorm:"not null" json:"url"`
+	Secret    string    `gorm:"not null" json:"-"`
+	Disabled  bool      `gorm:"default:false" json:"disabled"`
+
+	Collection string `json:"collection,omitempty"`
+	DID        string `gorm:"column:did" json:"did,omitempty"`
+	// Either changes.ActionUpsert or changes.ActionDelete.
+	Action string `json:"action,omitempty"`
+	// Dot-separated path to a value in the record, e.g. "subject" or
+	// "subject.uri", and the value it must be equal to. Non-string values
+	// are compared by their JSON representation.
+	ContentPath  string `json:"contentPath,omitempty"`
+	ContentValue string `json:"contentValue,omitempty"`
+
+	// Seq of the last change processed for this hook.
+	LastSeq int64 `json:"lastSeq"`
+}
+
+func (Hook) TableName() string { return "webhooks" }
+
+// DeadLetter is a change that couldn't be delivered.
+type DeadLetter struct {
+	ID        models.ID       `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time       `gorm:"index" json:"createdAt"`
+	Hook      models.ID       `gorm:"index;not null" json:"hook"`
+	Seq       int64           `gorm:"not null" json:"seq"`
+	Payload   json.RawMessage `gorm:"type:JSONB" json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError"`
+}
+
+func (DeadLetter) TableName() string { return "webhook_dead_letters" }
+
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Hook{}, &DeadLetter{})
+}
+
+// MinLastSeq returns the lowest LastSeq of enabled hooks, or false if
+// there are none. Changes after it are still needed for delivery.
+func MinLastSeq(ctx context.Context, db *gorm.DB) (int64, bool, error) {
+	var seq *int64
+	err := db.WithContext(ctx).Model(&Hook{}).
+		Select("min(last_seq)").
+		Where("not coalesce(disabled, false)").
+		Scan(&seq).Error
+	if err != nil {
+		return 0, false, fmt.Errorf("querying webhook positions: %w", err)
+	}
+	if seq == nil {
+		return 0, false, nil
+	}
+	return *seq, true, nil
+}
+
+// Filter returns a change feed filter that selects a superset of changes
+// matched by the hook.
+func (h *Hook) Filter() changes.Filter {
+	f := changes.Filter{}
+	if h.Collection != "" {
+		f.Collections = []string{h.Collection}
+	}
+	if h.DID != "" {
+		f.DIDs = []string{h.DID}
+	}
+	return f
+}
+
+// Match returns true if the change should be delivered to the hook.
+func (h *Hook) Match(c *changes.Change) bool {
+	if h.Collection != "" && h.Collection != c.Collection {
+		return false
+	}
+	if h.DID != "" && h.DID != c.Repo {
+		return false
+	}
+	if h.Action != "" && h.Action != c.Action {
+		return false
+	}
+	if h.ContentPath != "" {
+		v, found := lookupPath(c.Content, h.ContentPath)
+		if !found || v != h.ContentValue {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPath returns the value at the given path. Strings are returned
+// as is, other values as JSON.
+func lookupPath(content json.RawMessage, path string) (string, bool) {
+	if len(content) == 0 {
+		return "", false
+	}
+	cur := content
+	for _, key := range strings.Split(path, ".") {
+		switch {
+		case bytes.HasPrefix(bytes.TrimSpace(cur), []byte("[")):
+			arr := []json.RawMessage{}
+			if err := json.Unmarshal(cur, &arr); err != nil {
+				return "", false
+			}
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(arr) {
+				return "", false
+			}
+			cur = arr[i]
+		default:
+			obj := map[string]json.RawMessage{}
+			if err := json.Unmarshal(cur, &obj); err != nil {
+				return "", false
+			}
+			v, found := obj[key]
+			if !found {
+				return "", false
+			}
+			cur = v
+		}
+	}
+	s := ""
+	if err := json.Unmarshal(cur, &s); err == nil {
+		return s, true
+	}
+	return string(bytes.TrimSpace(cur)), true
+}
+
+// Signature returns the value of the signature header for the body:
+// hex-encoded HMAC-SHA256, keyed with the hook's secret.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
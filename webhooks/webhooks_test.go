@@ -0,0 +1,68 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/uabluerail/indexer/changes"
+)
+
+func TestMatch(t *testing.T) {
+	block := &changes.Change{
+		Repo:       "did:plc:a",
+		Collection: "app.bsky.graph.block",
+		Action:     changes.ActionUpsert,
+		Content:    json.RawMessage(`{"$type": "app.bsky.graph.block", "subject": "did:plc:us", "createdAt": "2024-01-01T00:00:00Z"}`),
+	}
+	like := &changes.Change{
+		Repo:       "did:plc:b",
+		Collection: "app.bsky.feed.like",
+		Action:     changes.ActionUpsert,
+		Content:    json.RawMessage(`{"subject": {"uri": "at://did:plc:us/app.bsky.feed.post/1", "cid": "bafy"}, "langs": ["uk", "en"], "n": 5}`),
+	}
+	deleted := &changes.Change{
+		Repo:       "did:plc:a",
+		Collection: "app.bsky.graph.block",
+		Action:     changes.ActionDelete,
+	}
+
+	type testCase struct {
+		hook   Hook
+		change *changes.Change
+		want   bool
+	}
+
+	cases := []testCase{
+		{Hook{}, block, true},
+		{Hook{}, deleted, true},
+		{Hook{Collection: "app.bsky.graph.block"}, block, true},
+		{Hook{Collection: "app.bsky.graph.block"}, like, false},
+		{Hook{DID: "did:plc:b"}, like, true},
+		{Hook{DID: "did:plc:b"}, block, false},
+		{Hook{Action: changes.ActionDelete}, deleted, true},
+		{Hook{Action: changes.ActionDelete}, block, false},
+		{Hook{ContentPath: "subject", ContentValue: "did:plc:us"}, block, true},
+		{Hook{ContentPath: "subject", ContentValue: "did:plc:them"}, block, false},
+		{Hook{ContentPath: "subject", ContentValue: "did:plc:us"}, deleted, false},
+		{Hook{ContentPath: "subject.uri", ContentValue: "at://did:plc:us/app.bsky.feed.post/1"}, like, true},
+		{Hook{ContentPath: "subject.uri", ContentValue: "at://did:plc:us/app.bsky.feed.post/1"}, block, false},
+		{Hook{ContentPath: "langs.1", ContentValue: "en"}, like, true},
+		{Hook{ContentPath: "langs.2", ContentValue: "en"}, like, false},
+		{Hook{ContentPath: "n", ContentValue: "5"}, like, true},
+		{Hook{Collection: "app.bsky.graph.block", ContentPath: "subject", ContentValue: "did:plc:us", Action: changes.ActionUpsert}, block, true},
+	}
+
+	for _, tc := range cases {
+		if got := tc.hook.Match(tc.change); got != tc.want {
+			t.Errorf("%+v.Match(%s %s) = %v, want %v", tc.hook, tc.change.Collection, tc.change.Action, got, tc.want)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	// echo -n '{"seq":1}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=21b7373c374f3e6011e9326e253361375dbf5379e3a5d800fbedce47bb99b361"
+	if got := Signature("secret", []byte(`{"seq":1}`)); got != want {
+		t.Errorf("Signature() = %q, want %q", got, want)
+	}
+}